@@ -27,11 +27,14 @@ var https = require('https');
 var setup = require('./setup');
 var cors = require('cors');
 var fs = require('fs');
+var pii = require('./utils/pii');
 
 
 var cpChaincode = null;
 var url = require('url');
 var defaultDemoUser = "WebAppAdmin";
+// Subscriber keys and salts of the home operator, never sent to the chain
+var piiStore = pii.FileStore(path.join(__dirname, 'pii_vault'));
 
 // =====================================================================================================================
 // 												Express Setup
@@ -105,17 +108,33 @@ app.post('/enterData', function (req, res) {
     console.log("Input Params: " + JSON.stringify(req.body));
 
     var data = JSON.parse(req.body.data);
-    var params = new Array();
-    params.push(data.key);
-    params.push(data.msisdn);
-    params.push(data.name);
-    params.push(data.address);
-    params.push(data.ho);
-    params.push(data.lat);
-    params.push(data.long);
-
-    cpChaincode.enterData(defaultDemoUser, params, function (e, data) {
-        cb_received_response(e, data, res);
+    // Name, address, MSISDN and position only go to the chain sealed, the transaction is stored on every peer.
+    // The MSISDN also goes masked and as the digest the chaincode indexes it by.
+    var envelope;
+    try {
+        envelope = pii.protect(piiStore, data.key, data);
+    } catch (e) {
+        return cb_received_response(e, null, res);
+    }
+    cpChaincode.queryMSISDNDigest(defaultDemoUser, [data.msisdn], function (e, result) {
+        if (e) {
+            return cb_received_response(e, null, res);
+        }
+        var digest = JSON.parse(result);
+        var params = new Array();
+        params.push(data.key);
+        params.push(digest.msisdn);
+        params.push(digest.digest);
+        params.push(data.ho);
+        params.push(JSON.stringify(envelope));
+        if (data.imsi || data.iccid) {
+            params.push(data.imsi || '');
+            params.push(data.iccid || '');
+        }
+
+        cpChaincode.enterData(defaultDemoUser, params, function (e, data) {
+            cb_received_response(e, data, res);
+        });
     });
 });
 
@@ -128,8 +147,9 @@ app.post('/discoverRP', function (req, res) {
     params.push(data.key);
     params.push(data.sp);
     params.push(data.loc);
-    params.push(data.lat);
-    params.push(data.long);
+    // The chaincode only takes coarse fixes, the transaction is stored on every peer
+    params.push(pii.coarse(data.lat));
+    params.push(pii.coarse(data.long));
 
     cpChaincode.discoverRP(defaultDemoUser, params, function (e, data) {
         cb_received_response(e, data, res);
@@ -178,6 +198,75 @@ app.post('/CallOut', function (req, res) {
     });
 });
 
+app.post('/CallIn', function (req, res) {
+    console.log("In CallIn!!");
+    console.log("Input Params: " + JSON.stringify(req.body));
+
+    var data = JSON.parse(req.body.data);
+    var params = new Array();
+    params.push(data.key);
+    params.push(data.callingmsisdn);
+
+    cpChaincode.CallIn(defaultDemoUser, params, function (e, data) {
+        cb_received_response(e, data, res);
+    });
+});
+
+app.post('/DataSessionStart', function (req, res) {
+    console.log("In DataSessionStart!!");
+    console.log("Input Params: " + JSON.stringify(req.body));
+
+    var data = JSON.parse(req.body.data);
+    var params = new Array();
+    params.push(data.key);
+
+    cpChaincode.DataSessionStart(defaultDemoUser, params, function (e, data) {
+        cb_received_response(e, data, res);
+    });
+});
+
+app.post('/DataSessionEnd', function (req, res) {
+    console.log("In DataSessionEnd!!");
+    console.log("Input Params: " + JSON.stringify(req.body));
+
+    var data = JSON.parse(req.body.data);
+    var params = new Array();
+    params.push(data.key);
+    params.push(data.bytes);
+
+    cpChaincode.DataSessionEnd(defaultDemoUser, params, function (e, data) {
+        cb_received_response(e, data, res);
+    });
+});
+
+app.post('/SMSOut', function (req, res) {
+    console.log("In SMSOut!!");
+    console.log("Input Params: " + JSON.stringify(req.body));
+
+    var data = JSON.parse(req.body.data);
+    var params = new Array();
+    params.push(data.key);
+    params.push(data.destmsisdn);
+
+    cpChaincode.SMSOut(defaultDemoUser, params, function (e, data) {
+        cb_received_response(e, data, res);
+    });
+});
+
+app.post('/SMSIn', function (req, res) {
+    console.log("In SMSIn!!");
+    console.log("Input Params: " + JSON.stringify(req.body));
+
+    var data = JSON.parse(req.body.data);
+    var params = new Array();
+    params.push(data.key);
+    params.push(data.callingmsisdn);
+
+    cpChaincode.SMSIn(defaultDemoUser, params, function (e, data) {
+        cb_received_response(e, data, res);
+    });
+});
+
 app.post('/CallEnd', function (req, res) {
     console.log("In CallEnd!!");
     console.log("Input Params: " + JSON.stringify(req.body));
@@ -233,6 +322,28 @@ app.post('/resetInventory', function (req, res) {
     });
 });
 
+app.post('/forgetSubscriber', function (req, res) {
+    console.log("In forgetSubscriber!!");
+    console.log("Input Params: " + JSON.stringify(req.body));
+
+    var data = JSON.parse(req.body.data);
+    var params = new Array();
+    params.push(data.key);
+    params.push(data.reason);
+
+    cpChaincode.forgetSubscriber(defaultDemoUser, params, function (e, result) {
+        if (!e) {
+            // The sealed PII stays in the blocks, without the key it can not be opened any more
+            try {
+                piiStore.forget(data.key);
+            } catch (err) {
+                e = err;
+            }
+        }
+        cb_received_response(e, result, res);
+    });
+});
+
 app.post('/delayFunc', function (req, res) {
     
   setTimeout(function(){res.send("Test")},3000)
@@ -435,6 +546,7 @@ chain_setup.setupChain(keyValStoreDir, users, peerURLs, caURL, certificate, cert
         cpChaincode = new chaincode_ops.CPChaincode(chain, chaincodeID);
 
         part2.setup(peers, cpChaincode);
+        listen_for_chaincode_events(chain, chaincodeID);
         //setup_helpers(cpChaincode);
 
         // Now that the chain is ready, start the web socket server so clients can use the demo.
@@ -447,6 +559,32 @@ chain_setup.setupChain(keyValStoreDir, users, peerURLs, caURL, certificate, cert
 var ws = require('ws');
 var wss = {};
 
+// The chaincode emits an event for every roaming lifecycle transition.  Event names end in the version of their
+// payload schema, e.g. 'roaming.call.started.v1'.  A transaction with several transitions emits one
+// 'roaming.batch.v1' event listing all of them.  Push them to the browser instead of making it poll.
+function listen_for_chaincode_events(chain, chaincodeID) {
+    if (!peers || !peers[0] || !peers[0].event_host) {
+        console.log(TAG, 'no event hub in the peer credentials, chaincode events will not be pushed');
+        return;
+    }
+    chain.eventHubConnect('grpcs://' + peers[0].event_host + ':' + peers[0].event_port, {pem: certificate});
+    process.on('exit', function () {
+        chain.eventHubDisconnect();
+    });
+
+    chain.getEventHub().registerChaincodeEvent(chaincodeID, '^roaming\\.', function (event) {
+        var payload;
+        try {
+            payload = JSON.parse(event.payload.toString());
+        }
+        catch (e) {
+            console.log(TAG, 'could not parse chaincode event', event.event_name, e);
+            return;
+        }
+        if (wss.broadcast) wss.broadcast({ msg: 'chaincode_event', name: event.event_name, event: payload });
+    });
+}
+
 function start_websocket_server(error, d) {
     if (error != null) {
         //look at tutorial_part1.md in the trouble shooting section for help
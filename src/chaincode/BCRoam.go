@@ -19,7 +19,6 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"time"
 
@@ -27,10 +26,6 @@ import (
 )
 
 
-
-var rsmap map[string]string
-
-
 // SimpleChaincode example simple Chaincode implementation
 type SimpleChaincode struct {
 }
@@ -46,16 +41,28 @@ type rsDetailBlock struct {
 	RP          string    `json:"rp"`
 	Roaming     string    `json:"roaming"`
 	Location    string    `json:"location"`
-	Lat    	    string    `json:"lat"`
-	Long        string    `json:"long"`
+	Lat    	    Degrees   `json:"lat"`
+	Long        Degrees   `json:"long"`
 	RateType    string    `json:"ratetype"`
 	Action      string    `json:"action"`
 	TransType   string    `json:"transtype"`
 	Destination string    `json:"destination"`
 	Duration    float64    `json:"duration"`
-	Charges     float64    `json:"charges"`
-	Flag        string    `json:"flag"`
+	Charges     Money     `json:"charges"`
+	Currency    string    `json:"currency"`
+	Flag        string    `json:"flag,omitempty"`
+	Flags       []string  `json:"flags,omitempty"`
 	Time        time.Time `json:"time"`
+	CDRSeq      int       `json:"cdrseq"`
+	CurrentCDR  string    `json:"currentcdr"`
+	FixTime     time.Time `json:"fixtime"`
+	IMSI        string    `json:"imsi"`
+	ICCID       string    `json:"iccid"`
+	State       string    `json:"state"`
+	UsageSeq    int       `json:"usageseq"`
+	CurrentData string    `json:"currentdata"`
+	PII         *PIIEnvelope `json:"pii,omitempty"`
+	MSISDNDigest string    `json:"msisdndigest,omitempty"`
 }
 
 type rsDetail struct {
@@ -90,46 +97,42 @@ func showArgs(args []string) {
 	fmt.Printf("\n")
 }
 
+//txTime returns the timestamp of the current transaction. Every peer sees the
+//same value, unlike time.Now(), so it is safe to write to the ledger.
+func txTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		fmt.Println("Error - could not get transaction timestamp")
+		return time.Time{}, internalError("Error getting transaction timestamp")
+	}
+	if ts == nil {
+		return time.Time{}, internalError("Transaction has no timestamp")
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
 // Init function
+//	args: [fixture (JSON, see fixture.go)], the demo dataset when there is none
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 
-	//var err error
-
 	fmt.Println("Launching Init Function")
-	//To add Time Stamp
-	currentDateStr := time.Now().Format(time.RFC822)
-	currtime, _ := time.Parse(time.RFC822, currentDateStr)
-	//Inventory hard coded here
-	rs1 := rsDetailBlock{"rs1", "14691234567", "A", "DC", "ABC", "", "FALSE", "DC","32.942746","38.91","", "", "", "", 0.0, 0.0, "", currtime}
-	rs2 := rsDetailBlock{"rs2", "14691234568", "B", "DALLAS", "ABC", "", "FALSE", "DALLAS","32.942746","-96.994838","", "", "", "", 0.0, 0.0, "", currtime}
-	rs3 := rsDetailBlock{"rs3", "14691234569", "C", "SF", "ABC", "", "FALSE", "SF","37.776","-122.414","", "", "", "", 0.0, 0.0, "", currtime}
-	rs4 := rsDetailBlock{"rs4", "03097218855", "D", "BERLIN", "XYZ", "", "FALSE", "BERLIN","52.5200","13.4050","", "", "", "", 0.0, 0.0, "", currtime}
-	rs5 := rsDetailBlock{"rs5", "349091234567", "E", "BARCELONA", "XYZ", "", "FALSE", "BARCELONA","41.3851","2.1734","", "", "", "", 0.0, 0.0, "", currtime}
-	rs6 := rsDetailBlock{"rs6", "349091234568", "F", "BARCELONA", "XYZ", "", "FALSE", "BARCELONA","41.385064","2.173403","", "", "", "", 0.0, 0.0, "", currtime}
-	rs7 := rsDetailBlock{"rs7", "349091234569", "G", "BARCELONA", "XYZ", "", "FALSE", "BARCELONA","41.385064","2.173403","", "", "", "", 0.0, 0.0, "", currtime}
-
-	rsmap = make(map[string]string)
-	rsmap["rs1"] = "14691234567"
-	rsmap["rs2"] = "14691234568"
-	rsmap["rs3"] = "14691234569"
-	rsmap["rs4"] = "03097218855"
-	rsmap["rs5"] = "349091234567"
-	rsmap["rs6"] = "349091234568"
-	rsmap["rs7"] = "349091234569"
-	rsmap["rs8"] = ""
-
-
-	//Create array for all adspots in ledger
-	//var AllPeersArray AllPeers
-
-	t.putMSIDN(stub, rs1, rs1.PublicKey)
-	t.putMSIDN(stub, rs2, rs2.PublicKey)
-	t.putMSIDN(stub, rs3, rs3.PublicKey)
-	t.putMSIDN(stub, rs4, rs4.PublicKey)
-	t.putMSIDN(stub, rs5, rs5.PublicKey)
-	t.putMSIDN(stub, rs6, rs6.PublicKey)
-	t.putMSIDN(stub, rs7, rs7.PublicKey)
-
+	if len(args) > 1 {
+		return nil, validationError("Init takes at most one argument, a fixture")
+	}
+	var fixture Fixture
+	var err error
+	if len(args) == 1 {
+		fixture, err = parseFixture(args[0])
+	} else {
+		fixture, err = defaultFixture()
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = resetFixture(stub, fixture)
+	if err != nil {
+		return nil, err
+	}
 
 	fmt.Println("Init Function Complete")
 	return nil, nil
@@ -138,46 +141,19 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string
 func (t *SimpleChaincode) resetInventory(stub shim.ChaincodeStubInterface) ([]byte, error) {
 
 	fmt.Println("resetting Inventory")
-	//To add Time Stamp
-	currentDateStr := time.Now().Format(time.RFC822)
-	currtime, _ := time.Parse(time.RFC822, currentDateStr)
-	//Inventory hard coded here
-	rs1 := rsDetailBlock{"rs1", "14691234567", "A", "DC", "ABC", "", "FALSE", "DC","32.942746","38.91","", "", "", "", 0.0, 0.0, "", currtime}
-	rs2 := rsDetailBlock{"rs2", "14691234568", "B", "DALLAS", "ABC", "", "FALSE", "DALLAS","32.942746","-96.994838","", "", "", "", 0.0, 0.0, "", currtime}
-	rs3 := rsDetailBlock{"rs3", "14691234569", "C", "SF", "ABC", "", "FALSE", "SF","37.776","-122.414","", "", "", "", 0.0, 0.0, "", currtime}
-	rs4 := rsDetailBlock{"rs4", "03097218855", "D", "BERLIN", "XYZ", "", "FALSE", "BERLIN","52.5200","13.4050","", "", "", "", 0.0, 0.0, "", currtime}
-	rs5 := rsDetailBlock{"rs5", "349091234567", "E", "BARCELONA", "XYZ", "", "FALSE", "BARCELONA","41.3851","2.1734","", "", "", "", 0.0, 0.0, "", currtime}
-	rs6 := rsDetailBlock{"rs6", "349091234568", "F", "BARCELONA", "XYZ", "", "FALSE", "BARCELONA","41.385064","2.173403","", "", "", "", 0.0, 0.0, "", currtime}
-	rs7 := rsDetailBlock{"rs7", "349091234569", "G", "BARCELONA", "XYZ", "", "FALSE", "BARCELONA","41.385064","2.173403","", "", "", "", 0.0, 0.0, "", currtime}
-
-    if len(rsmap) != 0{
-	rsmap["rs1"] = "14691234567"
-	rsmap["rs2"] = "14691234568"
-	rsmap["rs3"] = "14691234569"
-	rsmap["rs4"] = "03097218855"
-	rsmap["rs5"] = "349091234567"
-	rsmap["rs6"] = "349091234568"
-	rsmap["rs7"] = "349091234569"
-	rsmap["rs8"] = ""
-   }else{
-		fmt.Println("Map is empty: ",len(rsmap))
-	}
-
-	//Create array for all adspots in ledger
-	//var AllPeersArray AllPeers
-
-	t.putMSIDN(stub, rs1, rs1.PublicKey)
-	t.putMSIDN(stub, rs2, rs2.PublicKey)
-	t.putMSIDN(stub, rs3, rs3.PublicKey)
-	t.putMSIDN(stub, rs4, rs4.PublicKey)
-	t.putMSIDN(stub, rs5, rs5.PublicKey)
-	t.putMSIDN(stub, rs6, rs6.PublicKey)
-	t.putMSIDN(stub, rs7, rs7.PublicKey)
+	if err := requireRole(stub, "reset the inventory", roleAdmin); err != nil {
+		return nil, err
+	}
+	fixture, err := defaultFixture()
+	if err != nil {
+		return nil, err
+	}
+	err = resetFixture(stub, fixture)
+	if err != nil {
+		return nil, err
+	}
 
 	fmt.Println("Reset Function Complete")
-	
-
-	
 	return nil, nil
 
 }
@@ -188,11 +164,14 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function stri
 	fmt.Printf("Invoke called, determining function :%v", function)
 
 	showArgs(args)
-	var key, sp, loc, lat,long,msisdn,name,address,ho, destmsisdn string
+	var key, sp, loc, lat,long,msisdn,digest,ho, destmsisdn string
 
 	// Handle different functions
 	if function == "discoverRP" {
 		fmt.Printf("Function is discoverRP")
+		if err := checkArgs("discoverRP", args, 5, "key, rp, location, lat and long"); err != nil {
+			return nil, err
+		}
 		key = args[0]
 		sp = args[1]
 		loc = args[2]
@@ -201,44 +180,157 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function stri
 		return t.discoverRP(stub, key, sp, loc,lat,long)
 	} else if function == "authentication" {
 		fmt.Printf("Function is authentication")
+		if err := checkArgs("authentication", args, 1, "subscriber key"); err != nil {
+			return nil, err
+		}
 		key = args[0]
 		return t.authentication(stub, key)
 	} else if function == "updateRates" {
 		fmt.Printf("Function is updateRates")
+		if err := checkArgs("updateRates", args, 1, "subscriber key"); err != nil {
+			return nil, err
+		}
 		key = args[0]
 		return t.updateRates(stub, key)
 	} else if function == "CallOut" {
 		fmt.Printf("Function is CallOut")
+		if err := checkArgs("CallOut", args, 2, "subscriber key and destination msisdn"); err != nil {
+			return nil, err
+		}
 		key = args[0]
 		destmsisdn = args[1]
 		return t.CallOut(stub, key, destmsisdn)
+	} else if function == "CallIn" {
+		fmt.Printf("Function is CallIn")
+		if err := checkArgs("CallIn", args, 2, "subscriber key and calling msisdn"); err != nil {
+			return nil, err
+		}
+		key = args[0]
+		callingmsisdn := args[1]
+		return t.CallIn(stub, key, callingmsisdn)
+	} else if function == "DataSessionStart" {
+		fmt.Printf("Function is DataSessionStart")
+		return t.DataSessionStart(stub, args)
+	} else if function == "DataSessionEnd" {
+		fmt.Printf("Function is DataSessionEnd")
+		return t.DataSessionEnd(stub, args)
+	} else if function == "SMSOut" {
+		fmt.Printf("Function is SMSOut")
+		return t.SMSOut(stub, args)
+	} else if function == "SMSIn" {
+		fmt.Printf("Function is SMSIn")
+		return t.SMSIn(stub, args)
+	} else if function == "setPlan" {
+		fmt.Printf("Function is setPlan")
+		return t.setPlan(stub, args)
+	} else if function == "addBundle" {
+		fmt.Printf("Function is addBundle")
+		return t.addBundle(stub, args)
+	} else if function == "closeSettlementPeriod" {
+		fmt.Printf("Function is closeSettlementPeriod")
+		return t.closeSettlementPeriod(stub, args)
+	} else if function == "acceptStatement" {
+		fmt.Printf("Function is acceptStatement")
+		return t.acceptStatement(stub, args)
+	} else if function == "disputeStatement" {
+		fmt.Printf("Function is disputeStatement")
+		return t.disputeStatement(stub, args)
+	} else if function == "raiseDispute" {
+		fmt.Printf("Function is raiseDispute")
+		return t.raiseDispute(stub, args)
+	} else if function == "acceptDispute" {
+		fmt.Printf("Function is acceptDispute")
+		return t.acceptDispute(stub, args)
+	} else if function == "counterDispute" {
+		fmt.Printf("Function is counterDispute")
+		return t.counterDispute(stub, args)
+	} else if function == "escalateDispute" {
+		fmt.Printf("Function is escalateDispute")
+		return t.escalateDispute(stub, args)
+	} else if function == "resolveDispute" {
+		fmt.Printf("Function is resolveDispute")
+		return t.resolveDispute(stub, args)
+	} else if function == "forgetSubscriber" {
+		fmt.Printf("Function is forgetSubscriber")
+		return t.forgetSubscriber(stub, args)
+	} else if function == "loadFixture" {
+		fmt.Printf("Function is loadFixture")
+		return t.loadFixture(stub, args)
+	} else if function == "publishRates" {
+		fmt.Printf("Function is publishRates")
+		return t.publishRates(stub, args)
+	} else if function == "registerCoverage" {
+		fmt.Printf("Function is registerCoverage")
+		return t.registerCoverage(stub, args)
+	} else if function == "removeCoverage" {
+		fmt.Printf("Function is removeCoverage")
+		return t.removeCoverage(stub, args)
 	} else if function == "CallEnd" {
 		fmt.Printf("Function is CallEnd")
+		if err := checkArgs("CallEnd", args, 1, "subscriber key"); err != nil {
+			return nil, err
+		}
 		key = args[0]
 		return t.CallEnd(stub, key)
 	} else if function == "CallPay" {
 		fmt.Printf("Function is CallPay")
+		if err := checkArgs("CallPay", args, 1, "subscriber key"); err != nil {
+			return nil, err
+		}
 		key = args[0]
 		return t.CallPay(stub, key)
 	} else if function == "Overage" {
 		fmt.Printf("Function is Overage")
+		if err := checkArgs("Overage", args, 1, "subscriber key"); err != nil {
+			return nil, err
+		}
 		key = args[0]
 		return t.Overage(stub, key)
 	} else if function == "resetInventory" {
 		fmt.Printf("Function is resetInventory")
 		return t.resetInventory(stub)
+	} else if function == "createAgreement" {
+		fmt.Printf("Function is createAgreement")
+		return t.createAgreement(stub, args)
+	} else if function == "amendAgreement" {
+		fmt.Printf("Function is amendAgreement")
+		return t.amendAgreement(stub, args)
+	} else if function == "acceptAmendment" {
+		fmt.Printf("Function is acceptAmendment")
+		return t.acceptAmendment(stub, args)
+	} else if function == "suspendAgreement" {
+		fmt.Printf("Function is suspendAgreement")
+		return t.suspendAgreement(stub, args)
+	} else if function == "updateFraudCase" {
+		fmt.Printf("Function is updateFraudCase")
+		return t.updateFraudCase(stub, args)
+	} else if function == "createRateCard" {
+		fmt.Printf("Function is createRateCard")
+		return t.createRateCard(stub, args)
+	} else if function == "registerOperator" {
+		fmt.Printf("Function is registerOperator")
+		return t.registerOperator(stub, args)
+	} else if function == "updateOperator" {
+		fmt.Printf("Function is updateOperator")
+		return t.updateOperator(stub, args)
+	} else if function == "deactivateOperator" {
+		fmt.Printf("Function is deactivateOperator")
+		return t.deactivateOperator(stub, args)
 	}else if function == "enterData" {
 		fmt.Printf("Function is enterData")
+		if len(args) != 7 {
+			if err := checkArgs("enterData", args, 5, "key, masked msisdn, msisdn digest, ho, pii envelope and optionally imsi and iccid"); err != nil {
+				return nil, err
+			}
+			args = append(args, "", "")
+		}
 		key =args[0]
 		msisdn =args[1]
-		name =args[2]
-		address =args[3]
-		ho =args[4]
-		lat =args[5]
-		long =args[6]
-		return t.enterData(stub,key,msisdn,name,address,ho,lat,long)
-	}
-	return nil, errors.New("Received unknown function invocation")
+		digest =args[2]
+		ho =args[3]
+		return t.enterData(stub,key,msisdn,digest,ho,args[4],args[5],args[6])
+	}
+	return nil, validationError("Received unknown function invocation " + function)
 }
 
 //QUERY FUNCTION
@@ -250,392 +342,645 @@ func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function strin
 	if function == "queryMSISDN" {
 		fmt.Printf("Function is queryPeers")
 		return t.queryMSISDN(stub, args)
-	} else {
-		fmt.Printf("Invalid Function!")
+	} else if function == "queryCDRs" {
+		fmt.Printf("Function is queryCDRs")
+		return t.queryCDRs(stub, args)
+	} else if function == "queryCDR" {
+		fmt.Printf("Function is queryCDR")
+		return t.queryCDR(stub, args)
+	} else if function == "queryAgreement" {
+		fmt.Printf("Function is queryAgreement")
+		return t.queryAgreement(stub, args)
+	} else if function == "queryAttachment" {
+		fmt.Printf("Function is queryAttachment")
+		return t.queryAttachment(stub, args)
+	} else if function == "queryFraudCase" {
+		fmt.Printf("Function is queryFraudCase")
+		return t.queryFraudCase(stub, args)
+	} else if function == "queryFraudCases" {
+		fmt.Printf("Function is queryFraudCases")
+		return t.queryFraudCases(stub, args)
+	} else if function == "queryRateCards" {
+		fmt.Printf("Function is queryRateCards")
+		return t.queryRateCards(stub, args)
+	} else if function == "querySubscriberByMSISDN" {
+		fmt.Printf("Function is querySubscriberByMSISDN")
+		return t.querySubscriberByMSISDN(stub, args)
+	} else if function == "querySubscriberByIMSI" {
+		fmt.Printf("Function is querySubscriberByIMSI")
+		return t.querySubscriberByIMSI(stub, args)
+	} else if function == "querySubscriberByICCID" {
+		fmt.Printf("Function is querySubscriberByICCID")
+		return t.querySubscriberByICCID(stub, args)
+	} else if function == "listSubscribersByOperator" {
+		fmt.Printf("Function is listSubscribersByOperator")
+		return t.listSubscribersByOperator(stub, args)
+	} else if function == "listSubscribers" {
+		fmt.Printf("Function is listSubscribers")
+		return t.listSubscribers(stub, args)
+	} else if function == "listRoamers" {
+		fmt.Printf("Function is listRoamers")
+		return t.listRoamers(stub, args)
+	} else if function == "listFlagged" {
+		fmt.Printf("Function is listFlagged")
+		return t.listFlagged(stub, args)
+	} else if function == "listUpdated" {
+		fmt.Printf("Function is listUpdated")
+		return t.listUpdated(stub, args)
+	} else if function == "queryOperator" {
+		fmt.Printf("Function is queryOperator")
+		return t.queryOperator(stub, args)
+	} else if function == "listOperators" {
+		fmt.Printf("Function is listOperators")
+		return t.listOperators(stub, args)
+	} else if function == "queryUsage" {
+		fmt.Printf("Function is queryUsage")
+		return t.queryUsage(stub, args)
+	} else if function == "queryAllowance" {
+		fmt.Printf("Function is queryAllowance")
+		return t.queryAllowance(stub, args)
+	} else if function == "queryStatement" {
+		fmt.Printf("Function is queryStatement")
+		return t.queryStatement(stub, args)
+	} else if function == "queryStatements" {
+		fmt.Printf("Function is queryStatements")
+		return t.queryStatements(stub, args)
+	} else if function == "queryDispute" {
+		fmt.Printf("Function is queryDispute")
+		return t.queryDispute(stub, args)
+	} else if function == "queryDisputeSummary" {
+		fmt.Printf("Function is queryDisputeSummary")
+		return t.queryDisputeSummary(stub, args)
+	} else if function == "dumpState" {
+		fmt.Printf("Function is dumpState")
+		return t.dumpState(stub, args)
+	} else if function == "queryRates" {
+		fmt.Printf("Function is queryRates")
+		return t.queryRates(stub, args)
+	} else if function == "queryCoverage" {
+		fmt.Printf("Function is queryCoverage")
+		return t.queryCoverage(stub, args)
+	} else if function == "queryLocationTrail" {
+		fmt.Printf("Function is queryLocationTrail")
+		return t.queryLocationTrail(stub, args)
+	} else if function == "verifyPII" {
+		fmt.Printf("Function is verifyPII")
+		return t.verifyPII(stub, args)
+	} else if function == "queryErasure" {
+		fmt.Printf("Function is queryErasure")
+		return t.queryErasure(stub, args)
+	} else if function == "querySessionState" {
+		fmt.Printf("Function is querySessionState")
+		return t.querySessionState(stub, args)
+	} else if function == "queryMSISDNDigest" {
+		fmt.Printf("Function is queryMSISDNDigest")
+		return t.queryMSISDNDigest(stub, args)
 	}
 
-	return nil, nil
+	fmt.Printf("Invalid Function!")
+	return nil, validationError("Received unknown function query " + function)
 }
 
 ////////////////////////////////////////////////////
 
 //Redirect FUNCTIONS
 
-//Query MSISDN in our network
+//Query a subscriber by its key. Despite the name it does not take an MSISDN, use querySubscriberByMSISDN for that
 func (t *SimpleChaincode) queryMSISDN(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	fmt.Println("queryMSISDN called")
+	if err := checkArgs("queryMSISDN", args, 1, "subscriber key"); err != nil {
+		return nil, err
+	}
 	var key string
 	key = args[0]
-	fmt.Println("Key: %v", key)
-	bytes, _ := stub.GetState(key)
-	fmt.Println(string(bytes))
-	fmt.Printf("%x", bytes)
-	return bytes, nil
+	fmt.Printf("Key: %v\n", key)
+	rs, err := getSubscriber(stub, key)
+	if err != nil {
+		return nil, err
+	}
+	err = requireSubscriberRead(stub, rs)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(subscriberView(stub, rs))
 }
 
-func (t *SimpleChaincode) enterData(stub shim.ChaincodeStubInterface, key string,msisdn string,name string,address string,ho string,lat string,long string) ([]byte, error) {
+//The name, address, MSISDN and home position of the subscriber only come in
+//the pii envelope the home operator sealed, the MSISDN also masked and as
+//its digest, see privacy.go
+func (t *SimpleChaincode) enterData(stub shim.ChaincodeStubInterface, key string,msisdn string,digest string,ho string,pii string,imsi string,iccid string) ([]byte, error) {
+
+	//Only the home operator enters its subscribers, and only its own ones may be re-entered
+	err := requireOperator(stub, "enter subscribers of "+ho, ho)
+	if err != nil {
+		return nil, err
+	}
+	if err = validateSubscriberKey(key); err != nil {
+		return nil, err
+	}
+	//Subscribers can only be homed on a member operator
+	if _, err = activeOperator(stub, ho); err != nil {
+		return nil, err
+	}
+	//A subscriber entered again keeps its record sequences, so its next CDR
+	//or usage record does not take the key of one it already has
+	var cdrSeq, usageSeq int
+	if existing, err := getSubscriber(stub, key); err == nil {
+		if err = requireHomeOperator(stub, existing, "modify subscriber"); err != nil {
+			return nil, err
+		}
+		if existing.State == stateForgotten {
+			return nil, conflictError("Subscriber " + key + " was forgotten and can not be entered again")
+		}
+		cdrSeq, usageSeq = existing.CDRSeq, existing.UsageSeq
+	}
+	envelope, err := parsePIIEnvelope(pii)
+	if err != nil {
+		return nil, err
+	}
+	if err = parseMaskedMSISDN(msisdn, digest); err != nil {
+		return nil, err
+	}
 
 	var rsDetailObj rsDetailBlock
 	rsDetailObj.PublicKey = key
 	rsDetailObj.MSISDN = msisdn
-	rsDetailObj.Name = name
-	rsDetailObj.Address = address
+	rsDetailObj.MSISDNDigest = digest
 	rsDetailObj.HO = ho
 	rsDetailObj.RP = ""
 	rsDetailObj.Roaming = "FALSE"
-	rsDetailObj.Location = address
-	rsDetailObj.Lat = lat
-	rsDetailObj.Long = long
 	rsDetailObj.RateType = ""
 	rsDetailObj.Action = ""
 	rsDetailObj.TransType = ""
 	rsDetailObj.Destination = ""
 	rsDetailObj.Duration = 0.0
 	rsDetailObj.Charges = 0.0
-	rsDetailObj.Flag = ""
+	rsDetailObj.Currency = ""
+	rsDetailObj.IMSI = imsi
+	rsDetailObj.ICCID = iccid
+	rsDetailObj.State = stateIdle
+	rsDetailObj.CDRSeq = cdrSeq
+	rsDetailObj.UsageSeq = usageSeq
+	rsDetailObj.PII = envelope
 	//Get Current Time
-	currentDateStr := time.Now().Format(time.RFC822)
-	rsDetailObj.Time, _ = time.Parse(time.RFC822, currentDateStr)
+	currtime, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	rsDetailObj.Time = currtime
 	
 	fmt.Println(rsDetailObj)
-	bytes, _ := json.Marshal(rsDetailObj)
-	fmt.Println(string(bytes))
-
-	err2 := stub.PutState(rsDetailObj.PublicKey, bytes)
-	if err2 != nil {
-		fmt.Println("Error - could not Marshall in rsDetailObj")
-	} else {
-		fmt.Println("Success -  works")
+	err = registerSubscriber(stub, rsDetailObj)
+	if err != nil {
+		return nil, err
 	}
 
 	return nil, nil
 }
 
-//putNetworkPeers: To put an array containing pointers to all blocks for a particular user(or peer) on the ledger
-func (t *SimpleChaincode) putMSIDN(stub shim.ChaincodeStubInterface, rs rsDetailBlock, key string) ([]byte, error) {
-	//marshalling
-	fmt.Println(" Initializing msisdn: ", key)
-	fmt.Printf("put details: %+v ", rs)
-	fmt.Printf("\n")
-	bytes, _ := json.Marshal(rs)
-	fmt.Println(string(bytes))
-	err2 := stub.PutState(key, bytes)
-	
-	if err2 != nil {
-		fmt.Println("Error - could not Marshall in msisdn")
-		//return nil, err
-	} else {
-		fmt.Println("Success - Marshall in msisdn details")
-	}
-	return nil, nil
-}
-
 //Remote Partner Discovery
 func (t *SimpleChaincode) discoverRP(stub shim.ChaincodeStubInterface, key string, sp string, loc string,lat string,long string) ([]byte, error) {
 
-	bytes, err := stub.GetState(key)
+	rsDetailobj, err := getSubscriber(stub, key)
 	if err != nil {
-		fmt.Println("Error - Could not get User details : %s", key)
-		//return nil, err
-	} else {
-		fmt.Println("Success - User details found %s", key)
+		return nil, err
 	}
-
-	var rsDetailobj rsDetailBlock
-	err = json.Unmarshal(bytes, &rsDetailobj)
+	//The network reporting the fix, or the home operator
+	err = requireOperator(stub, "report the location of "+key, sp, rsDetailobj.HO)
+	if err != nil {
+		return nil, err
+	}
+	//Only member operators can serve roamers, and only away from home
+	if _, err = activeOperator(stub, sp); err != nil {
+		return nil, err
+	}
+	if sp == rsDetailobj.HO {
+		return nil, validationError(sp + " is the home operator of " + key + ", only a visited network can be discovered")
+	}
+	position, err := parsePosition(lat, long)
+	if err != nil {
+		return nil, err
+	}
+	//The fix is in the transaction for good, only a coarse one is taken
+	if !position.coarse() {
+		return nil, validationError(fmt.Sprintf("Report the position rounded to %d decimals, not %s, %s", positionDecimals, lat, long))
+	}
+	if err = advance(&rsDetailobj, "discoverRP"); err != nil {
+		return nil, err
+	}
+	currtime, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	//The fix is checked against the coverage of the visited network
+	hits, err := checkCoverage(stub, sp, position)
+	if err != nil {
+		return nil, err
+	}
+	//Compare the new fix with the previous one before it is overwritten
+	hits = append(checkImpossibleTravel(rsDetailobj, position, currtime), hits...)
 	rsDetailobj.RP = sp
 	rsDetailobj.Location = loc
-	rsDetailobj.Lat = lat
-	rsDetailobj.Long = long
+	rsDetailobj.Lat = position.Lat
+	rsDetailobj.Long = position.Long
+	rsDetailobj.FixTime = currtime
 	rsDetailobj.Action = "Discovery"
 	rsDetailobj.TransType = "Setup"
-	currentDateStr := time.Now().Format(time.RFC822)
-	rsDetailobj.Time, _ = time.Parse(time.RFC822, currentDateStr)
-	bytes2, _ := json.Marshal(rsDetailobj)
-	err2 := stub.PutState(rsDetailobj.PublicKey, bytes2)
-	if err2 != nil {
-		fmt.Println("Error - could not Marshall in msisdn")
-	} else {
-		fmt.Println("Success, updated record")
+	rsDetailobj.Time = currtime
+	fraudEvents, err := openFraudCases(stub, &rsDetailobj, hits, currtime)
+	if err != nil {
+		return nil, err
+	}
+	err = putSubscriber(stub, rsDetailobj)
+	if err != nil {
+		return nil, err
+	}
+	fix := LocationFix{PublicKey: key, Time: currtime, TxID: stub.GetTxID(), RP: sp, Location: loc, Lat: position.Lat, Long: position.Long}
+	for _, hit := range hits {
+		fix.Flags = append(fix.Flags, hit.Rule)
+	}
+	if err = appendLocation(stub, fix); err != nil {
+		return nil, err
 	}
 
-	if len(rsmap) != 0{
-	 rsmap[key]=""
-         }else{
-		fmt.Println("Map is empty: ",len(rsmap))
-		}
+	//The subscriber leaves its current network until it authenticates on the new one
+	digest, err := subscriberDigest(stub, rsDetailobj)
+	if err != nil {
+		return nil, err
+	}
+	err = detach(stub, digest, rsDetailobj.PublicKey)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil, nil
+	event := newEvent(stub, eventDiscovery, rsDetailobj, currtime, DiscoveryEvent{Location: loc, Lat: position.Lat, Long: position.Long})
+	return nil, setEvents(stub, append([]RoamingEvent{event}, fraudEvents...))
 }
 
 //Authentication
 func (t *SimpleChaincode) authentication(stub shim.ChaincodeStubInterface, keyy string) ([]byte, error) {
 
-	bytes, err := stub.GetState(keyy)
+	rsDetailobj, err := getSubscriber(stub, keyy)
 	if err != nil {
-		fmt.Println("Error - Could not get User details : %s", keyy)
-		//return nil, err
-	} else {
-		fmt.Println("Success - User details found %s", keyy)
+		return nil, err
+	}
+
+	err = requireServingNetwork(stub, rsDetailobj, "authenticate")
+	if err != nil {
+		return nil, err
+	}
+	if err = advance(&rsDetailobj, "authentication"); err != nil {
+		return nil, err
 	}
 
 	var ho, rp, msisdn string
 
-	var rsDetailobj rsDetailBlock
-	err = json.Unmarshal(bytes, &rsDetailobj)
 	ho = rsDetailobj.HO
 	rp = rsDetailobj.RP
 	msisdn = rsDetailobj.MSISDN
-	//ADDING LOGIC FOR FRAUD:
-	for key, value := range rsmap {
-		if msisdn == value{
-			rsDetailobj.Flag="Fraud"
-			break
-		}
-        fmt.Println("Key:", key, "Value:", value)
-     }
-
-	 if keyy=="rs8"{
-		rsDetailobj.Flag="Fraud" 
-	 }
+	currtime, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
 
+	//ADDING LOGIC FOR FRAUD:
+	hits, err := checkSIMClone(stub, rsDetailobj)
+	if err != nil {
+		return nil, err
+	}
+	fraudEvents, err := openFraudCases(stub, &rsDetailobj, hits, currtime)
+	if err != nil {
+		return nil, err
+	}
 
-    if rsDetailobj.Flag!="Fraud"{
-	          if len(rsmap) != 0{
-			 rsmap[keyy] = msisdn
-			}else{
-				fmt.Println("Map is empty: ",len(rsmap))
-			}
+	//A clone must not take over the attachment of the real subscriber
+	if len(hits) == 0 {
+		network := rp
+		if network == "" {
+			network = ho
+		}
+		digest, err := subscriberDigest(stub, rsDetailobj)
+		if err != nil {
+			return nil, err
+		}
+		err = putAttachment(stub, digest, Attachment{MSISDN: mask(msisdn), PublicKey: keyy, Network: network, Time: currtime})
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	////// Add logic for authentication here
+	////// Roaming is allowed only under an agreement in force between HO and RP
+	authEvent := eventAuthenticated
+	var reason string
 	if rp == "" {
 		        rsDetailobj.Roaming = "False"
 			rsDetailobj.Action = "Authentication"
 			rsDetailobj.TransType = "Setup"
 			fmt.Println("Authentication Successfull")
-	} else if rp == "XYZ" {
-		if ho == "ABC" {
-			rsDetailobj.Roaming = "True"
-			rsDetailobj.Action = "Authentication"
-			rsDetailobj.TransType = "Setup"
-			fmt.Println("Authentication Successfull")
-		}
-	} else if rp == "ABC" {
-		if ho == "XYZ" {
+	} else if _, err = activeAgreement(stub, ho, rp, currtime); err == nil {
 			rsDetailobj.Roaming = "True"
 			rsDetailobj.Action = "Authentication"
 			rsDetailobj.TransType = "Setup"
 			fmt.Println("Authentication Successfull")
-		}
 	}else {
-		fmt.Println("Authentication Failed")
+		fmt.Println("Authentication Failed: " + err.Error())
+		authEvent = eventAuthFailed
+		//Not authenticated, it has to authenticate again before rates and calls
+		rsDetailobj.State = stateDiscovered
+		reason = err.Error()
+		if ce, ok := err.(*ChaincodeError); ok {
+			reason = ce.Message
+		}
 	}
 
-	//rsDetailobj.Roaming="True"
-	//rsDetailobj.Action="Authentication"
-	//rsDetailobj.TransType="Setup"
-
 	////////////////////////////////////////////
-	currentDateStr := time.Now().Format(time.RFC822)
-	rsDetailobj.Time, _ = time.Parse(time.RFC822, currentDateStr)
-	bytes2, _ := json.Marshal(rsDetailobj)
-	err2 := stub.PutState(rsDetailobj.PublicKey, bytes2)
-	if err2 != nil {
-		fmt.Println("Error - could not Marshall in msisdn")
-	} else {
-		fmt.Println("Success, updated record")
+	rsDetailobj.Time = currtime
+	err = putSubscriber(stub, rsDetailobj)
+	if err != nil {
+		return nil, err
 	}
 	
 
-	return nil, nil
+	event := newEvent(stub, authEvent, rsDetailobj, currtime, AuthenticationEvent{Roaming: rsDetailobj.Roaming, Reason: reason})
+	return nil, setEvents(stub, append([]RoamingEvent{event}, fraudEvents...))
 }
 
 //Update voice and data rates
 func (t *SimpleChaincode) updateRates(stub shim.ChaincodeStubInterface, key string) ([]byte, error) {
 
-	bytes, err := stub.GetState(key)
+	rsDetailobj, err := getSubscriber(stub, key)
 	if err != nil {
-		fmt.Println("Error - Could not get User details : %s", key)
-		//return nil, err
-	} else {
-		fmt.Println("Success - User details found %s", key)
+		return nil, err
+	}
+	err = requireServingNetwork(stub, rsDetailobj, "register rates")
+	if err != nil {
+		return nil, err
+	}
+	if err = advance(&rsDetailobj, "updateRates"); err != nil {
+		return nil, err
 	}
-
-	var rsDetailobj rsDetailBlock
 	var sp string
-	err = json.Unmarshal(bytes, &rsDetailobj)
+	rsDetailobj.Time, err = txTime(stub)
+	if err != nil {
+		return nil, err
+	}
 	if rsDetailobj.Roaming == "True" {
 		sp = rsDetailobj.RP
-		if sp == "XYZ" {
-			rsDetailobj.RateType = "RoamingXYZ"
-		}else if sp == "ABC" {
-			rsDetailobj.RateType = "RoamingABC"
+		agreement, err := activeAgreement(stub, rsDetailobj.HO, sp, rsDetailobj.Time)
+		if err != nil {
+			fmt.Println("Error - " + err.Error())
+			return nil, err
 		}
+		rsDetailobj.RateType = agreement.RatePlan
 	}
-	currentDateStr := time.Now().Format(time.RFC822)
-	rsDetailobj.Time, _ = time.Parse(time.RFC822, currentDateStr)
 	rsDetailobj.Action = "Register"
 	rsDetailobj.TransType = "Setup"
-	bytes2, _ := json.Marshal(rsDetailobj)
-	err2 := stub.PutState(rsDetailobj.PublicKey, bytes2)
-	if err2 != nil {
-		fmt.Println("Error - could not Marshall in msisdn")
-	} else {
-		fmt.Println("Success, updated record")
+	err = putSubscriber(stub, rsDetailobj)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, nil
+	event := newEvent(stub, eventRatesRegistered, rsDetailobj, rsDetailobj.Time, RatesEvent{RatePlan: rsDetailobj.RateType})
+	return nil, setEvents(stub, []RoamingEvent{event})
 }
 
 //Call Out
 func (t *SimpleChaincode) CallOut(stub shim.ChaincodeStubInterface, key string, destmsisdn string) ([]byte, error) {
 
-	bytes, err := stub.GetState(key)
+	rsDetailobj, err := getSubscriber(stub, key)
 	if err != nil {
-		fmt.Println("Error - Could not get User details : %s", key)
-		//return nil, err
-	} else {
-		fmt.Println("Success - User details found %s", key)
+		return nil, err
 	}
-
-	var rsDetailobj rsDetailBlock
-	err = json.Unmarshal(bytes, &rsDetailobj)
-	rsDetailobj.Destination = destmsisdn
+	err = requireServingNetwork(stub, rsDetailobj, "record calls")
+	if err != nil {
+		return nil, err
+	}
+	if err = advance(&rsDetailobj, "CallOut"); err != nil {
+		return nil, err
+	}
+	rsDetailobj.Destination = mask(destmsisdn)
 	rsDetailobj.Action = "Call Initialization"
 	rsDetailobj.TransType = "Call Out"
 	rsDetailobj.Duration = 0.0
 	rsDetailobj.Charges = 0.0
-	currentDateStr := time.Now().Format(time.RFC822)
-	rsDetailobj.Time, _ = time.Parse(time.RFC822, currentDateStr)
-	bytes2, _ := json.Marshal(rsDetailobj)
-	err2 := stub.PutState(rsDetailobj.PublicKey, bytes2)
-	if err2 != nil {
-		fmt.Println("Error - could not Marshall in msisdn")
-	} else {
-		fmt.Println("Success, updated record")
+	rsDetailobj.Currency = ""
+	//Every call gets its own CDR key, the record itself is written on CallEnd
+	rsDetailobj.CDRSeq = rsDetailobj.CDRSeq + 1
+	rsDetailobj.CurrentCDR = cdrKey(rsDetailobj.PublicKey, rsDetailobj.CDRSeq)
+	rsDetailobj.Time, err = txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if err = requireService(stub, rsDetailobj, serviceVoice, rsDetailobj.Time); err != nil {
+		return nil, err
+	}
+	//A subscriber that hit its hard cap or spending limit can not start calls
+	if err = requireNotCapped(stub, rsDetailobj, rsDetailobj.Time); err != nil {
+		return nil, err
+	}
+	hits, err := checkCallVelocity(stub, rsDetailobj, rsDetailobj.Time)
+	if err != nil {
+		return nil, err
+	}
+	fraudEvents, err := openFraudCases(stub, &rsDetailobj, hits, rsDetailobj.Time)
+	if err != nil {
+		return nil, err
+	}
+	err = putSubscriber(stub, rsDetailobj)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, nil
+	event := newEvent(stub, eventCallStarted, rsDetailobj, rsDetailobj.Time, CallEvent{CDRID: rsDetailobj.CurrentCDR, TransType: rsDetailobj.TransType, CallingParty: mask(rsDetailobj.MSISDN), Destination: mask(destmsisdn)})
+	return nil, setEvents(stub, append([]RoamingEvent{event}, fraudEvents...))
 }
 
+//Overage flags a subscriber. It can come in the middle of a call, so it
+//only sets the flag and leaves the call in progress alone: its direction and
+//start time are what CallEnd builds the CDR from.
 func (t *SimpleChaincode) Overage(stub shim.ChaincodeStubInterface, key string) ([]byte, error) {
 
-	bytes, err := stub.GetState(key)
+	rsDetailobj, err := getSubscriber(stub, key)
 	if err != nil {
-		fmt.Println("Error - Could not get User details : %s", key)
-		//return nil, err
-	} else {
-		fmt.Println("Success - User details found %s", key)
+		return nil, err
 	}
-
-	var rsDetailobj rsDetailBlock
-	err = json.Unmarshal(bytes, &rsDetailobj)
-	rsDetailobj.Action = "OverageCheck"
-	rsDetailobj.TransType = "Call Out"
-	rsDetailobj.Flag= "OVERAGE"
-	currentDateStr := time.Now().Format(time.RFC822)
-	rsDetailobj.Time, _ = time.Parse(time.RFC822, currentDateStr)
-	bytes2, _ := json.Marshal(rsDetailobj)
-	err2 := stub.PutState(rsDetailobj.PublicKey, bytes2)
-	if err2 != nil {
-		fmt.Println("Error - could not Marshall in msisdn")
-	} else {
-		fmt.Println("Success, updated record")
+	err = requireHomeOperator(stub, rsDetailobj, "flag overage")
+	if err != nil {
+		return nil, err
+	}
+	currtime, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	rsDetailobj.addFlag(flagOverage)
+	err = putSubscriber(stub, rsDetailobj)
+	if err != nil {
+		return nil, err
 	}
-	
 
-	return nil, nil
+	event := newEvent(stub, eventOverage, rsDetailobj, currtime, OverageEvent{Flag: flagOverage})
+	return nil, setEvents(stub, []RoamingEvent{event})
 }
 
-//Call In
-func (t *SimpleChaincode) CallIn(stub shim.ChaincodeStubInterface, key string, destmsisdn string) ([]byte, error) {
+//Call In. For a received call Destination holds the calling party.
+func (t *SimpleChaincode) CallIn(stub shim.ChaincodeStubInterface, key string, callingmsisdn string) ([]byte, error) {
 
-	bytes, err := stub.GetState(key)
+	rsDetailobj, err := getSubscriber(stub, key)
 	if err != nil {
-		fmt.Println("Error - Could not get User details : %s", key)
-		//return nil, err
-	} else {
-		fmt.Println("Success - User details found %s", key)
+		return nil, err
 	}
-
-	var rsDetailobj rsDetailBlock
-	err = json.Unmarshal(bytes, &rsDetailobj)
-	rsDetailobj.Destination = destmsisdn
+	err = requireServingNetwork(stub, rsDetailobj, "record calls")
+	if err != nil {
+		return nil, err
+	}
+	if err = advance(&rsDetailobj, "CallIn"); err != nil {
+		return nil, err
+	}
+	rsDetailobj.Destination = mask(callingmsisdn)
 	rsDetailobj.Action = "Call Recieved"
 	rsDetailobj.TransType = "Call In"
 	rsDetailobj.Duration = 0.0
-	currentDateStr := time.Now().Format(time.RFC822)
-	rsDetailobj.Time, _ = time.Parse(time.RFC822, currentDateStr)
-	bytes2, _ := json.Marshal(rsDetailobj)
-	err2 := stub.PutState(rsDetailobj.PublicKey, bytes2)
-	if err2 != nil {
-		fmt.Println("Error - could not Marshall in msisdn")
-	} else {
-		fmt.Println("Success, updated record")
+	rsDetailobj.Charges = 0.0
+	rsDetailobj.Currency = ""
+	//Received calls get their own CDR key as well, written on CallEnd
+	rsDetailobj.CDRSeq = rsDetailobj.CDRSeq + 1
+	rsDetailobj.CurrentCDR = cdrKey(rsDetailobj.PublicKey, rsDetailobj.CDRSeq)
+	rsDetailobj.Time, err = txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if err = requireService(stub, rsDetailobj, serviceVoice, rsDetailobj.Time); err != nil {
+		return nil, err
+	}
+	err = putSubscriber(stub, rsDetailobj)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, nil
+	event := newEvent(stub, eventCallStarted, rsDetailobj, rsDetailobj.Time, CallEvent{CDRID: rsDetailobj.CurrentCDR, TransType: rsDetailobj.TransType, CallingParty: mask(callingmsisdn), Destination: mask(rsDetailobj.MSISDN)})
+	return nil, setEvents(stub, []RoamingEvent{event})
 }
 
 //Call End
 func (t *SimpleChaincode) CallEnd(stub shim.ChaincodeStubInterface, key string) ([]byte, error) {
 
-	bytes, err := stub.GetState(key)
+	rsDetailobj, err := getSubscriber(stub, key)
 	if err != nil {
-		fmt.Println("Error - Could not get User details : %s", key)
-		//return nil, err
-	} else {
-		fmt.Println("Success - User details found %s", key)
+		return nil, err
 	}
-
-	var rsDetailobj rsDetailBlock
-	err = json.Unmarshal(bytes, &rsDetailobj)
+	err = requireServingNetwork(stub, rsDetailobj, "record calls")
+	if err != nil {
+		return nil, err
+	}
+	if err = advance(&rsDetailobj, "CallEnd"); err != nil {
+		return nil, err
+	}
+	//TransType stays Call Out or Call In as set when the call started
 	rsDetailobj.Action = "Call End"
-	rsDetailobj.TransType = "Call Out"
-	currentDateStr := time.Now().Format(time.RFC822)
-	duration := time.Since(rsDetailobj.Time)
-	//dur := strconv.(duration.Minutes())
-	rsDetailobj.Time, _ = time.Parse(time.RFC822, currentDateStr)
+	currtime, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	duration := currtime.Sub(rsDetailobj.Time)
+	startTime := rsDetailobj.Time
+	rsDetailobj.Time = currtime
 	rsDetailobj.Duration = duration.Minutes()
-	bytes2, _ := json.Marshal(rsDetailobj)
-	err2 := stub.PutState(rsDetailobj.PublicKey, bytes2)
-	if err2 != nil {
-		fmt.Println("Error - could not Marshall in msisdn")
-	} else {
-		fmt.Println("Success, updated record")
+
+	if rsDetailobj.CurrentCDR == "" {
+		fmt.Println("Error - no call in progress for " + key)
+		return nil, conflictError("No call in progress for " + key)
+	}
+	var cdr callDetailRecord
+	cdr.CDRID = rsDetailobj.CurrentCDR
+	cdr.PublicKey = rsDetailobj.PublicKey
+	cdr.Seq = rsDetailobj.CDRSeq
+	cdr.TxID = stub.GetTxID()
+	cdr.MSISDN = mask(rsDetailobj.MSISDN)
+	cdr.HO = rsDetailobj.HO
+	cdr.RP = rsDetailobj.RP
+	cdr.RateType = rsDetailobj.RateType
+	cdr.TransType = rsDetailobj.TransType
+	cdr.CallingParty = cdr.MSISDN
+	cdr.Destination = mask(rsDetailobj.Destination)
+	if cdr.TransType == "Call In" {
+		cdr.CallingParty = mask(rsDetailobj.Destination)
+		cdr.Destination = cdr.MSISDN
+	}
+	cdr.StartTime = startTime
+	cdr.EndTime = rsDetailobj.Time
+	cdr.Duration = rsDetailobj.Duration
+	cdr.Status = cdrStatusEnded
+	err = putCDR(stub, cdr)
+	if err != nil {
+		return nil, err
+	}
+	fraudEvents, err := openFraudCases(stub, &rsDetailobj, checkCallDuration(rsDetailobj), currtime)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, nil
+	err = putSubscriber(stub, rsDetailobj)
+	if err != nil {
+		return nil, err
+	}
+
+	event := newEvent(stub, eventCallEnded, rsDetailobj, currtime, CallEvent{CDRID: cdr.CDRID, TransType: cdr.TransType, CallingParty: mask(cdr.CallingParty), Destination: mask(cdr.Destination), Duration: cdr.Duration})
+	return nil, setEvents(stub, append([]RoamingEvent{event}, fraudEvents...))
 }
 
 //Call Pay
 func (t *SimpleChaincode) CallPay(stub shim.ChaincodeStubInterface, key string) ([]byte, error) {
 
-	bytes, err := stub.GetState(key)
+	rsDetailobj, err := getSubscriber(stub, key)
 	if err != nil {
-		fmt.Println("Error - Could not get User details : %s", key)
-		//return nil, err
-	} else {
-		fmt.Println("Success - User details found %s", key)
+		return nil, err
+	}
+	err = requireServingNetwork(stub, rsDetailobj, "charge calls")
+	if err != nil {
+		return nil, err
+	}
+	if err = advance(&rsDetailobj, "CallPay"); err != nil {
+		return nil, err
 	}
-
-	var rsDetailobj rsDetailBlock
-	err = json.Unmarshal(bytes, &rsDetailobj)
 	rsDetailobj.Action = "Pay Charge"
-	rsDetailobj.TransType = "Call Out"
-	currentDateStr := time.Now().Format(time.RFC822)
-	rsDetailobj.Charges = rsDetailobj.Duration*5
-	rsDetailobj.Time, _ = time.Parse(time.RFC822, currentDateStr)
-	bytes2, _ := json.Marshal(rsDetailobj)
-	err2 := stub.PutState(rsDetailobj.PublicKey, bytes2)
-	if err2 != nil {
-		fmt.Println("Error - could not Marshall in msisdn")
-	} else {
-		fmt.Println("Success, updated record")
+	rsDetailobj.Time, err = txTime(stub)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, nil
+	//Charge the CDR of the call that just ended against the tariff of its start time
+	cdr, err := getCDR(stub, rsDetailobj.CurrentCDR)
+	if err != nil {
+		return nil, err
+	}
+	if cdr.Status != cdrStatusEnded {
+		fmt.Println("Error - call not ended yet : " + cdr.CDRID)
+		return nil, conflictError("Call " + cdr.CDRID + " has not ended or is already charged")
+	}
+	err = rateCDR(stub, &cdr)
+	if err != nil {
+		fmt.Println("Error - could not rate call : " + err.Error())
+		return nil, err
+	}
+	rsDetailobj.Charges = cdr.Charges
+	rsDetailobj.Currency = cdr.Currency
+	cdr.Status = cdrStatusCharged
+	err = putCDR(stub, cdr)
+	if err != nil {
+		return nil, err
+	}
+	planEvents, err := chargeAllowance(stub, &rsDetailobj, cdrService(cdr), cdrSeconds(cdr), cdr.Charges, cdr.Currency, rsDetailobj.Time)
+	if err != nil {
+		return nil, err
+	}
+
+	err = putSubscriber(stub, rsDetailobj)
+	if err != nil {
+		return nil, err
+	}
+
+	event := newEvent(stub, eventChargePosted, rsDetailobj, rsDetailobj.Time, ChargeEvent{CDRID: cdr.CDRID, Charges: cdr.Charges, Currency: cdr.Currency})
+	return nil, setEvents(stub, append([]RoamingEvent{event}, planEvents...))
 }
 
 //MAIN FUNCTION
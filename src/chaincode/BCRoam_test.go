@@ -0,0 +1,295 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// testStart is the ledger time a test starts at
+var testStart = time.Date(2017, 3, 1, 9, 0, 0, 0, time.UTC)
+
+// testLedger drives the chaincode through a MockStub. Every invoke is a
+// transaction of its own, the ledger clock only moves when a test moves it.
+type testLedger struct {
+	t    *testing.T
+	stub *shim.MockStub
+	now  time.Time
+	txs  int
+}
+
+//newTestLedger starts a ledger from defaultFixture, or from the fixture of the Init arguments
+func newTestLedger(t *testing.T, initArgs ...string) *testLedger {
+	l := &testLedger{t: t, stub: shim.NewMockStub("bcroam", new(SimpleChaincode)), now: testStart}
+	//The mock range iterator never returns the first key in the ledger, a
+	//sentinel that sorts before every record keeps range queries complete
+	l.stub.MockTransactionStart("sentinel")
+	l.stub.PutState("!", []byte{})
+	l.stub.MockTransactionEnd("sentinel")
+	l.stub.SetTxTimestamp(l.now)
+	if _, err := l.stub.MockInit(l.nextTx(), "init", initArgs); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	return l
+}
+
+func (l *testLedger) nextTx() string {
+	l.txs++
+	return fmt.Sprintf("tx%04d", l.txs)
+}
+
+//advance moves the ledger clock
+func (l *testLedger) advance(d time.Duration) {
+	l.now = l.now.Add(d)
+	l.stub.SetTxTimestamp(l.now)
+}
+
+//asOperator makes the following calls with the certificate of an operator
+func (l *testLedger) asOperator(operator string) *testLedger {
+	l.stub.CertAttributes = map[string][]byte{attrRole: []byte(roleOperator), attrOperator: []byte(operator)}
+	return l
+}
+
+//asRole makes the following calls with the certificate of a network role
+func (l *testLedger) asRole(role string) *testLedger {
+	l.stub.CertAttributes = map[string][]byte{attrRole: []byte(role)}
+	return l
+}
+
+func (l *testLedger) invoke(function string, args ...string) ([]byte, error) {
+	return l.stub.MockInvoke(l.nextTx(), function, args)
+}
+
+func (l *testLedger) mustInvoke(function string, args ...string) []byte {
+	l.t.Helper()
+	bytes, err := l.invoke(function, args...)
+	if err != nil {
+		l.t.Fatalf("%s %v: %v", function, args, err)
+	}
+	return bytes
+}
+
+//mustFail runs an invoke that has to fail with the error code
+func (l *testLedger) mustFail(code string, function string, args ...string) {
+	l.t.Helper()
+	_, err := l.invoke(function, args...)
+	if ce, ok := err.(*ChaincodeError); !ok || ce.Code != code {
+		l.t.Fatalf("%s %v: got %v, want a %s error", function, args, err, code)
+	}
+}
+
+//mustQuery runs a query and decodes its result into v
+func (l *testLedger) mustQuery(v interface{}, function string, args ...string) {
+	l.t.Helper()
+	bytes, err := l.stub.MockQuery(function, args)
+	if err != nil {
+		l.t.Fatalf("%s %v: %v", function, args, err)
+	}
+	if err = json.Unmarshal(bytes, v); err != nil {
+		l.t.Fatalf("%s %v: decoding %s: %v", function, args, bytes, err)
+	}
+}
+
+func (l *testLedger) subscriber(publicKey string) rsDetailBlock {
+	l.t.Helper()
+	rs, err := getSubscriber(l.stub, publicKey)
+	if err != nil {
+		l.t.Fatalf("subscriber %s: %v", publicKey, err)
+	}
+	return rs
+}
+
+func (l *testLedger) cdrs(publicKey string) []callDetailRecord {
+	l.t.Helper()
+	cdrs, err := getCDRs(l.stub, publicKey)
+	if err != nil {
+		l.t.Fatalf("CDRs of %s: %v", publicKey, err)
+	}
+	return cdrs
+}
+
+//testEnvelope is a PII envelope with a dummy blob and commitments, as enterData needs one
+func testEnvelope() string {
+	env := PIIEnvelope{Blob: "c2VhbGVk"}
+	for _, field := range piiFields {
+		env.Commitments = append(env.Commitments, PIICommitment{Field: field, Hash: strings.Repeat("a", 64)})
+	}
+	bytes, _ := json.Marshal(env)
+	return string(bytes)
+}
+
+//enterArgs are the arguments of enterData for a subscriber, with the MSISDN masked and digested
+func (l *testLedger) enterArgs(publicKey string, msisdn string, ho string) []string {
+	l.t.Helper()
+	digest, err := msisdnDigest(l.stub, msisdn)
+	if err != nil {
+		l.t.Fatalf("digest of %s: %v", msisdn, err)
+	}
+	return []string{publicKey, mask(msisdn), digest, ho, testEnvelope()}
+}
+
+//roam takes a subscriber to a visited network and registers its rates there
+func (l *testLedger) roam(publicKey string, rp string) {
+	l.t.Helper()
+	l.asOperator(rp)
+	l.mustInvoke("discoverRP", publicKey, rp, "BERLIN", "52.52", "13.40")
+	l.mustInvoke("authentication", publicKey)
+	l.mustInvoke("updateRates", publicKey)
+}
+
+//call makes an outgoing call of a roaming subscriber and charges it
+func (l *testLedger) call(publicKey string, destination string, d time.Duration) {
+	l.t.Helper()
+	l.mustInvoke("CallOut", publicKey, destination)
+	l.advance(d)
+	l.mustInvoke("CallEnd", publicKey)
+	l.mustInvoke("CallPay", publicKey)
+}
+
+func TestResetKeepsRecordSequences(t *testing.T) {
+	l := newTestLedger(t)
+	l.roam("rs1", "XYZ")
+	l.call("rs1", "4930123456", time.Minute)
+	l.mustInvoke("DataSessionStart", "rs1")
+	l.mustInvoke("DataSessionEnd", "rs1", "1048576")
+	l.mustInvoke("SMSOut", "rs1", "4930123456")
+
+	l.asRole(roleAdmin).mustInvoke("resetInventory")
+	if rs := l.subscriber("rs1"); rs.State != stateIdle || rs.CDRSeq != 1 || rs.UsageSeq != 2 {
+		t.Fatalf("after reset: state %s, cdrseq %d, usageseq %d", rs.State, rs.CDRSeq, rs.UsageSeq)
+	}
+
+	l.advance(time.Hour)
+	l.roam("rs1", "XYZ")
+	l.call("rs1", "4930123456", 2*time.Minute)
+	l.mustInvoke("DataSessionStart", "rs1")
+	l.mustInvoke("DataSessionEnd", "rs1", "1048576")
+	l.mustInvoke("SMSOut", "rs1", "4930123456")
+
+	cdrs := l.cdrs("rs1")
+	if len(cdrs) != 2 {
+		t.Fatalf("got %d CDRs, want 2", len(cdrs))
+	}
+	for i, cdr := range cdrs {
+		if cdr.Seq != i+1 || cdr.Status != cdrStatusCharged {
+			t.Errorf("CDR %d: seq %d, status %s", i, cdr.Seq, cdr.Status)
+		}
+	}
+	if cdrs[0].Duration == cdrs[1].Duration {
+		t.Errorf("the second call overwrote the first CDR")
+	}
+	var usage UsageRecords
+	l.mustQuery(&usage, "queryUsage", "rs1")
+	if len(usage.DataSessions) != 2 || len(usage.SMS) != 2 {
+		t.Fatalf("got %d data sessions and %d SMS, want 2 of each", len(usage.DataSessions), len(usage.SMS))
+	}
+	if rs := l.subscriber("rs1"); rs.State != stateRatesRegistered {
+		t.Errorf("state %s after the second call, want %s", rs.State, stateRatesRegistered)
+	}
+}
+
+func TestEnterDataKeepsRecordSequences(t *testing.T) {
+	l := newTestLedger(t)
+	l.roam("rs1", "XYZ")
+	l.call("rs1", "4930123456", time.Minute)
+
+	l.asOperator("ABC")
+	l.mustInvoke("enterData", l.enterArgs("rs1", "14691234567", "ABC")...)
+	if rs := l.subscriber("rs1"); rs.CDRSeq != 1 {
+		t.Fatalf("cdrseq %d after enterData, want 1", rs.CDRSeq)
+	}
+	l.roam("rs1", "XYZ")
+	l.call("rs1", "4930123456", time.Minute)
+	if cdrs := l.cdrs("rs1"); len(cdrs) != 2 {
+		t.Fatalf("got %d CDRs, want 2", len(cdrs))
+	}
+}
+
+func TestSubscriberKeysCanNotOverlap(t *testing.T) {
+	l := newTestLedger(t)
+	l.roam("rs1", "XYZ")
+	l.call("rs1", "4930123456", time.Minute)
+
+	l.asOperator("XYZ")
+	for _, key := range []string{"rs1:x", "rs1:", "", "rs 1", "../rs1"} {
+		l.mustFail(codeValidation, "enterData", l.enterArgs(key, "34909000000", "XYZ")...)
+		l.mustFail(codeValidation, "CallOut", key, "4930123456")
+		if _, err := l.stub.MockQuery("queryCDRs", []string{key}); err == nil {
+			t.Errorf("queryCDRs %q succeeded", key)
+		}
+	}
+	l.asRole(roleAdmin).mustFail(codeValidation, "loadFixture", `{"subscribers": [{"publickey": "rs1:x", "msisdn": "34909000000", "ho": "XYZ"}]}`)
+	if cdrs := l.cdrs("rs1"); len(cdrs) != 1 {
+		t.Errorf("rs1 has %d CDRs, want 1", len(cdrs))
+	}
+}
+
+func TestCallTimesComeFromTheTransaction(t *testing.T) {
+	records := make([][]byte, 2)
+	for i := range records {
+		l := newTestLedger(t)
+		l.roam("rs1", "XYZ")
+		start := l.now
+		l.call("rs1", "4930123456", 150*time.Second)
+
+		cdrs := l.cdrs("rs1")
+		if len(cdrs) != 1 {
+			t.Fatalf("got %d CDRs, want 1", len(cdrs))
+		}
+		cdr := cdrs[0]
+		if !cdr.StartTime.Equal(start) || !cdr.EndTime.Equal(start.Add(150*time.Second)) || cdr.Duration != 2.5 {
+			t.Fatalf("CDR from %s to %s, %v minutes", cdr.StartTime, cdr.EndTime, cdr.Duration)
+		}
+		if rs := l.subscriber("rs1"); !rs.Time.Equal(l.now) {
+			t.Errorf("subscriber time %s, want %s", rs.Time, l.now)
+		}
+		records[i], _ = l.stub.GetState(cdr.CDRID)
+	}
+	//Peers that run the same transactions write the same records
+	if string(records[0]) != string(records[1]) {
+		t.Errorf("CDRs differ between runs:\n%s\n%s", records[0], records[1])
+	}
+}
+
+func TestOverageLeavesTheCallAlone(t *testing.T) {
+	l := newTestLedger(t)
+	l.roam("rs1", "XYZ")
+	l.mustInvoke("CallIn", "rs1", "4930123456")
+	l.advance(20 * time.Second)
+	l.asOperator("ABC").mustInvoke("Overage", "rs1")
+	l.advance(40 * time.Second)
+	l.asOperator("XYZ").mustInvoke("CallEnd", "rs1")
+	l.mustInvoke("CallPay", "rs1")
+
+	cdr := l.cdrs("rs1")[0]
+	if cdr.TransType != "Call In" || cdr.CallingParty != mask("4930123456") || cdr.Destination != mask("14691234567") {
+		t.Errorf("CDR %s from %s to %s", cdr.TransType, cdr.CallingParty, cdr.Destination)
+	}
+	if cdr.Duration != 1 || cdr.Charges.String() != "1.0000" {
+		t.Errorf("CDR of %v minutes charged %s, want 1 minute at 1.0000", cdr.Duration, cdr.Charges)
+	}
+	if rs := l.subscriber("rs1"); !rs.hasFlag(flagOverage) {
+		t.Errorf("flags %v after Overage", rs.Flags)
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Access control is attribute based. The membership service puts these
+// attributes in the transaction certificate of every enrolled user:
+//
+//	role        operator, subscriber, auditor or admin
+//	operator    the operator an operator user acts for, e.g. "ABC"
+//	subscriber  the subscriber key of a subscriber user, e.g. "rs1"
+const (
+	attrRole       = "role"
+	attrOperator   = "operator"
+	attrSubscriber = "subscriber"
+)
+
+// Roles
+const (
+	roleOperator   = "operator"
+	roleSubscriber = "subscriber"
+	roleAuditor    = "auditor"
+	roleAdmin      = "admin"
+)
+
+//hasRole reports whether the caller's certificate carries the role
+func hasRole(stub shim.ChaincodeStubInterface, role string) bool {
+	ok, err := stub.VerifyAttribute(attrRole, []byte(role))
+	if err != nil {
+		fmt.Println("Error - could not verify role " + role + ": " + err.Error())
+		return false
+	}
+	return ok
+}
+
+//certAttribute reads an attribute of the caller's certificate, "" if it has none
+func certAttribute(stub shim.ChaincodeStubInterface, name string) string {
+	value, err := stub.ReadCertAttribute(name)
+	if err != nil {
+		return ""
+	}
+	return string(value)
+}
+
+//isOperator reports whether the caller is an operator user acting for any of the operators
+func isOperator(stub shim.ChaincodeStubInterface, operators ...string) bool {
+	if !hasRole(stub, roleOperator) {
+		return false
+	}
+	caller := certAttribute(stub, attrOperator)
+	for _, op := range operators {
+		if op != "" && op == caller {
+			return true
+		}
+	}
+	return false
+}
+
+func operatorNames(operators []string) string {
+	var names []string
+	for _, op := range operators {
+		if op != "" {
+			names = append(names, op)
+		}
+	}
+	return strings.Join(names, " or ")
+}
+
+//requireRole passes callers holding any of the roles
+func requireRole(stub shim.ChaincodeStubInterface, action string, roles ...string) error {
+	for _, role := range roles {
+		if hasRole(stub, role) {
+			return nil
+		}
+	}
+	return authError("Only " + strings.Join(roles, " or ") + " may " + action)
+}
+
+//requireOperator passes operator users acting for any of the operators
+func requireOperator(stub shim.ChaincodeStubInterface, action string, operators ...string) error {
+	if isOperator(stub, operators...) {
+		return nil
+	}
+	return authError("Only operator " + operatorNames(operators) + " may " + action)
+}
+
+//requireOperatorOrRole passes operator users acting for any of the operators and holders of any of the roles
+func requireOperatorOrRole(stub shim.ChaincodeStubInterface, action string, operators []string, roles ...string) error {
+	if isOperator(stub, operators...) {
+		return nil
+	}
+	for _, role := range roles {
+		if hasRole(stub, role) {
+			return nil
+		}
+	}
+	return authError("Only operator " + operatorNames(operators) + " or " + strings.Join(roles, " or ") + " may " + action)
+}
+
+//servingNetwork is the network a subscriber currently uses
+func servingNetwork(rs rsDetailBlock) string {
+	if rs.RP != "" {
+		return rs.RP
+	}
+	return rs.HO
+}
+
+//requireServingNetwork passes the operator the subscriber is currently on, who records its usage
+func requireServingNetwork(stub shim.ChaincodeStubInterface, rs rsDetailBlock, action string) error {
+	return requireOperator(stub, action+" of "+rs.PublicKey, servingNetwork(rs))
+}
+
+//requireHomeOperator passes the home operator of the subscriber, who manages its record
+func requireHomeOperator(stub shim.ChaincodeStubInterface, rs rsDetailBlock, action string) error {
+	return requireOperator(stub, action+" of "+rs.PublicKey, rs.HO)
+}
+
+//requireSubscriberRead passes the subscriber itself, its home and serving
+//operators, auditors and admins
+func requireSubscriberRead(stub shim.ChaincodeStubInterface, rs rsDetailBlock) error {
+	if hasRole(stub, roleSubscriber) && certAttribute(stub, attrSubscriber) == rs.PublicKey {
+		return nil
+	}
+	return requireOperatorOrRole(stub, "read subscriber "+rs.PublicKey, []string{rs.HO, rs.RP}, roleAuditor, roleAdmin)
+}
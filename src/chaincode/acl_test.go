@@ -0,0 +1,65 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestAccessControl(t *testing.T) {
+	l := newTestLedger(t)
+	l.roam("rs1", "XYZ")
+
+	denied := []struct {
+		attrs    map[string]string
+		function string
+		args     []string
+	}{
+		{nil, "resetInventory", nil},
+		{map[string]string{attrRole: roleOperator, attrOperator: "XYZ"}, "resetInventory", nil},
+		//Only the serving network records usage
+		{map[string]string{attrRole: roleOperator, attrOperator: "ABC"}, "CallOut", []string{"rs1", "4930123456"}},
+		//An operator attribute without the operator role is not enough
+		{map[string]string{attrOperator: "XYZ"}, "CallOut", []string{"rs1", "4930123456"}},
+		{map[string]string{attrRole: roleAuditor}, "CallOut", []string{"rs1", "4930123456"}},
+		//Only the home operator manages its subscribers
+		{map[string]string{attrRole: roleOperator, attrOperator: "XYZ"}, "Overage", []string{"rs1"}},
+		{map[string]string{attrRole: roleOperator, attrOperator: "XYZ"}, "enterData", l.enterArgs("rs1", "14691234567", "ABC")},
+	}
+	for _, c := range denied {
+		l.stub.CertAttributes = map[string][]byte{}
+		for name, value := range c.attrs {
+			l.stub.CertAttributes[name] = []byte(value)
+		}
+		l.mustFail(codeUnauthorized, c.function, c.args...)
+	}
+
+	//A subscriber reads its own records and nobody else's
+	l.stub.CertAttributes = map[string][]byte{attrRole: []byte(roleSubscriber), attrSubscriber: []byte("rs1")}
+	var cdrs []callDetailRecord
+	l.mustQuery(&cdrs, "queryCDRs", "rs1")
+	if _, err := l.stub.MockQuery("queryCDRs", []string{"rs2"}); err == nil {
+		t.Errorf("rs1 read the CDRs of rs2")
+	}
+	//The roaming partner reads the roamer on its network, a third operator does not
+	l.asOperator("XYZ").mustQuery(&cdrs, "queryCDRs", "rs1")
+	l.asRole(roleAdmin).mustInvoke("registerOperator", `{"id": "DEF", "tadig": "FRADF", "mccmnc": ["208-01"], "name": "DEF", "settlementCurrency": "EUR"}`)
+	if _, err := l.asOperator("DEF").stub.MockQuery("queryCDRs", []string{"rs1"}); err == nil {
+		t.Errorf("DEF read the CDRs of a subscriber it does not serve")
+	}
+}
@@ -0,0 +1,320 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Agreements are keyed by the home operator followed by the roaming partner,
+// e.g. "agreement:ABC:XYZ" lets ABC subscribers roam on XYZ.
+var agreementPrefix = "agreement:"
+
+// Agreement status values
+const (
+	agreementActive    = "Active"
+	agreementSuspended = "Suspended"
+)
+
+// Roaming services an agreement can allow
+const (
+	serviceVoice = "voice"
+	serviceSMS   = "sms"
+	serviceData  = "data"
+)
+
+// RoamingAgreement between a home operator and a roaming partner. Usage is
+// only recorded for the services it lists and is rated with the rate cards
+// of its RatePlan.
+type RoamingAgreement struct {
+	HO        string              `json:"ho"`
+	RP        string              `json:"rp"`
+	ValidFrom time.Time           `json:"validFrom"`
+	ValidTo   time.Time           `json:"validTo"`
+	Services  []string            `json:"services"`
+	RatePlan  string              `json:"ratePlan"`
+	Status    string              `json:"status"`
+	Pending   *AgreementAmendment `json:"pending,omitempty"`
+}
+
+// AgreementAmendment is a change of terms one party of an agreement has
+// proposed. The terms stay as they are until the other party accepts it.
+type AgreementAmendment struct {
+	ProposedBy string           `json:"proposedBy"`
+	ProposedAt time.Time        `json:"proposedAt"`
+	Terms      RoamingAgreement `json:"terms"`
+}
+
+func agreementKey(ho string, rp string) string {
+	return agreementPrefix + ho + ":" + rp
+}
+
+//allows reports whether the agreement covers the given service
+func (a RoamingAgreement) allows(service string) bool {
+	for _, s := range a.Services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+//validAt reports whether the agreement is active at time at.
+//A zero ValidTo means the agreement has no end date.
+func (a RoamingAgreement) validAt(at time.Time) bool {
+	if a.Status != agreementActive {
+		return false
+	}
+	if at.Before(a.ValidFrom) {
+		return false
+	}
+	if !a.ValidTo.IsZero() && !at.Before(a.ValidTo) {
+		return false
+	}
+	return true
+}
+
+//getAgreement reads the agreement between ho and rp from the ledger
+func getAgreement(stub shim.ChaincodeStubInterface, ho string, rp string) (RoamingAgreement, error) {
+	var agreement RoamingAgreement
+	key := agreementKey(ho, rp)
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("Error - Could not get agreement : " + key)
+		return agreement, internalError("Error retrieving agreement " + key)
+	}
+	if bytes == nil {
+		return agreement, notFoundError("No roaming agreement between " + ho + " and " + rp)
+	}
+	err = json.Unmarshal(bytes, &agreement)
+	if err != nil {
+		fmt.Println("Error unmarshalling agreement " + key)
+		return agreement, internalError("Error unmarshalling agreement " + key)
+	}
+	return agreement, nil
+}
+
+func putAgreement(stub shim.ChaincodeStubInterface, agreement RoamingAgreement) error {
+	key := agreementKey(agreement.HO, agreement.RP)
+	bytes, err := json.Marshal(agreement)
+	if err != nil {
+		return internalError("Error marshalling agreement " + key)
+	}
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("Error - could not write agreement " + key)
+		return internalError("Error writing agreement " + key)
+	}
+	fmt.Println("Success, wrote agreement " + key)
+	return nil
+}
+
+//activeAgreement returns the agreement between ho and rp if it is in force at time at
+func activeAgreement(stub shim.ChaincodeStubInterface, ho string, rp string, at time.Time) (RoamingAgreement, error) {
+	agreement, err := getAgreement(stub, ho, rp)
+	if err != nil {
+		return agreement, err
+	}
+	if !agreement.validAt(at) {
+		return agreement, conflictError("Roaming agreement between " + ho + " and " + rp + " is not in force")
+	}
+	return agreement, nil
+}
+
+//requireService checks that the agreement a roaming subscriber is served
+//under is in force at time at and covers the service. Usage on the home
+//network needs no agreement.
+func requireService(stub shim.ChaincodeStubInterface, rs rsDetailBlock, service string, at time.Time) error {
+	if rs.Roaming != "True" {
+		return nil
+	}
+	agreement, err := activeAgreement(stub, rs.HO, rs.RP, at)
+	if err != nil {
+		return err
+	}
+	if !agreement.allows(service) {
+		return conflictError("Roaming agreement between " + rs.HO + " and " + rs.RP + " does not cover " + service)
+	}
+	return nil
+}
+
+//parseAgreement decodes and validates an agreement passed as a JSON argument
+func parseAgreement(arg string) (RoamingAgreement, error) {
+	var agreement RoamingAgreement
+	err := json.Unmarshal([]byte(arg), &agreement)
+	if err != nil {
+		return agreement, validationError("Invalid roaming agreement")
+	}
+	return agreement, agreement.validate()
+}
+
+//validate checks an agreement before it is written
+func (a RoamingAgreement) validate() error {
+	if a.HO == "" || a.RP == "" {
+		return validationError("Roaming agreement needs both ho and rp")
+	}
+	if err := validateOperatorIDs(a.HO, a.RP); err != nil {
+		return err
+	}
+	if a.HO == a.RP {
+		return validationError("Roaming agreement ho and rp must differ")
+	}
+	if !a.ValidTo.IsZero() && !a.ValidTo.After(a.ValidFrom) {
+		return validationError("Roaming agreement validTo must be after validFrom")
+	}
+	for _, s := range a.Services {
+		if s != serviceVoice && s != serviceSMS && s != serviceData {
+			return validationError("Unknown roaming service " + s)
+		}
+	}
+	return nil
+}
+
+/*		0
+	json
+	{
+		"ho": "ABC",
+		"rp": "XYZ",
+		"validFrom": "2017-01-01T00:00:00Z",
+		"validTo": "2018-01-01T00:00:00Z",  (optional, open ended when missing)
+		"services": ["voice", "sms", "data"],
+		"ratePlan": "RoamingXYZ"
+	}
+*/
+func (t *SimpleChaincode) createAgreement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Creating roaming agreement")
+	if err := checkArgs("createAgreement", args, 1, "roaming agreement record"); err != nil {
+		return nil, err
+	}
+	agreement, err := parseAgreement(args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = requireOperatorOrRole(stub, "create the agreement between "+agreement.HO+" and "+agreement.RP, []string{agreement.HO, agreement.RP}, roleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := stub.GetState(agreementKey(agreement.HO, agreement.RP))
+	if err != nil {
+		return nil, internalError("Error retrieving agreement " + agreementKey(agreement.HO, agreement.RP))
+	}
+	if existing != nil {
+		return nil, conflictError("Roaming agreement between " + agreement.HO + " and " + agreement.RP + " already exists")
+	}
+	agreement.Status = agreementActive
+	return nil, putAgreement(stub, agreement)
+}
+
+//amendAgreement proposes new terms for an existing agreement. The status is
+//kept unless the amendment sets it, which is how a suspension is lifted.
+//Nothing changes until the other party accepts the amendment with
+//acceptAmendment, a later proposal of either party replaces a pending one.
+func (t *SimpleChaincode) amendAgreement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Amending roaming agreement")
+	if err := checkArgs("amendAgreement", args, 1, "roaming agreement record"); err != nil {
+		return nil, err
+	}
+	amended, err := parseAgreement(args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = requireOperator(stub, "amend the agreement between "+amended.HO+" and "+amended.RP, amended.HO, amended.RP)
+	if err != nil {
+		return nil, err
+	}
+	if amended.Status != "" && amended.Status != agreementActive && amended.Status != agreementSuspended {
+		return nil, validationError("Unknown agreement status " + amended.Status)
+	}
+	agreement, err := getAgreement(stub, amended.HO, amended.RP)
+	if err != nil {
+		return nil, err
+	}
+	at, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	amended.Pending = nil
+	agreement.Pending = &AgreementAmendment{ProposedBy: certAttribute(stub, attrOperator), ProposedAt: at, Terms: amended}
+	return nil, putAgreement(stub, agreement)
+}
+
+//acceptAmendment puts the pending amendment of an agreement into force. Only
+//the party that did not propose it can accept it.
+//	args: ho, rp
+func (t *SimpleChaincode) acceptAmendment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Accepting roaming agreement amendment")
+	if err := checkArgs("acceptAmendment", args, 2, "ho and rp"); err != nil {
+		return nil, err
+	}
+	agreement, err := getAgreement(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	if agreement.Pending == nil {
+		return nil, conflictError("Roaming agreement between " + agreement.HO + " and " + agreement.RP + " has no pending amendment")
+	}
+	counterparty := agreement.HO
+	if agreement.Pending.ProposedBy == agreement.HO {
+		counterparty = agreement.RP
+	}
+	if err = requireOperator(stub, "accept the amendment "+agreement.Pending.ProposedBy+" proposed", counterparty); err != nil {
+		return nil, err
+	}
+	amended := agreement.Pending.Terms
+	if amended.Status == "" {
+		amended.Status = agreement.Status
+	}
+	return nil, putAgreement(stub, amended)
+}
+
+//suspendAgreement stops roaming between ho and rp until the agreement is amended
+//back to Active. Either party can suspend on its own, lifting it takes both.
+func (t *SimpleChaincode) suspendAgreement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Suspending roaming agreement")
+	if err := checkArgs("suspendAgreement", args, 2, "ho and rp"); err != nil {
+		return nil, err
+	}
+	if err := requireOperatorOrRole(stub, "suspend the agreement between "+args[0]+" and "+args[1], args, roleAdmin); err != nil {
+		return nil, err
+	}
+	agreement, err := getAgreement(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	agreement.Status = agreementSuspended
+	return nil, putAgreement(stub, agreement)
+}
+
+func (t *SimpleChaincode) queryAgreement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("queryAgreement called")
+	if err := checkArgs("queryAgreement", args, 2, "ho and rp"); err != nil {
+		return nil, err
+	}
+	if err := requireOperatorOrRole(stub, "read the agreement between "+args[0]+" and "+args[1], args, roleAuditor, roleAdmin); err != nil {
+		return nil, err
+	}
+	agreement, err := getAgreement(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(agreement)
+}
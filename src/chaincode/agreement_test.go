@@ -0,0 +1,72 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestAgreementServicesAreEnforced(t *testing.T) {
+	fixture, err := ioutil.ReadFile("../../fixtures/minimal.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newTestLedger(t, string(fixture))
+	l.roam("rs1", "XYZ")
+	l.mustFail(codeStateConflict, "DataSessionStart", "rs1")
+	l.mustInvoke("SMSOut", "rs1", "4930123456")
+	l.call("rs1", "4930123456", time.Minute)
+
+	l.asOperator("ABC").mustInvoke("suspendAgreement", "ABC", "XYZ")
+	l.asOperator("XYZ")
+	l.mustFail(codeStateConflict, "CallOut", "rs1", "4930123456")
+	l.mustFail(codeStateConflict, "CallIn", "rs1", "4930123456")
+	l.mustFail(codeStateConflict, "SMSOut", "rs1", "4930123456")
+}
+
+func TestRatingNeedsTheAgreedRatePlan(t *testing.T) {
+	l := newTestLedger(t)
+	l.roam("rs1", "XYZ")
+	l.mustInvoke("createRateCard", `{"ho": "ABC", "rp": "XYZ", "ratePlan": "Promo", "currency": "EUR",
+		"effectiveFrom": "2017-02-01T00:00:00Z", "voiceOut": {"price": "0.01"}}`)
+	l.mustInvoke("CallOut", "rs1", "4930123456")
+	l.advance(time.Minute)
+	l.mustInvoke("CallEnd", "rs1")
+	l.mustFail(codeStateConflict, "CallPay", "rs1")
+}
+
+func TestAmendmentNeedsTheCounterparty(t *testing.T) {
+	l := newTestLedger(t)
+	l.asOperator("ABC").mustInvoke("suspendAgreement", "ABC", "XYZ")
+
+	l.asOperator("XYZ").mustInvoke("amendAgreement", `{"ho": "ABC", "rp": "XYZ", "services": ["voice"], "ratePlan": "RoamingXYZ", "status": "Active"}`)
+	if a, _ := getAgreement(l.stub, "ABC", "XYZ"); a.Status != agreementSuspended || len(a.Services) != 3 || a.Pending == nil {
+		t.Fatalf("amendment took effect before it was accepted: %+v", a)
+	}
+	l.mustFail(codeUnauthorized, "acceptAmendment", "ABC", "XYZ")
+	l.asRole(roleAdmin).mustFail(codeUnauthorized, "acceptAmendment", "ABC", "XYZ")
+
+	l.asOperator("ABC").mustInvoke("acceptAmendment", "ABC", "XYZ")
+	a, _ := getAgreement(l.stub, "ABC", "XYZ")
+	if a.Status != agreementActive || len(a.Services) != 1 || a.Pending != nil {
+		t.Fatalf("accepted amendment not in force: %+v", a)
+	}
+	l.mustFail(codeStateConflict, "acceptAmendment", "ABC", "XYZ")
+}
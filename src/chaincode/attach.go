@@ -0,0 +1,128 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// The attachment registry records which subscriber key currently holds an
+// MSISDN on the network. It used to be an in-memory map in the chaincode
+// container; keeping it in world state makes every peer see the same thing.
+// Attachments are keyed by the digest of the MSISDN, see msisdnDigest, and
+// only keep the number masked.
+var attachPrefix = "attach:"
+
+// Attachment of an MSISDN to a subscriber key on a network, MSISDN is masked
+type Attachment struct {
+	MSISDN    string    `json:"msisdn"`
+	PublicKey string    `json:"publickey"`
+	Network   string    `json:"network"`
+	Time      time.Time `json:"time"`
+}
+
+func attachKey(digest string) string {
+	return attachPrefix + digest
+}
+
+//getAttachment returns the attachment of the MSISDN with the digest, or nil if it is not attached
+func getAttachment(stub shim.ChaincodeStubInterface, digest string) (*Attachment, error) {
+	key := attachKey(digest)
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("Error - Could not get attachment : " + key)
+		return nil, internalError("Error retrieving attachment " + key)
+	}
+	if bytes == nil {
+		return nil, nil
+	}
+	var attachment Attachment
+	err = json.Unmarshal(bytes, &attachment)
+	if err != nil {
+		fmt.Println("Error unmarshalling attachment " + key)
+		return nil, internalError("Error unmarshalling attachment " + key)
+	}
+	return &attachment, nil
+}
+
+//putAttachment attaches the MSISDN with the digest, attachment holds it masked
+func putAttachment(stub shim.ChaincodeStubInterface, digest string, attachment Attachment) error {
+	key := attachKey(digest)
+	bytes, err := json.Marshal(attachment)
+	if err != nil {
+		return internalError("Error marshalling attachment " + key)
+	}
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("Error - could not write attachment " + key)
+		return internalError("Error writing attachment " + key)
+	}
+	return nil
+}
+
+//detach removes the attachment of the MSISDN with the digest if it is held by publicKey
+func detach(stub shim.ChaincodeStubInterface, digest string, publicKey string) error {
+	attachment, err := getAttachment(stub, digest)
+	if err != nil {
+		return err
+	}
+	if attachment == nil || attachment.PublicKey != publicKey {
+		return nil
+	}
+	key := attachKey(digest)
+	err = stub.DelState(key)
+	if err != nil {
+		fmt.Println("Error - could not delete attachment " + key)
+		return internalError("Error deleting attachment " + key)
+	}
+	return nil
+}
+
+//Query which subscriber key currently holds an MSISDN
+func (t *SimpleChaincode) queryAttachment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("queryAttachment called")
+	if err := checkArgs("queryAttachment", args, 1, "msisdn"); err != nil {
+		return nil, err
+	}
+	digest, err := msisdnDigest(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	attachment, err := getAttachment(stub, digest)
+	if err != nil {
+		return nil, err
+	}
+	if attachment == nil {
+		return nil, notFoundError("MSISDN not attached " + mask(args[0]))
+	}
+	//The network it is attached to may see it, everyone else needs read access to the subscriber
+	if !isOperator(stub, attachment.Network) {
+		rs, err := getSubscriber(stub, attachment.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if err = requireSubscriberRead(stub, rs); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(attachment)
+}
@@ -0,0 +1,193 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Every call is written under its own key so that the next call on the same
+// subscriber can not overwrite it. Keys sort by subscriber and then by the
+// zero padded sequence number, so a range scan returns them in time order.
+var cdrPrefix = "cdr:"
+
+// CDR status values. A record is written once when the call ends and
+// updated a single time when it is charged; after that it is immutable.
+const (
+	cdrStatusEnded   = "Ended"
+	cdrStatusCharged = "Charged"
+)
+
+// Call Detail Record for a single roaming call
+type callDetailRecord struct {
+	CDRID        string    `json:"cdrid"`
+	PublicKey    string    `json:"publickey"`
+	Seq          int       `json:"seq"`
+	TxID         string    `json:"txid"`
+	MSISDN       string    `json:"msisdn"`
+	HO           string    `json:"ho"`
+	RP           string    `json:"rp"`
+	RateType     string    `json:"ratetype"`
+	TransType    string    `json:"transtype"`
+	CallingParty string    `json:"callingparty"`
+	Destination  string    `json:"destination"`
+	StartTime    time.Time `json:"starttime"`
+	EndTime      time.Time `json:"endtime"`
+	Duration     float64   `json:"duration"`
+	Charges      Money     `json:"charges"`
+	Currency     string    `json:"currency"`
+	Status       string    `json:"status"`
+}
+
+//cdrKey builds the ledger key of the seq'th call of a subscriber
+func cdrKey(publicKey string, seq int) string {
+	return fmt.Sprintf("%s%s:%010d", cdrPrefix, publicKey, seq)
+}
+
+//getCDR reads a single call detail record from the ledger
+func getCDR(stub shim.ChaincodeStubInterface, key string) (callDetailRecord, error) {
+	var cdr callDetailRecord
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("Error - Could not get CDR : " + key)
+		return cdr, internalError("Error retrieving CDR " + key)
+	}
+	if bytes == nil {
+		return cdr, notFoundError("CDR not found " + key)
+	}
+	err = json.Unmarshal(bytes, &cdr)
+	if err != nil {
+		fmt.Println("Error unmarshalling CDR " + key)
+		return cdr, internalError("Error unmarshalling CDR " + key)
+	}
+	return cdr, nil
+}
+
+//putCDR writes a call detail record, refusing to touch one that is already charged
+func putCDR(stub shim.ChaincodeStubInterface, cdr callDetailRecord) error {
+	existing, err := stub.GetState(cdr.CDRID)
+	if err != nil {
+		return internalError("Error retrieving CDR " + cdr.CDRID)
+	}
+	if existing != nil {
+		var old callDetailRecord
+		if err = json.Unmarshal(existing, &old); err == nil && old.Status == cdrStatusCharged {
+			fmt.Println("Error - CDR is already charged : " + cdr.CDRID)
+			return conflictError("CDR " + cdr.CDRID + " is already charged and can not be modified")
+		}
+	}
+	bytes, err := json.Marshal(cdr)
+	if err != nil {
+		return internalError("Error marshalling CDR " + cdr.CDRID)
+	}
+	err = stub.PutState(cdr.CDRID, bytes)
+	if err != nil {
+		fmt.Println("Error - could not write CDR " + cdr.CDRID)
+		return internalError("Error writing CDR " + cdr.CDRID)
+	}
+	fmt.Println("Success, wrote CDR " + cdr.CDRID)
+	return nil
+}
+
+//rangeByPrefix calls fn for every key on the ledger that starts with prefix, in key order
+func rangeByPrefix(stub shim.ChaincodeStubInterface, prefix string, fn func(key string, value []byte) error) error {
+	iter, err := stub.RangeQueryState(prefix, prefix+"~")
+	if err != nil {
+		return internalError("Error scanning range " + prefix)
+	}
+	defer iter.Close()
+
+	for iter.HasNext() {
+		key, value, err := iter.Next()
+		if err != nil {
+			return internalError("Error scanning range " + prefix)
+		}
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if err = fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//getCDRs returns all the call detail records of a subscriber in time order
+func getCDRs(stub shim.ChaincodeStubInterface, publicKey string) ([]callDetailRecord, error) {
+	cdrs := []callDetailRecord{}
+	err := rangeByPrefix(stub, cdrPrefix+publicKey+":", func(key string, value []byte) error {
+		var cdr callDetailRecord
+		if err := json.Unmarshal(value, &cdr); err != nil {
+			fmt.Println("Error unmarshalling CDR " + key)
+			return internalError("Error unmarshalling CDR " + key)
+		}
+		cdrs = append(cdrs, cdr)
+		return nil
+	})
+	return cdrs, err
+}
+
+//Query all CDRs of a subscriber
+func (t *SimpleChaincode) queryCDRs(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("queryCDRs called")
+	if err := checkArgs("queryCDRs", args, 1, "subscriber key"); err != nil {
+		return nil, err
+	}
+	rs, err := getSubscriber(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = requireSubscriberRead(stub, rs); err != nil {
+		return nil, err
+	}
+	cdrs, err := getCDRs(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(cdrViews(stub, rs.HO, cdrs))
+}
+
+//Query a single CDR by subscriber key and sequence number
+func (t *SimpleChaincode) queryCDR(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("queryCDR called")
+	if err := checkArgs("queryCDR", args, 2, "subscriber key and sequence"); err != nil {
+		return nil, err
+	}
+	seq, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, validationError("Invalid CDR sequence " + args[1])
+	}
+	rs, err := getSubscriber(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = requireSubscriberRead(stub, rs); err != nil {
+		return nil, err
+	}
+	cdr, err := getCDR(stub, cdrKey(args[0], seq))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(cdrViews(stub, rs.HO, []callDetailRecord{cdr})[0])
+}
@@ -0,0 +1,529 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// A home operator disputes the charges a roaming partner posted for some of
+// its calls by proposing what they should have cost. The operators then take
+// turns: the one who did not make the latest proposal accepts it or counters
+// with its own. Either may escalate, after which an admin decides. The
+// agreed amount is booked as an adjustment, the difference to what was
+// charged, and the next settlement statement of the pair picks it up.
+//
+// Disputes are keyed like statements, by the two operators in alphabetical
+// order, then the time and transaction they were raised in. A CDR can only
+// be disputed once, "disputeidx:<cdr key>" points to its dispute.
+var (
+	disputePrefix      = "dispute:"
+	disputeIndexPrefix = "disputeidx:"
+	adjustmentPrefix   = "adjustment:"
+)
+
+// Dispute status values
+const (
+	disputeOpen      = "Open"
+	disputeCountered = "Countered"
+	disputeEscalated = "Escalated"
+	disputeResolved  = "Resolved"
+)
+
+// Adjustments are booked on settlement statements as their own service
+const serviceAdjustment = "adjustment"
+
+// Evidence is referenced by the hex SHA-256 of a document kept off chain,
+// PII commitments are hex HMAC-SHA256 values of the same shape
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// DisputeProposal is an amount one operator proposes for the disputed calls
+type DisputeProposal struct {
+	Operator string    `json:"operator"`
+	Amount   Money     `json:"amount"`
+	Evidence []string  `json:"evidence"`
+	Note     string    `json:"note,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Dispute over the charges of some calls of HO subscribers on RP
+type Dispute struct {
+	DisputeID  string            `json:"disputeId"`
+	HO         string            `json:"ho"`
+	RP         string            `json:"rp"`
+	Records    []string          `json:"records"`
+	Currency   string            `json:"currency"`
+	Charged    Money             `json:"charged"`
+	Proposals  []DisputeProposal `json:"proposals"`
+	Escalation string            `json:"escalation,omitempty"`
+	Agreed     Money             `json:"agreed"`
+	Adjustment string            `json:"adjustment,omitempty"`
+	RaisedAt   time.Time         `json:"raisedAt"`
+	ResolvedAt time.Time         `json:"resolvedAt"`
+	Status     string            `json:"status"`
+}
+
+// Adjustment books the outcome of a dispute. Amount is the agreed minus the
+// charged amount, so a credit to the home operator is negative.
+type Adjustment struct {
+	AdjustmentID string    `json:"adjustmentId"`
+	DisputeID    string    `json:"disputeId"`
+	HO           string    `json:"ho"`
+	RP           string    `json:"rp"`
+	Currency     string    `json:"currency"`
+	Amount       Money     `json:"amount"`
+	Time         time.Time `json:"time"`
+}
+
+// DisputeSummary sums the disputes of HO subscribers on RP in one currency.
+// Disputed is what was charged for all disputed calls, Agreed what was
+// agreed for the resolved ones and Outstanding what was charged for the
+// unresolved ones.
+type DisputeSummary struct {
+	HO          string `json:"ho"`
+	RP          string `json:"rp"`
+	Currency    string `json:"currency"`
+	Disputes    int    `json:"disputes"`
+	Disputed    Money  `json:"disputed"`
+	Agreed      Money  `json:"agreed"`
+	Adjusted    Money  `json:"adjusted"`
+	Outstanding Money  `json:"outstanding"`
+}
+
+// disputeRequest is the argument of raiseDispute
+type disputeRequest struct {
+	Records  []string `json:"records"`
+	Proposed Money    `json:"proposed"`
+	Evidence []string `json:"evidence"`
+	Note     string   `json:"note"`
+}
+
+func disputeKey(ho string, rp string, at time.Time, txID string) string {
+	a, b := operatorPair(ho, rp)
+	return disputePrefix + a + ":" + b + ":" + at.UTC().Format(time.RFC3339) + ":" + txID
+}
+
+func disputeIndexKey(record string) string {
+	return disputeIndexPrefix + record
+}
+
+func adjustmentKey(d Dispute) string {
+	return adjustmentPrefix + strings.TrimPrefix(d.DisputeID, disputePrefix)
+}
+
+func checkEvidence(evidence []string) error {
+	for _, e := range evidence {
+		if !sha256Pattern.MatchString(e) {
+			return validationError("Evidence " + e + " is not a hex SHA-256 hash")
+		}
+	}
+	return nil
+}
+
+func getDispute(stub shim.ChaincodeStubInterface, id string) (Dispute, error) {
+	var d Dispute
+	bytes, err := stub.GetState(id)
+	if err != nil {
+		return d, internalError("Error retrieving dispute " + id)
+	}
+	if bytes == nil || !strings.HasPrefix(id, disputePrefix) {
+		return d, notFoundError("Dispute not found " + id)
+	}
+	if err = json.Unmarshal(bytes, &d); err != nil {
+		return d, internalError("Error unmarshalling dispute " + id)
+	}
+	return d, nil
+}
+
+//putDispute writes a dispute, refusing to touch one that is resolved
+func putDispute(stub shim.ChaincodeStubInterface, d Dispute) error {
+	existing, err := stub.GetState(d.DisputeID)
+	if err != nil {
+		return internalError("Error retrieving dispute " + d.DisputeID)
+	}
+	if existing != nil {
+		var old Dispute
+		if err = json.Unmarshal(existing, &old); err == nil && old.Status == disputeResolved {
+			return conflictError("Dispute " + d.DisputeID + " is resolved and can not be modified")
+		}
+	}
+	bytes, err := json.Marshal(d)
+	if err != nil {
+		return internalError("Error marshalling dispute " + d.DisputeID)
+	}
+	if err = stub.PutState(d.DisputeID, bytes); err != nil {
+		fmt.Println("Error - could not write dispute " + d.DisputeID)
+		return internalError("Error writing dispute " + d.DisputeID)
+	}
+	fmt.Println("Success, wrote dispute " + d.DisputeID)
+	return nil
+}
+
+//getDisputes returns the disputes between two operators in both directions, oldest first
+func getDisputes(stub shim.ChaincodeStubInterface, op1 string, op2 string) ([]Dispute, error) {
+	a, b := operatorPair(op1, op2)
+	disputes := []Dispute{}
+	err := rangeByPrefix(stub, disputePrefix+a+":"+b+":", func(key string, value []byte) error {
+		var d Dispute
+		if err := json.Unmarshal(value, &d); err != nil {
+			return internalError("Error unmarshalling dispute " + key)
+		}
+		disputes = append(disputes, d)
+		return nil
+	})
+	return disputes, err
+}
+
+//adjustmentRecords calls fn with every adjustment between two operators,
+//ready to be booked on a settlement statement
+func adjustmentRecords(stub shim.ChaincodeStubInterface, a string, b string, fn func(rec ratedRecord) error) error {
+	return rangeByPrefix(stub, adjustmentPrefix+a+":"+b+":", func(key string, value []byte) error {
+		var adj Adjustment
+		if err := json.Unmarshal(value, &adj); err != nil {
+			return internalError("Error unmarshalling adjustment " + key)
+		}
+		return fn(ratedRecord{adj.AdjustmentID, adj.HO, adj.RP, serviceAdjustment, 0, adj.Time, adj.Amount, adj.Currency})
+	})
+}
+
+//disputeParty returns which of the dispute's operators the caller acts for
+func disputeParty(stub shim.ChaincodeStubInterface, d Dispute, action string) (string, error) {
+	if err := requireOperator(stub, action+" dispute "+d.DisputeID, d.HO, d.RP); err != nil {
+		return "", err
+	}
+	return certAttribute(stub, attrOperator), nil
+}
+
+//requireTurn passes the operator that did not make the latest proposal
+func requireTurn(d Dispute, party string, action string) error {
+	if d.Status != disputeOpen && d.Status != disputeCountered {
+		return conflictError("Can not " + action + " dispute " + d.DisputeID + ", it is " + d.Status)
+	}
+	latest := d.Proposals[len(d.Proposals)-1]
+	if latest.Operator == party {
+		return conflictError("Dispute " + d.DisputeID + " waits for the answer of the other operator")
+	}
+	return nil
+}
+
+//resolve closes the dispute at the agreed amount and books the adjustment
+func resolve(stub shim.ChaincodeStubInterface, d *Dispute, agreed Money, at time.Time) error {
+	d.Agreed = agreed
+	d.Status = disputeResolved
+	d.ResolvedAt = at
+	adj := Adjustment{
+		AdjustmentID: adjustmentKey(*d),
+		DisputeID:    d.DisputeID,
+		HO:           d.HO,
+		RP:           d.RP,
+		Currency:     d.Currency,
+		Amount:       agreed - d.Charged,
+		Time:         at,
+	}
+	d.Adjustment = adj.AdjustmentID
+	bytes, err := json.Marshal(adj)
+	if err != nil {
+		return internalError("Error marshalling adjustment " + adj.AdjustmentID)
+	}
+	if err = stub.PutState(adj.AdjustmentID, bytes); err != nil {
+		return internalError("Error writing adjustment " + adj.AdjustmentID)
+	}
+	return putDispute(stub, *d)
+}
+
+func disputeEvent(stub shim.ChaincodeStubInterface, name string, d Dispute, party string, amount Money, at time.Time) error {
+	event := newOperatorEvent(stub, name, d.HO, d.RP, at, DisputeEvent{DisputeID: d.DisputeID, Status: d.Status, Operator: party, Amount: amount, Currency: d.Currency})
+	return setEvents(stub, []RoamingEvent{event})
+}
+
+/*		0
+	json
+	{
+		"records": ["cdr:rs1:0000000001", "cdr:rs1:0000000002"],
+		"proposed": "10.00",
+		"evidence": ["9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"],
+		"note": "calls were dropped after setup"
+	}
+*/
+func (t *SimpleChaincode) raiseDispute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Raising dispute")
+	if err := checkArgs("raiseDispute", args, 1, "dispute record"); err != nil {
+		return nil, err
+	}
+	var req disputeRequest
+	if err := json.Unmarshal([]byte(args[0]), &req); err != nil {
+		return nil, validationError("Invalid dispute: " + err.Error())
+	}
+	if len(req.Records) == 0 {
+		return nil, validationError("A dispute needs at least one charged call")
+	}
+	if err := checkEvidence(req.Evidence); err != nil {
+		return nil, err
+	}
+
+	var d Dispute
+	for i, id := range req.Records {
+		if !strings.HasPrefix(id, cdrPrefix) {
+			return nil, validationError(id + " is not a call detail record")
+		}
+		cdr, err := getCDR(stub, id)
+		if err != nil {
+			return nil, err
+		}
+		if cdr.Status != cdrStatusCharged {
+			return nil, conflictError("Call " + id + " is not charged yet")
+		}
+		if i == 0 {
+			d.HO, d.RP, d.Currency = cdr.HO, cdr.RP, cdr.Currency
+		} else if cdr.HO != d.HO || cdr.RP != d.RP || cdr.Currency != d.Currency {
+			return nil, validationError("All calls of a dispute must be between the same operators and in one currency")
+		}
+		if d.RP == "" || d.RP == d.HO {
+			return nil, validationError("Call " + id + " is not a roaming call")
+		}
+		owner, err := indexOwner(stub, disputeIndexKey(id))
+		if err != nil {
+			return nil, err
+		}
+		if owner != "" {
+			return nil, conflictError("Call " + id + " is already disputed in " + owner)
+		}
+		for _, other := range req.Records[:i] {
+			if other == id {
+				return nil, validationError("Call " + id + " is listed twice")
+			}
+		}
+		d.Charged = d.Charged + cdr.Charges
+	}
+	//Only the home operator pays for the calls, so only it disputes them
+	if err := requireOperator(stub, "dispute the charges of "+d.RP, d.HO); err != nil {
+		return nil, err
+	}
+	if req.Proposed < 0 || req.Proposed > d.Charged {
+		return nil, validationError("Proposed amount must be between 0 and the charged " + d.Charged.String())
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	d.DisputeID = disputeKey(d.HO, d.RP, now, stub.GetTxID())
+	d.Records = req.Records
+	d.Proposals = []DisputeProposal{{Operator: d.HO, Amount: req.Proposed, Evidence: req.Evidence, Note: req.Note, Time: now}}
+	d.RaisedAt = now
+	d.Status = disputeOpen
+	for _, id := range d.Records {
+		if err = stub.PutState(disputeIndexKey(id), []byte(d.DisputeID)); err != nil {
+			return nil, internalError("Error writing index " + disputeIndexKey(id))
+		}
+	}
+	if err = putDispute(stub, d); err != nil {
+		return nil, err
+	}
+	return nil, disputeEvent(stub, eventDisputeRaised, d, d.HO, req.Proposed, now)
+}
+
+//Accept the latest proposal of the other operator
+//	args: dispute id
+func (t *SimpleChaincode) acceptDispute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Accepting dispute proposal")
+	if err := checkArgs("acceptDispute", args, 1, "dispute id"); err != nil {
+		return nil, err
+	}
+	d, err := getDispute(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	party, err := disputeParty(stub, d, "accept")
+	if err != nil {
+		return nil, err
+	}
+	if err = requireTurn(d, party, "accept"); err != nil {
+		return nil, err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if err = resolve(stub, &d, d.Proposals[len(d.Proposals)-1].Amount, now); err != nil {
+		return nil, err
+	}
+	return nil, disputeEvent(stub, eventDisputeResolved, d, party, d.Agreed, now)
+}
+
+//Answer the latest proposal of the other operator with another amount
+//	args: dispute id, amount, note [, evidence hash...]
+func (t *SimpleChaincode) counterDispute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Countering dispute")
+	if len(args) < 3 {
+		return nil, checkArgs("counterDispute", args, 3, "dispute id, amount, note and optionally evidence hashes")
+	}
+	amount, err := parseMoney(args[1])
+	if err != nil {
+		return nil, validationError("Invalid amount " + args[1])
+	}
+	evidence := args[3:]
+	if err = checkEvidence(evidence); err != nil {
+		return nil, err
+	}
+	d, err := getDispute(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	party, err := disputeParty(stub, d, "counter")
+	if err != nil {
+		return nil, err
+	}
+	if err = requireTurn(d, party, "counter"); err != nil {
+		return nil, err
+	}
+	if amount < 0 || amount > d.Charged {
+		return nil, validationError("Proposed amount must be between 0 and the charged " + d.Charged.String())
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	d.Proposals = append(d.Proposals, DisputeProposal{Operator: party, Amount: amount, Evidence: append([]string{}, evidence...), Note: args[2], Time: now})
+	d.Status = disputeCountered
+	if err = putDispute(stub, d); err != nil {
+		return nil, err
+	}
+	return nil, disputeEvent(stub, eventDisputeCountered, d, party, amount, now)
+}
+
+//Hand the dispute to an admin for a decision
+//	args: dispute id, reason
+func (t *SimpleChaincode) escalateDispute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Escalating dispute")
+	if err := checkArgs("escalateDispute", args, 2, "dispute id and reason"); err != nil {
+		return nil, err
+	}
+	d, err := getDispute(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	party, err := disputeParty(stub, d, "escalate")
+	if err != nil {
+		return nil, err
+	}
+	if d.Status != disputeOpen && d.Status != disputeCountered {
+		return nil, conflictError("Can not escalate dispute " + d.DisputeID + ", it is " + d.Status)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	d.Status = disputeEscalated
+	d.Escalation = party + ": " + args[1]
+	if err = putDispute(stub, d); err != nil {
+		return nil, err
+	}
+	return nil, disputeEvent(stub, eventDisputeEscalated, d, party, 0, now)
+}
+
+//Decide an escalated dispute
+//	args: dispute id, agreed amount
+func (t *SimpleChaincode) resolveDispute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Resolving dispute")
+	if err := checkArgs("resolveDispute", args, 2, "dispute id and amount"); err != nil {
+		return nil, err
+	}
+	if err := requireRole(stub, "decide escalated disputes", roleAdmin); err != nil {
+		return nil, err
+	}
+	amount, err := parseMoney(args[1])
+	if err != nil {
+		return nil, validationError("Invalid amount " + args[1])
+	}
+	d, err := getDispute(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if d.Status != disputeEscalated {
+		return nil, conflictError("Only escalated disputes are decided by an admin, " + d.DisputeID + " is " + d.Status)
+	}
+	if amount < 0 || amount > d.Charged {
+		return nil, validationError("Agreed amount must be between 0 and the charged " + d.Charged.String())
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if err = resolve(stub, &d, amount, now); err != nil {
+		return nil, err
+	}
+	return nil, disputeEvent(stub, eventDisputeResolved, d, "", amount, now)
+}
+
+func (t *SimpleChaincode) queryDispute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("queryDispute called")
+	if err := checkArgs("queryDispute", args, 1, "dispute id"); err != nil {
+		return nil, err
+	}
+	d, err := getDispute(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = requireOperatorOrRole(stub, "read dispute "+d.DisputeID, []string{d.HO, d.RP}, roleAuditor, roleAdmin); err != nil {
+		return nil, err
+	}
+	return json.Marshal(d)
+}
+
+//Query the disputed, agreed and outstanding amounts between two operators,
+//one summary per direction and currency
+//	args: two operators
+func (t *SimpleChaincode) queryDisputeSummary(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("queryDisputeSummary called")
+	if err := checkArgs("queryDisputeSummary", args, 2, "two operators"); err != nil {
+		return nil, err
+	}
+	if err := requireOperatorOrRole(stub, "read the disputes of "+args[0]+" and "+args[1], args, roleAuditor, roleAdmin); err != nil {
+		return nil, err
+	}
+	disputes, err := getDisputes(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	summaries := []DisputeSummary{}
+	for _, d := range disputes {
+		i := 0
+		for i < len(summaries) && !(summaries[i].HO == d.HO && summaries[i].Currency == d.Currency) {
+			i++
+		}
+		if i == len(summaries) {
+			summaries = append(summaries, DisputeSummary{HO: d.HO, RP: d.RP, Currency: d.Currency})
+		}
+		s := &summaries[i]
+		s.Disputes++
+		s.Disputed = s.Disputed + d.Charged
+		if d.Status == disputeResolved {
+			s.Agreed = s.Agreed + d.Agreed
+			s.Adjusted = s.Adjusted + d.Agreed - d.Charged
+		} else {
+			s.Outstanding = s.Outstanding + d.Charged
+		}
+	}
+	return json.Marshal(summaries)
+}
@@ -0,0 +1,124 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+//raiseDispute disputes calls as their home operator and returns the dispute id
+func (l *testLedger) raiseDispute(proposed string, records ...string) string {
+	l.t.Helper()
+	list := ""
+	for i, id := range records {
+		if i > 0 {
+			list += ", "
+		}
+		list += `"` + id + `"`
+	}
+	l.asOperator("ABC").mustInvoke("raiseDispute", `{"records": [`+list+`], "proposed": "`+proposed+`"}`)
+	id, _ := l.stub.GetState(disputeIndexKey(records[0]))
+	return string(id)
+}
+
+func (l *testLedger) dispute(id string) Dispute {
+	l.t.Helper()
+	var d Dispute
+	l.asRole(roleAuditor).mustQuery(&d, "queryDispute", id)
+	return d
+}
+
+func TestEscalatedDisputeBooksTheDecidedAdjustment(t *testing.T) {
+	l := newTestLedger(t)
+	l.publishTestRates()
+	l.roam("rs1", "XYZ")
+	l.call("rs1", "4930123456", time.Minute)
+	l.call("rs1", "4930123456", 2*time.Minute)
+	cdrs := l.cdrs("rs1")
+
+	id := l.raiseDispute("5.00", cdrs[0].CDRID, cdrs[1].CDRID)
+	l.mustFail(codeStateConflict, "raiseDispute", `{"records": ["`+cdrs[1].CDRID+`"], "proposed": "1.00"}`)
+	l.mustFail(codeStateConflict, "counterDispute", id, "4.00", "lower still")
+	l.asOperator("XYZ").mustInvoke("counterDispute", id, "12.00", "only the second call dropped")
+	l.asOperator("ABC").mustFail(codeValidation, "counterDispute", id, "16.00", "more than charged")
+	l.mustInvoke("escalateDispute", id, "no agreement")
+	l.mustFail(codeStateConflict, "acceptDispute", id)
+	l.asOperator("XYZ").mustFail(codeUnauthorized, "resolveDispute", id, "9.00")
+	l.asRole(roleAdmin).mustInvoke("resolveDispute", id, "9.00")
+
+	d := l.dispute(id)
+	if d.Status != disputeResolved || d.Charged.String() != "15.0000" || d.Agreed.String() != "9.0000" || len(d.Proposals) != 2 {
+		t.Fatalf("dispute %s charged %s agreed %s after %d proposals", d.Status, d.Charged, d.Agreed, len(d.Proposals))
+	}
+	var adj Adjustment
+	bytes, _ := l.stub.GetState(d.Adjustment)
+	if err := json.Unmarshal(bytes, &adj); err != nil || adj.Amount.String() != "-6.0000" || adj.Currency != "EUR" {
+		t.Fatalf("adjustment %s: %+v, want -6.0000 EUR", d.Adjustment, adj)
+	}
+
+	var summaries []DisputeSummary
+	l.asOperator("XYZ").mustQuery(&summaries, "queryDisputeSummary", "ABC", "XYZ")
+	if len(summaries) != 1 || summaries[0].Adjusted.String() != "-6.0000" || summaries[0].Outstanding != 0 {
+		t.Errorf("summaries %+v", summaries)
+	}
+
+	//The statement books both calls and the credit to the home operator
+	l.advance(24 * time.Hour)
+	l.asOperator("ABC").mustInvoke("closeSettlementPeriod", "ABC", "XYZ", "2017-03-01T00:00:00Z", "2017-03-02T00:00:00Z")
+	s := l.statement("2017-03-01T00:00:00Z")
+	if len(s.Records) != 3 || s.Totals[0].Net.String() != "9.0000" {
+		t.Fatalf("statement books %v with totals %+v, want two calls and the adjustment netting 9.0000", s.Records, s.Totals)
+	}
+	found := false
+	for _, li := range s.LineItems {
+		if li.Service == serviceAdjustment {
+			found = li.Amount.String() == "-6.0000" && li.Debtor == "ABC"
+		}
+	}
+	if !found {
+		t.Errorf("line items %+v, want an adjustment of -6.0000 owed by ABC", s.LineItems)
+	}
+}
+
+func TestAdjustmentIsBookedOnTheNextStatement(t *testing.T) {
+	l := newTestLedger(t)
+	l.publishTestRates()
+	l.roam("rs1", "XYZ")
+	l.call("rs1", "4930123456", time.Minute)
+	cdr := l.cdrs("rs1")[0]
+	l.advance(24 * time.Hour)
+	l.asOperator("ABC").mustInvoke("closeSettlementPeriod", "ABC", "XYZ", "2017-03-01T00:00:00Z", "2017-03-02T00:00:00Z")
+	l.mustInvoke("acceptStatement", "settlement:ABC:XYZ:2017-03-01T00:00:00Z")
+	l.asOperator("XYZ").mustInvoke("acceptStatement", "settlement:ABC:XYZ:2017-03-01T00:00:00Z")
+
+	//The call is settled already, the dispute over it is corrected later
+	id := l.raiseDispute("3.00", cdr.CDRID)
+	l.asOperator("XYZ").mustInvoke("acceptDispute", id)
+	l.advance(24 * time.Hour)
+	l.asOperator("ABC").mustInvoke("closeSettlementPeriod", "ABC", "XYZ", "2017-03-02T00:00:00Z", "2017-03-03T00:00:00Z")
+
+	if s := l.statement("2017-03-01T00:00:00Z"); s.Status != statementAccepted || s.Totals[0].Net.String() != "5.0000" {
+		t.Errorf("accepted statement changed to %s netting %s", s.Status, s.Totals[0].Net)
+	}
+	s := l.statement("2017-03-02T00:00:00Z")
+	if len(s.Records) != 1 || s.Records[0] != l.dispute(id).Adjustment || s.Totals[0].Net.String() != "-2.0000" || s.Totals[0].Payer != "XYZ" {
+		t.Errorf("next statement books %v with totals %+v, want XYZ to pay back 2.0000", s.Records, s.Totals)
+	}
+}
@@ -0,0 +1,328 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// A home operator erases a subscriber by crypto-shredding. The blocks keep
+// every transaction for good, including the sealed PII of enterData, so
+// nothing can be deleted there. Instead the operator destroys the
+// subscriber's key in its vault (piivault forget), which leaves the blob
+// unreadable, and calls forgetSubscriber to clear what world state holds:
+//
+//   - the subscriber record becomes a tombstone in state Forgotten, which
+//     allows no further actions and can not be entered again
+//   - the MSISDN, IMSI and ICCID index records and the attachment go
+//   - the CDRs and usage records keep their rates and charges for
+//     settlement, but lose the numbers of both parties
+//   - fraud cases lose the MSISDN, their details and the notes of their trail
+//   - the location history goes
+//
+// Not all of it is gone after that. The transactions still hold what
+// erasureRetained lists, the erasure record says so rather than claim the
+// subscriber can not be traced any more.
+//
+// "erasure:<subscriber key>" records who erased the subscriber, when and
+// why, together with the rated totals that were kept.
+var erasurePrefix = "erasure:"
+
+// ErasureTotal is the rated usage of one service, roaming partner and
+// currency that was kept when a subscriber was forgotten
+type ErasureTotal struct {
+	Service  string `json:"service"`
+	RP       string `json:"rp"`
+	Currency string `json:"currency"`
+	Records  int    `json:"records"`
+	Charges  Money  `json:"charges"`
+}
+
+// erasureRetained is what the transaction history keeps of a forgotten subscriber
+var erasureRetained = []string{
+	"the masked MSISDN and its digest in enterData, whoever can read the MSISDN key in world state can match the digest against candidate numbers",
+	"the positions reported by discoverRP, rounded to about a kilometre",
+	"the numbers of the other parties in the arguments of CallOut, CallIn, SMSOut and SMSIn",
+	"the number and position in clear of any fixture that listed the subscriber",
+}
+
+// Erasure is the record of a forgotten subscriber. Retained lists what the
+// transaction history still holds of it, the sealed PII is only unreadable
+// once the home operator has destroyed the key.
+type Erasure struct {
+	PublicKey   string         `json:"publickey"`
+	HO          string         `json:"ho"`
+	RequestedBy string         `json:"requestedBy"`
+	Reason      string         `json:"reason"`
+	Time        time.Time      `json:"time"`
+	TxID        string         `json:"txid"`
+	Records     int            `json:"records"`
+	FraudCases  int            `json:"fraudCases"`
+	Locations   int            `json:"locations"`
+	Totals      []ErasureTotal `json:"totals"`
+	Retained    []string       `json:"retained"`
+}
+
+func erasureKey(publicKey string) string {
+	return erasurePrefix + publicKey
+}
+
+//addTotal adds a rated record to the totals, keeping the totals in the order they were first seen
+func addTotal(totals []ErasureTotal, service string, rp string, currency string, charges Money) []ErasureTotal {
+	for i := range totals {
+		if totals[i].Service == service && totals[i].RP == rp && totals[i].Currency == currency {
+			totals[i].Records++
+			totals[i].Charges += charges
+			return totals
+		}
+	}
+	return append(totals, ErasureTotal{Service: service, RP: rp, Currency: currency, Records: 1, Charges: charges})
+}
+
+//putErased overwrites a record with its erased version. Charged records are
+//otherwise immutable, see putCDR and putUsage; erasure is the one exception.
+func putErased(stub shim.ChaincodeStubInterface, key string, record interface{}) error {
+	bytes, err := json.Marshal(record)
+	if err != nil {
+		return internalError("Error marshalling erased record " + key)
+	}
+	if err = stub.PutState(key, bytes); err != nil {
+		fmt.Println("Error - could not write erased record " + key)
+		return internalError("Error writing erased record " + key)
+	}
+	return nil
+}
+
+//eraseRecords clears the numbers from the CDRs and usage records of a
+//subscriber and adds what they were charged to the totals of the erasure
+func eraseRecords(stub shim.ChaincodeStubInterface, publicKey string, erasure *Erasure) error {
+	cdrs, err := getCDRs(stub, publicKey)
+	if err != nil {
+		return err
+	}
+	for _, cdr := range cdrs {
+		cdr.MSISDN = ""
+		cdr.CallingParty = ""
+		cdr.Destination = ""
+		if err = putErased(stub, cdr.CDRID, cdr); err != nil {
+			return err
+		}
+		erasure.Totals = addTotal(erasure.Totals, serviceVoice, cdr.RP, cdr.Currency, cdr.Charges)
+	}
+	sessions, err := getDataSessions(stub, publicKey)
+	if err != nil {
+		return err
+	}
+	for _, rec := range sessions {
+		rec.MSISDN = ""
+		if err = putErased(stub, rec.RecordID, rec); err != nil {
+			return err
+		}
+		erasure.Totals = addTotal(erasure.Totals, serviceData, rec.RP, rec.Currency, rec.Charges)
+	}
+	messages, err := getSMSRecords(stub, publicKey)
+	if err != nil {
+		return err
+	}
+	for _, rec := range messages {
+		rec.MSISDN = ""
+		rec.CallingParty = ""
+		rec.Destination = ""
+		if err = putErased(stub, rec.RecordID, rec); err != nil {
+			return err
+		}
+		erasure.Totals = addTotal(erasure.Totals, serviceSMS, rec.RP, rec.Currency, rec.Charges)
+	}
+	erasure.Records = len(cdrs) + len(sessions) + len(messages)
+	return nil
+}
+
+//eraseFraudCases clears the MSISDN and details of the fraud cases of a
+//subscriber, and the notes of their trail, which quote the details
+func eraseFraudCases(stub shim.ChaincodeStubInterface, publicKey string, erasure *Erasure) error {
+	var cases []FraudCase
+	err := rangeByPrefix(stub, fraudPrefix+publicKey+":", func(key string, value []byte) error {
+		var fc FraudCase
+		if err := json.Unmarshal(value, &fc); err != nil {
+			return internalError("Error unmarshalling fraud case " + key)
+		}
+		cases = append(cases, fc)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, fc := range cases {
+		fc.MSISDN = ""
+		fc.Details = ""
+		for i := range fc.History {
+			fc.History[i].Note = ""
+		}
+		fc.UpdatedAt = erasure.Time
+		fc.History = append(fc.History, FraudCaseNote{Time: erasure.Time, Operator: erasure.RequestedBy, Status: fc.Status, Note: "Details erased"})
+		if err = putFraudCase(stub, fc); err != nil {
+			return err
+		}
+	}
+	erasure.FraudCases = len(cases)
+	return nil
+}
+
+//Forget a subscriber. The home operator destroys its key in the vault as
+//well, the chaincode can not do that. Subscribers in a call or data session
+//have to finish it first. The erasure record lists what the transactions
+//still hold of the subscriber.
+//	args: subscriber key, reason
+func (t *SimpleChaincode) forgetSubscriber(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("forgetSubscriber called")
+	if err := checkArgs("forgetSubscriber", args, 2, "subscriber key and reason"); err != nil {
+		return nil, err
+	}
+	if args[1] == "" {
+		return nil, validationError("forgetSubscriber needs a reason")
+	}
+	rs, err := getSubscriber(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = requireOperatorOrRole(stub, "forget subscriber "+rs.PublicKey, []string{rs.HO}, roleAdmin); err != nil {
+		return nil, err
+	}
+	switch state := sessionState(rs); {
+	case state == stateForgotten:
+		return nil, conflictError("Subscriber " + rs.PublicKey + " is already forgotten")
+	case state == stateInCall || state == stateCallEnded:
+		return nil, conflictError("Subscriber " + rs.PublicKey + " has a call that is not charged yet, state " + state)
+	case rs.CurrentData != "":
+		return nil, conflictError("Subscriber " + rs.PublicKey + " has an open data session " + rs.CurrentData)
+	}
+	at, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	requestedBy := certAttribute(stub, attrOperator)
+	if !isOperator(stub, rs.HO) {
+		requestedBy = roleAdmin
+	}
+	erasure := Erasure{
+		PublicKey:   rs.PublicKey,
+		HO:          rs.HO,
+		RequestedBy: requestedBy,
+		Reason:      args[1],
+		Time:        at,
+		TxID:        stub.GetTxID(),
+		Totals:      []ErasureTotal{},
+		Retained:    erasureRetained,
+	}
+
+	if err = eraseRecords(stub, rs.PublicKey, &erasure); err != nil {
+		return nil, err
+	}
+	if err = eraseFraudCases(stub, rs.PublicKey, &erasure); err != nil {
+		return nil, err
+	}
+	locations, _, err := getLocations(stub, rs.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range locations {
+		if err = stub.DelState(key); err != nil {
+			return nil, internalError("Error deleting location " + key)
+		}
+	}
+	erasure.Locations = len(locations)
+	digest, err := subscriberDigest(stub, rs)
+	if err != nil {
+		return nil, err
+	}
+	if err = detach(stub, digest, rs.PublicKey); err != nil {
+		return nil, err
+	}
+	//The operator index stays, the tombstone is still one of the HO's subscribers
+	keys, err := rs.indexKeys(stub)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key == operatorIndexKey(rs.HO, rs.PublicKey) {
+			continue
+		}
+		if err = stub.DelState(key); err != nil {
+			return nil, internalError("Error deleting index " + key)
+		}
+	}
+
+	tombstone := rsDetailBlock{
+		PublicKey: rs.PublicKey,
+		HO:        rs.HO,
+		Roaming:   "FALSE",
+		Time:      at,
+		CDRSeq:    rs.CDRSeq,
+		UsageSeq:  rs.UsageSeq,
+		State:     stateForgotten,
+	}
+	if err = putSubscriber(stub, tombstone); err != nil {
+		return nil, err
+	}
+
+	bytes, err := json.Marshal(erasure)
+	if err != nil {
+		return nil, internalError("Error marshalling erasure " + rs.PublicKey)
+	}
+	if err = stub.PutState(erasureKey(rs.PublicKey), bytes); err != nil {
+		fmt.Println("Error - could not write erasure " + rs.PublicKey)
+		return nil, internalError("Error writing erasure " + rs.PublicKey)
+	}
+	events := []RoamingEvent{newEvent(stub, eventSubscriberForgotten, tombstone, at,
+		ErasureEvent{Reason: erasure.Reason, RequestedBy: requestedBy, Records: erasure.Records})}
+	if err = setEvents(stub, events); err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
+
+//Query the erasure record of a forgotten subscriber
+//	args: subscriber key
+func (t *SimpleChaincode) queryErasure(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("queryErasure called")
+	if err := checkArgs("queryErasure", args, 1, "subscriber key"); err != nil {
+		return nil, err
+	}
+	if err := validateSubscriberKey(args[0]); err != nil {
+		return nil, err
+	}
+	bytes, err := stub.GetState(erasureKey(args[0]))
+	if err != nil {
+		return nil, internalError("Error retrieving erasure " + args[0])
+	}
+	if bytes == nil {
+		return nil, notFoundError("Subscriber " + args[0] + " has not been forgotten")
+	}
+	var erasure Erasure
+	if err = json.Unmarshal(bytes, &erasure); err != nil {
+		return nil, internalError("Error unmarshalling erasure " + args[0])
+	}
+	if err = requireOperatorOrRole(stub, "read the erasure of "+args[0], []string{erasure.HO}, roleAuditor, roleAdmin); err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
@@ -0,0 +1,108 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForgetSubscriberKeepsTheCharges(t *testing.T) {
+	l := newTestLedger(t)
+	l.publishTestRates()
+	l.asOperator("ABC").mustInvoke("enterData", l.enterArgs("rs1", testMSISDN, "ABC")...)
+	l.roam("rs1", "XYZ")
+	l.call("rs1", testDestination, time.Minute)
+	l.mustInvoke("DataSessionStart", "rs1")
+	l.mustInvoke("DataSessionEnd", "rs1", "1048576")
+	l.mustInvoke("SMSOut", "rs1", testDestination)
+	//A fix outside the coverage of the partner opens a fraud case
+	l.mustInvoke("registerCoverage", `{"areaId": "DE", "operator": "XYZ", "country": "DE",
+		"box": {"minLat": 47.27, "minLong": 5.87, "maxLat": 55.06, "maxLong": 15.04}}`)
+	l.advance(24 * time.Hour)
+	l.mustInvoke("discoverRP", "rs1", "XYZ", "DALLAS", "32.94", "-96.99")
+
+	l.mustFail(codeUnauthorized, "forgetSubscriber", "rs1", "customer request")
+	l.asOperator("ABC").mustInvoke("forgetSubscriber", "rs1", "customer request")
+	l.mustFail(codeStateConflict, "forgetSubscriber", "rs1", "customer request")
+
+	var erasure Erasure
+	l.mustQuery(&erasure, "queryErasure", "rs1")
+	if erasure.RequestedBy != "ABC" || erasure.Records != 3 || erasure.FraudCases != 1 || erasure.Locations != 2 {
+		t.Errorf("erasure by %s of %d records, %d fraud cases, %d locations", erasure.RequestedBy, erasure.Records, erasure.FraudCases, erasure.Locations)
+	}
+	if len(erasure.Retained) != len(erasureRetained) {
+		t.Errorf("erasure retains %q", erasure.Retained)
+	}
+	totals := map[string]string{}
+	for _, total := range erasure.Totals {
+		totals[total.Service] = total.RP + " " + total.Charges.String() + " " + total.Currency
+	}
+	if totals[serviceVoice] != "XYZ 5.0000 EUR" || totals[serviceData] != "XYZ 2.0000 EUR" || totals[serviceSMS] != "XYZ 0.5000 EUR" {
+		t.Errorf("totals %v", totals)
+	}
+
+	rs := l.subscriber("rs1")
+	if rs.State != stateForgotten || rs.MSISDN != "" || rs.PII != nil || rs.CDRSeq != 1 || rs.UsageSeq != 2 {
+		t.Errorf("tombstone %+v", rs)
+	}
+	cdr := l.cdrs("rs1")[0]
+	if cdr.Status != cdrStatusCharged || cdr.Charges.String() != "5.0000" || cdr.MSISDN != "" || cdr.Destination != "" {
+		t.Errorf("erased CDR %+v", cdr)
+	}
+	for key, value := range l.stub.State {
+		if inClear(string(value)) || strings.Contains(string(value), "c2VhbGVk") {
+			t.Errorf("%s still holds personal data: %s", key, value)
+		}
+		if strings.HasPrefix(key, locationPrefix+"rs1:") || strings.HasPrefix(key, attachPrefix) && strings.Contains(string(value), `"rs1"`) {
+			t.Errorf("%s is left", key)
+		}
+		if strings.HasPrefix(key, fraudPrefix+"rs1:") {
+			var fc FraudCase
+			json.Unmarshal(value, &fc)
+			for _, note := range fc.History[:len(fc.History)-1] {
+				if note.Note != "" {
+					t.Errorf("fraud case %s keeps the note %q", fc.CaseID, note.Note)
+				}
+			}
+		}
+	}
+	if _, err := l.stub.MockQuery("querySubscriberByMSISDN", []string{testMSISDN}); err == nil {
+		t.Errorf("the forgotten MSISDN is still indexed")
+	}
+	var subscribers []rsDetailBlock
+	if l.mustQuery(&subscribers, "listSubscribersByOperator", "ABC"); len(subscribers) != 3 {
+		t.Errorf("ABC lists %d subscribers, want 3 with the tombstone", len(subscribers))
+	}
+
+	//A reset or the fixture never brings the subscriber back
+	l.asRole(roleAdmin).mustInvoke("resetInventory")
+	if rs = l.subscriber("rs1"); rs.State != stateForgotten {
+		t.Errorf("state %s after reset", rs.State)
+	}
+	l.asOperator("ABC").mustFail(codeStateConflict, "enterData", l.enterArgs("rs1", testMSISDN, "ABC")...)
+
+	//The erased records are still settled
+	l.advance(24 * time.Hour)
+	l.mustInvoke("closeSettlementPeriod", "ABC", "XYZ", "2017-03-01T00:00:00Z", "2017-03-03T00:00:00Z")
+	if s := l.statement("2017-03-01T00:00:00Z"); len(s.Records) != 3 || s.Totals[0].AOwesB.String() != "7.5000" {
+		t.Errorf("statement books %v with totals %+v", s.Records, s.Totals)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Error codes returned to the Node layer. The error text of a failed
+// Invoke or Query is the JSON form of ChaincodeError, so callers can switch
+// on the code instead of parsing messages.
+const (
+	codeValidation    = "VALIDATION"
+	codeNotFound      = "NOT_FOUND"
+	codeUnauthorized  = "UNAUTHORIZED"
+	codeStateConflict = "STATE_CONFLICT"
+	codeInternal      = "INTERNAL"
+)
+
+// ChaincodeError is the error type returned by every Invoke and Query path
+type ChaincodeError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ChaincodeError) Error() string {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return e.Code + ": " + e.Message
+	}
+	return string(bytes)
+}
+
+func newError(code string, message string) error {
+	fmt.Println("Error - " + code + ": " + message)
+	return &ChaincodeError{Code: code, Message: message}
+}
+
+//validationError is for bad arguments
+func validationError(message string) error {
+	return newError(codeValidation, message)
+}
+
+//notFoundError is for keys that are missing from the ledger
+func notFoundError(message string) error {
+	return newError(codeNotFound, message)
+}
+
+//authError is for callers that may not run the function
+func authError(message string) error {
+	return newError(codeUnauthorized, message)
+}
+
+//conflictError is for requests the current ledger state does not allow
+func conflictError(message string) error {
+	return newError(codeStateConflict, message)
+}
+
+//internalError is for ledger and marshalling failures
+func internalError(message string) error {
+	return newError(codeInternal, message)
+}
+
+//checkArgs validates the number of arguments of a function
+func checkArgs(function string, args []string, expected int, names string) error {
+	if len(args) != expected {
+		return validationError("Incorrect number of arguments for " + function + ". Expecting " + strconv.Itoa(expected) + ": " + names)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Chaincode events let the Node server push lifecycle transitions to the
+// browser instead of polling queryMSISDN. Event names carry the schema
+// version of their payload; a payload change that is not backwards
+// compatible gets a new version suffix. Every peer and event listener sees
+// the events, so they only carry masked numbers.
+//
+// Fabric keeps only one event per transaction, so a transaction that causes
+// several transitions (a discovery that also trips a fraud rule) emits a
+// single eventBatch whose payload lists all of them.
+const eventVersion = 1
+
+// Event names
+const (
+	eventDiscovery       = "roaming.discovery.v1"
+	eventAuthenticated   = "roaming.authentication.succeeded.v1"
+	eventAuthFailed      = "roaming.authentication.failed.v1"
+	eventRatesRegistered = "roaming.rates.registered.v1"
+	eventCallStarted     = "roaming.call.started.v1"
+	eventCallEnded       = "roaming.call.ended.v1"
+	eventChargePosted    = "roaming.charge.posted.v1"
+	eventDataStarted     = "roaming.data.started.v1"
+	eventDataEnded       = "roaming.data.ended.v1"
+	eventSMSSent         = "roaming.sms.sent.v1"
+	eventSMSReceived     = "roaming.sms.received.v1"
+	eventOverage         = "roaming.overage.v1"
+	eventUsageCapped     = "roaming.usage.capped.v1"
+	eventFraudFlagged    = "roaming.fraud.flagged.v1"
+	eventBatch           = "roaming.batch.v1"
+)
+
+// Settlement event names, these carry no subscriber
+const (
+	eventStatementIssued   = "roaming.settlement.issued.v1"
+	eventStatementAccepted = "roaming.settlement.accepted.v1"
+	eventStatementDisputed = "roaming.settlement.disputed.v1"
+)
+
+// Dispute event names
+const (
+	eventDisputeRaised    = "roaming.dispute.raised.v1"
+	eventDisputeCountered = "roaming.dispute.countered.v1"
+	eventDisputeEscalated = "roaming.dispute.escalated.v1"
+	eventDisputeResolved  = "roaming.dispute.resolved.v1"
+)
+
+// Erasure event name
+const eventSubscriberForgotten = "roaming.subscriber.forgotten.v1"
+
+// RoamingEvent is the payload of every event. Data holds one of the typed
+// payloads below, chosen by Name.
+type RoamingEvent struct {
+	Name      string      `json:"name"`
+	Version   int         `json:"version"`
+	TxID      string      `json:"txId"`
+	Time      time.Time   `json:"time"`
+	PublicKey string      `json:"publickey"`
+	MSISDN    string      `json:"msisdn"`
+	HO        string      `json:"ho"`
+	RP        string      `json:"rp"`
+	Data      interface{} `json:"data"`
+}
+
+// EventBatch is the payload of eventBatch
+type EventBatch struct {
+	Version int            `json:"version"`
+	Events  []RoamingEvent `json:"events"`
+}
+
+// DiscoveryEvent is the payload of eventDiscovery
+type DiscoveryEvent struct {
+	Location string `json:"location"`
+	Lat      Degrees `json:"lat"`
+	Long     Degrees `json:"long"`
+}
+
+// AuthenticationEvent is the payload of eventAuthenticated and eventAuthFailed
+type AuthenticationEvent struct {
+	Roaming string `json:"roaming"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// RatesEvent is the payload of eventRatesRegistered
+type RatesEvent struct {
+	RatePlan string `json:"ratePlan"`
+}
+
+// CallEvent is the payload of eventCallStarted and eventCallEnded
+type CallEvent struct {
+	CDRID        string  `json:"cdrId"`
+	TransType    string  `json:"transtype"`
+	CallingParty string  `json:"callingParty"`
+	Destination  string  `json:"destination"`
+	Duration     float64 `json:"duration"`
+}
+
+// DataEvent is the payload of eventDataStarted and eventDataEnded
+type DataEvent struct {
+	RecordID string `json:"recordId"`
+	Bytes    int64  `json:"bytes"`
+	Charges  Money  `json:"charges"`
+	Currency string `json:"currency,omitempty"`
+}
+
+// SMSEvent is the payload of eventSMSSent and eventSMSReceived
+type SMSEvent struct {
+	RecordID     string `json:"recordId"`
+	TransType    string `json:"transtype"`
+	CallingParty string `json:"callingParty"`
+	Destination  string `json:"destination"`
+	Charges      Money  `json:"charges"`
+	Currency     string `json:"currency"`
+}
+
+// ChargeEvent is the payload of eventChargePosted
+type ChargeEvent struct {
+	CDRID    string `json:"cdrId"`
+	Charges  Money  `json:"charges"`
+	Currency string `json:"currency"`
+}
+
+// OverageEvent is the payload of eventOverage
+type OverageEvent struct {
+	Flag    string `json:"flag"`
+	Service string `json:"service,omitempty"`
+	Month   string `json:"month,omitempty"`
+}
+
+// CapEvent is the payload of eventUsageCapped
+type CapEvent struct {
+	Month  string `json:"month"`
+	Reason string `json:"reason"`
+}
+
+// StatementEvent is the payload of the settlement events
+type StatementEvent struct {
+	StatementID string `json:"statementId"`
+	Status      string `json:"status"`
+	Operator    string `json:"operator,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// DisputeEvent is the payload of the dispute events. Amount is the proposed
+// or agreed amount, depending on the event.
+type DisputeEvent struct {
+	DisputeID string `json:"disputeId"`
+	Status    string `json:"status"`
+	Operator  string `json:"operator,omitempty"`
+	Amount    Money  `json:"amount"`
+	Currency  string `json:"currency"`
+}
+
+// ErasureEvent is the payload of eventSubscriberForgotten, the event carries
+// no MSISDN
+type ErasureEvent struct {
+	Reason      string `json:"reason"`
+	RequestedBy string `json:"requestedBy"`
+	Records     int    `json:"records"`
+}
+
+// FraudEvent is the payload of eventFraudFlagged
+type FraudEvent struct {
+	CaseID  string `json:"caseId"`
+	Rule    string `json:"rule"`
+	Details string `json:"details"`
+}
+
+//newEvent fills the envelope of an event about subscriber rs
+func newEvent(stub shim.ChaincodeStubInterface, name string, rs rsDetailBlock, at time.Time, data interface{}) RoamingEvent {
+	return RoamingEvent{
+		Name:      name,
+		Version:   eventVersion,
+		TxID:      stub.GetTxID(),
+		Time:      at,
+		PublicKey: rs.PublicKey,
+		MSISDN:    mask(rs.MSISDN),
+		HO:        rs.HO,
+		RP:        rs.RP,
+		Data:      data,
+	}
+}
+
+//newOperatorEvent builds an event between two operators that concerns no single subscriber
+func newOperatorEvent(stub shim.ChaincodeStubInterface, name string, ho string, rp string, at time.Time, data interface{}) RoamingEvent {
+	return newEvent(stub, name, rsDetailBlock{HO: ho, RP: rp}, at, data)
+}
+
+//setEvents emits the events of a transaction, batching them when there is more than one
+func setEvents(stub shim.ChaincodeStubInterface, events []RoamingEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	name := events[0].Name
+	var payload interface{} = events[0]
+	if len(events) > 1 {
+		name = eventBatch
+		payload = EventBatch{Version: eventVersion, Events: events}
+	}
+	bytes, err := json.Marshal(payload)
+	if err != nil {
+		return internalError("Error marshalling event " + name)
+	}
+	err = stub.SetEvent(name, bytes)
+	if err != nil {
+		fmt.Println("Error - could not set event " + name)
+		return internalError("Error setting event " + name)
+	}
+	fmt.Println("Event " + name)
+	return nil
+}
@@ -0,0 +1,121 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testEvent is a RoamingEvent with its payload still encoded
+type testEvent struct {
+	RoamingEvent
+	Data json.RawMessage `json:"data"`
+}
+
+//events decodes the event the last transaction set, a batch into its events
+func (l *testLedger) events() []testEvent {
+	l.t.Helper()
+	if l.stub.EventName == eventBatch {
+		var batch struct {
+			Events []testEvent `json:"events"`
+		}
+		if err := json.Unmarshal(l.stub.EventPayload, &batch); err != nil {
+			l.t.Fatalf("decoding batch %s: %v", l.stub.EventPayload, err)
+		}
+		return batch.Events
+	}
+	var event testEvent
+	if err := json.Unmarshal(l.stub.EventPayload, &event); err != nil {
+		l.t.Fatalf("decoding event %s: %v", l.stub.EventPayload, err)
+	}
+	if event.Name != l.stub.EventName {
+		l.t.Fatalf("event %s carries the payload of %s", l.stub.EventName, event.Name)
+	}
+	return []testEvent{event}
+}
+
+//event decodes the single event the last transaction set and its payload into data
+func (l *testLedger) event(name string, data interface{}) testEvent {
+	l.t.Helper()
+	events := l.events()
+	if len(events) != 1 || events[0].Name != name {
+		l.t.Fatalf("got events %s, want only %s", l.stub.EventPayload, name)
+	}
+	event := events[0]
+	if event.TxID != fmt.Sprintf("tx%04d", l.txs) || !event.Time.Equal(l.now) || event.Version != eventVersion {
+		l.t.Errorf("%s: txid %s at %s, version %d", name, event.TxID, event.Time, event.Version)
+	}
+	if err := json.Unmarshal(event.Data, data); err != nil {
+		l.t.Fatalf("decoding %s payload %s: %v", name, event.Data, err)
+	}
+	return event
+}
+
+func TestCallFlowEvents(t *testing.T) {
+	l := newTestLedger(t)
+	l.asOperator("XYZ")
+	l.mustInvoke("discoverRP", "rs1", "XYZ", "BERLIN", "52.52", "13.40")
+	var discovery DiscoveryEvent
+	if e := l.event(eventDiscovery, &discovery); e.PublicKey != "rs1" || e.HO != "ABC" || e.RP != "XYZ" || discovery.Lat != 52.52 {
+		t.Errorf("discovery event %+v %+v", e.RoamingEvent, discovery)
+	}
+	l.mustInvoke("authentication", "rs1")
+	l.event(eventAuthenticated, &AuthenticationEvent{})
+	l.mustInvoke("updateRates", "rs1")
+	var rates RatesEvent
+	if l.event(eventRatesRegistered, &rates); rates.RatePlan != "RoamingXYZ" {
+		t.Errorf("rates registered under %q", rates.RatePlan)
+	}
+
+	l.mustInvoke("CallOut", "rs1", "4930123456")
+	var started CallEvent
+	l.event(eventCallStarted, &started)
+	l.advance(time.Minute)
+	l.mustInvoke("CallEnd", "rs1")
+	var ended CallEvent
+	if l.event(eventCallEnded, &ended); ended.CDRID != started.CDRID || ended.Duration != 1 || ended.TransType != "Call Out" {
+		t.Errorf("call ended %+v, started %+v", ended, started)
+	}
+	l.mustInvoke("CallPay", "rs1")
+	var charge ChargeEvent
+	if l.event(eventChargePosted, &charge); charge.CDRID != started.CDRID || charge.Charges.String() != "5.0000" || charge.Currency != "EUR" {
+		t.Errorf("charge posted %+v", charge)
+	}
+}
+
+func TestFraudHitsAreBatched(t *testing.T) {
+	l := newTestLedger(t)
+	l.asOperator("XYZ")
+	l.mustInvoke("registerCoverage", `{"areaId": "DE", "operator": "XYZ", "country": "DE",
+		"box": {"minLat": 47.27, "minLong": 5.87, "maxLat": 55.06, "maxLong": 15.04}}`)
+	l.mustInvoke("discoverRP", "rs1", "XYZ", "DALLAS", "32.94", "-96.99")
+	if l.stub.EventName != eventBatch {
+		t.Fatalf("got event %s, want a batch", l.stub.EventName)
+	}
+	events := l.events()
+	if len(events) != 2 || events[0].Name != eventDiscovery || events[1].Name != eventFraudFlagged {
+		t.Fatalf("batch %s", l.stub.EventPayload)
+	}
+	var fraud FraudEvent
+	if err := json.Unmarshal(events[1].Data, &fraud); err != nil || fraud.Rule != ruleOutsideCoverage {
+		t.Errorf("fraud event %s: %v", events[1].Data, err)
+	}
+}
@@ -0,0 +1,281 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// A fixture is a dataset the ledger starts from: operators, subscribers,
+// roaming agreements and rate cards. Init takes one as its optional
+// argument, resetInventory goes back to defaultFixture and loadFixture adds
+// one to a running ledger. Sample fixtures are in the fixtures directory at
+// the top of the repository, fixtures/demo.json is defaultFixture and is
+// compiled in by go generate.
+//
+// Operators, agreements and rate cards are managed by their own functions
+// once they are on the ledger. A fixture only adds the ones that are not
+// there yet, so a reset never reactivates an operator, lifts the suspension
+// of an agreement or replaces a rate card.
+//
+// Subscribers are written with their coarse position only, a masked MSISDN
+// and without PII. The fixture itself holds their numbers and positions in
+// clear, so it is for demo and test data, enterData is the way to enter
+// real subscribers with protected personal data.
+
+// FixtureSubscriber is a subscriber of a fixture, at home and idle
+type FixtureSubscriber struct {
+	PublicKey string  `json:"publickey"`
+	MSISDN    string  `json:"msisdn"`
+	HO        string  `json:"ho"`
+	Location  string  `json:"location"`
+	Lat       Degrees `json:"lat"`
+	Long      Degrees `json:"long"`
+	IMSI      string  `json:"imsi,omitempty"`
+	ICCID     string  `json:"iccid,omitempty"`
+}
+
+// Fixture is a dataset to load
+type Fixture struct {
+	Operators   []Operator          `json:"operators"`
+	Subscribers []FixtureSubscriber `json:"subscribers"`
+	Agreements  []RoamingAgreement  `json:"agreements"`
+	RateCards   []RateCard          `json:"rateCards"`
+}
+
+//go:generate go run gen_fixture.go
+
+//defaultFixture is the demo dataset of fixtures/demo.json, two operators with
+//subscribers in Dallas, San Francisco, Berlin and Barcelona. Its rate cards
+//keep the old flat 5 per minute, per second billed, for outgoing calls.
+//Received SMS are free.
+func defaultFixture() (Fixture, error) {
+	return parseFixture(demoFixture)
+}
+
+//parseFixture decodes a fixture argument and checks it as a whole before anything is written
+func parseFixture(arg string) (Fixture, error) {
+	var f Fixture
+	if err := json.Unmarshal([]byte(arg), &f); err != nil {
+		return f, validationError("Invalid fixture: " + err.Error())
+	}
+	return f, f.validate()
+}
+
+func (f Fixture) validate() error {
+	for _, op := range f.Operators {
+		if err := op.validate(); err != nil {
+			return err
+		}
+	}
+	for i, rs := range f.Subscribers {
+		if rs.PublicKey == "" || rs.MSISDN == "" || rs.HO == "" {
+			return validationError("Fixture subscriber needs a publickey, an msisdn and a home operator")
+		}
+		if err := validateSubscriberKey(rs.PublicKey); err != nil {
+			return err
+		}
+		if err := (GeoPoint{rs.Lat, rs.Long}).validate(); err != nil {
+			return err
+		}
+		for _, other := range f.Subscribers[:i] {
+			if other.PublicKey == rs.PublicKey {
+				return validationError("Fixture lists subscriber " + rs.PublicKey + " twice")
+			}
+		}
+	}
+	for _, a := range f.Agreements {
+		if err := a.validate(); err != nil {
+			return err
+		}
+	}
+	for _, c := range f.RateCards {
+		if err := c.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//applyFixture writes a fixture, operators first so the subscribers and
+//agreements can refer to them. Operators, agreements and rate cards that
+//are already on the ledger are skipped. Subscribers are attached to their
+//home network, unless the operator is no longer active, then they are
+//skipped. A forgotten subscriber is never written again, it is skipped.
+//A subscriber that is already on the ledger goes back home and idle but
+//keeps its CDR and usage sequences. It is refused while it has a call or
+//data session open, the session would never be rated or settled otherwise.
+//Only the attachments of the fixture subscribers change.
+func applyFixture(stub shim.ChaincodeStubInterface, f Fixture, at time.Time) error {
+	//Checked before anything is written
+	for _, seed := range f.Subscribers {
+		existing, err := getSubscriber(stub, seed.PublicKey)
+		if err != nil {
+			continue
+		}
+		if session := openSession(existing); session != "" {
+			return conflictError("Subscriber " + seed.PublicKey + " has the " + session + " open, end it before loading the fixture")
+		}
+	}
+	for _, op := range f.Operators {
+		exists, err := keyExists(stub, operatorKey(op.ID))
+		if err != nil {
+			return err
+		}
+		if exists {
+			fmt.Println("Operator " + op.ID + " is already registered, not loading it again")
+			continue
+		}
+		op.Status = operatorActive
+		op.RegisteredAt = at
+		op.UpdatedAt = at
+		if err := putOperator(stub, op); err != nil {
+			return err
+		}
+	}
+	for _, seed := range f.Subscribers {
+		ho, err := getOperator(stub, seed.HO)
+		if err != nil {
+			return err
+		}
+		if ho.Status != operatorActive {
+			fmt.Println("Operator " + ho.ID + " is " + ho.Status + ", not loading subscriber " + seed.PublicKey)
+			continue
+		}
+		existing, err := getSubscriber(stub, seed.PublicKey)
+		if err == nil && existing.State == stateForgotten {
+			fmt.Println("Subscriber " + seed.PublicKey + " was forgotten, not loading it again")
+			continue
+		}
+		digest, err := msisdnDigest(stub, seed.MSISDN)
+		if err != nil {
+			return err
+		}
+		rs := rsDetailBlock{
+			PublicKey:    seed.PublicKey,
+			MSISDN:       mask(seed.MSISDN),
+			MSISDNDigest: digest,
+			HO:           seed.HO,
+			Roaming:      "FALSE",
+			Location:     seed.Location,
+			Lat:          coarsePosition(seed.Lat),
+			Long:         coarsePosition(seed.Long),
+			Time:         at,
+			IMSI:         seed.IMSI,
+			ICCID:        seed.ICCID,
+			State:        stateIdle,
+		}
+		//The records of a subscriber loaded again stay, its sequences go on from them
+		if existing.PublicKey != "" {
+			rs.CDRSeq = existing.CDRSeq
+			rs.UsageSeq = existing.UsageSeq
+			old, err := subscriberDigest(stub, existing)
+			if err != nil {
+				return err
+			}
+			if err = detach(stub, old, existing.PublicKey); err != nil {
+				return err
+			}
+		}
+		if err := registerSubscriber(stub, rs); err != nil {
+			return err
+		}
+		if err := putAttachment(stub, digest, Attachment{MSISDN: rs.MSISDN, PublicKey: rs.PublicKey, Network: rs.HO, Time: at}); err != nil {
+			return err
+		}
+	}
+	for _, a := range f.Agreements {
+		exists, err := keyExists(stub, agreementKey(a.HO, a.RP))
+		if err != nil {
+			return err
+		}
+		if exists {
+			fmt.Println("Agreement of " + a.HO + " and " + a.RP + " is already on the ledger, not loading it again")
+			continue
+		}
+		a.Status = agreementActive
+		if err = putAgreement(stub, a); err != nil {
+			return err
+		}
+	}
+	for _, c := range f.RateCards {
+		key := tariffKey(c.HO, c.RP, c.EffectiveFrom)
+		exists, err := keyExists(stub, key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			fmt.Println("Rate card " + key + " is already on the ledger, not loading it again")
+			continue
+		}
+		if err = putRateCard(stub, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//keyExists reports whether there is a record under key
+func keyExists(stub shim.ChaincodeStubInterface, key string) (bool, error) {
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return false, internalError("Error retrieving " + key)
+	}
+	return bytes != nil, nil
+}
+
+//resetFixture loads a fixture for Init and resetInventory. Subscribers
+//entered with enterData keep their attachments, only the ones of the
+//fixture go back to their home network.
+func resetFixture(stub shim.ChaincodeStubInterface, f Fixture) error {
+	at, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	if err = initMSISDNKey(stub); err != nil {
+		return err
+	}
+	return applyFixture(stub, f, at)
+}
+
+//Load a fixture into a running ledger. Subscribers with the same keys are
+//reloaded, operators, agreements and rate cards that exist are kept as they
+//are, see applyFixture.
+//	args: fixture (JSON, see fixtures/demo.json)
+func (t *SimpleChaincode) loadFixture(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("loadFixture called")
+	if err := checkArgs("loadFixture", args, 1, "fixture"); err != nil {
+		return nil, err
+	}
+	if err := requireRole(stub, "load fixtures", roleAdmin); err != nil {
+		return nil, err
+	}
+	f, err := parseFixture(args[0])
+	if err != nil {
+		return nil, err
+	}
+	at, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	return nil, applyFixture(stub, f, at)
+}
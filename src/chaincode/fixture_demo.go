@@ -0,0 +1,39 @@
+// Code generated by gen_fixture.go from fixtures/demo.json. DO NOT EDIT.
+
+package main
+
+//demoFixture is fixtures/demo.json
+const demoFixture = `{
+  "operators": [
+    {"id": "ABC", "tadig": "USAAB", "mccmnc": ["310-010"], "name": "ABC Wireless", "settlementCurrency": "USD"},
+    {"id": "XYZ", "tadig": "DEUXY", "mccmnc": ["262-01"], "name": "XYZ Mobilfunk", "settlementCurrency": "EUR"}
+  ],
+  "subscribers": [
+    {"publickey": "rs1", "msisdn": "14691234567", "ho": "ABC", "location": "DC", "lat": 32.942746, "long": 38.91},
+    {"publickey": "rs2", "msisdn": "14691234568", "ho": "ABC", "location": "DALLAS", "lat": 32.942746, "long": -96.994838},
+    {"publickey": "rs3", "msisdn": "14691234569", "ho": "ABC", "location": "SF", "lat": 37.776, "long": -122.414},
+    {"publickey": "rs4", "msisdn": "03097218855", "ho": "XYZ", "location": "BERLIN", "lat": 52.5200, "long": 13.4050},
+    {"publickey": "rs5", "msisdn": "349091234567", "ho": "XYZ", "location": "BARCELONA", "lat": 41.3851, "long": 2.1734},
+    {"publickey": "rs6", "msisdn": "349091234568", "ho": "XYZ", "location": "BARCELONA", "lat": 41.385064, "long": 2.173403},
+    {"publickey": "rs7", "msisdn": "349091234569", "ho": "XYZ", "location": "BARCELONA", "lat": 41.385064, "long": 2.173403}
+  ],
+  "agreements": [
+    {"ho": "ABC", "rp": "XYZ", "services": ["voice", "sms", "data"], "ratePlan": "RoamingXYZ"},
+    {"ho": "XYZ", "rp": "ABC", "services": ["voice", "sms", "data"], "ratePlan": "RoamingABC"}
+  ],
+  "rateCards": [
+    {"ho": "ABC", "rp": "ABC", "currency": "USD",
+     "voiceOut": {"price": "5", "increment": "1/1"}, "voiceIn": {"price": "1", "increment": "1/1"},
+     "sms": {"price": "0.50", "increment": "1/1"}, "data": {"price": "2", "increment": "1/1"}},
+    {"ho": "XYZ", "rp": "XYZ", "currency": "EUR",
+     "voiceOut": {"price": "5", "increment": "1/1"}, "voiceIn": {"price": "1", "increment": "1/1"},
+     "sms": {"price": "0.50", "increment": "1/1"}, "data": {"price": "2", "increment": "1/1"}},
+    {"ho": "ABC", "rp": "XYZ", "ratePlan": "RoamingXYZ", "currency": "EUR",
+     "voiceOut": {"price": "5", "increment": "1/1"}, "voiceIn": {"price": "1", "increment": "1/1"},
+     "sms": {"price": "0.50", "increment": "1/1"}, "data": {"price": "2", "increment": "1/1"}},
+    {"ho": "XYZ", "rp": "ABC", "ratePlan": "RoamingABC", "currency": "USD",
+     "voiceOut": {"price": "5", "increment": "1/1"}, "voiceIn": {"price": "1", "increment": "1/1"},
+     "sms": {"price": "0.50", "increment": "1/1"}, "data": {"price": "2", "increment": "1/1"}}
+  ]
+}
+`
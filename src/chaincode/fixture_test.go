@@ -0,0 +1,114 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestDemoFixtureIsGenerated(t *testing.T) {
+	demo, err := ioutil.ReadFile("../../fixtures/demo.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(demo) != demoFixture {
+		t.Fatalf("fixture_demo.go is out of date with fixtures/demo.json, run go generate")
+	}
+	f, err := defaultFixture()
+	if err != nil {
+		t.Fatalf("defaultFixture: %v", err)
+	}
+	if len(f.Operators) != 2 || len(f.Subscribers) != 7 || len(f.Agreements) != 2 || len(f.RateCards) != 4 {
+		t.Errorf("demo fixture of %d operators, %d subscribers, %d agreements and %d rate cards",
+			len(f.Operators), len(f.Subscribers), len(f.Agreements), len(f.RateCards))
+	}
+}
+
+func TestResetKeepsOperatorsAgreementsAndRateCards(t *testing.T) {
+	minimal, err := ioutil.ReadFile("../../fixtures/minimal.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newTestLedger(t, string(minimal))
+	l.asOperator("ABC").mustInvoke("suspendAgreement", "ABC", "XYZ")
+	l.asRole(roleAdmin).mustInvoke("deactivateOperator", "XYZ")
+
+	check := func(when string) {
+		t.Helper()
+		var op Operator
+		if l.mustQuery(&op, "queryOperator", "XYZ"); op.Status != operatorInactive {
+			t.Errorf("XYZ is %s after %s", op.Status, when)
+		}
+		if a, err := getAgreement(l.stub, "ABC", "XYZ"); err != nil || a.Status != agreementSuspended {
+			t.Errorf("agreement of ABC and XYZ is %s after %s (%v)", a.Status, when, err)
+		}
+		cards, err := getRateCards(l.stub, "ABC", "XYZ")
+		if err != nil || len(cards) != 1 || cards[0].VoiceOut.Price.String() != "0.2500" {
+			t.Errorf("rate cards of ABC on XYZ after %s: %+v (%v)", when, cards, err)
+		}
+		if _, err = getSubscriber(l.stub, "rs5"); err == nil {
+			t.Errorf("subscriber of the inactive XYZ loaded by %s", when)
+		}
+	}
+	l.mustInvoke("resetInventory")
+	check("resetInventory")
+	l.mustInvoke("loadFixture", string(minimal))
+	check("loadFixture")
+
+	//What the ledger did not have yet is added
+	if cards, err := getRateCards(l.stub, "ABC", "ABC"); err != nil || len(cards) != 1 {
+		t.Errorf("home rate cards of ABC: %+v (%v)", cards, err)
+	}
+	if rs := l.subscriber("rs2"); rs.HO != "ABC" || rs.State != stateIdle {
+		t.Errorf("demo subscriber rs2 %+v", rs)
+	}
+}
+
+func TestResetKeepsEnteredSubscribersAndOpenSessions(t *testing.T) {
+	l := newTestLedger(t)
+	l.asOperator("ABC").mustInvoke("enterData", l.enterArgs("rs8", "14699990000", "ABC")...)
+	l.mustInvoke("authentication", "rs8")
+
+	//A call in progress keeps the subscriber from being reloaded until it is charged
+	l.roam("rs1", "XYZ")
+	l.mustInvoke("CallOut", "rs1", "4930123456")
+	l.asRole(roleAdmin).mustFail(codeStateConflict, "resetInventory")
+	l.advance(time.Minute)
+	l.asOperator("XYZ").mustInvoke("CallEnd", "rs1")
+	l.asRole(roleAdmin).mustFail(codeStateConflict, "resetInventory")
+	l.asOperator("XYZ").mustInvoke("CallPay", "rs1")
+	l.mustInvoke("DataSessionStart", "rs1")
+	l.asRole(roleAdmin).mustFail(codeStateConflict, "resetInventory")
+	l.asOperator("XYZ").mustInvoke("DataSessionEnd", "rs1", "2048")
+	l.asRole(roleAdmin).mustInvoke("resetInventory")
+
+	var attachment Attachment
+	l.mustQuery(&attachment, "queryAttachment", "14699990000")
+	if attachment.PublicKey != "rs8" || attachment.Network != "ABC" {
+		t.Errorf("attachment of the entered subscriber %+v", attachment)
+	}
+	l.mustQuery(&attachment, "queryAttachment", testMSISDN)
+	if attachment.PublicKey != "rs1" || attachment.Network != "ABC" {
+		t.Errorf("attachment of the fixture subscriber %+v", attachment)
+	}
+	if cdrs := l.cdrs("rs1"); len(cdrs) != 1 || cdrs[0].Status != cdrStatusCharged {
+		t.Errorf("CDRs after the reset %+v", cdrs)
+	}
+}
@@ -0,0 +1,301 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Fraud cases are keyed by subscriber, transaction and rule so that one
+// transaction opens at most one case per rule and a subscriber's cases can
+// be listed with a single range scan.
+var fraudPrefix = "fraud:"
+
+// Fraud rules
+const (
+	ruleSIMClone          = "SIMClone"
+	ruleImpossibleTravel  = "ImpossibleTravel"
+	ruleCallVelocity      = "CallVelocity"
+	ruleExcessiveDuration = "ExcessiveDuration"
+	ruleOutsideCoverage   = "OutsideCoverage"
+)
+
+// Rule thresholds
+const (
+	maxTravelSpeedKmh   = 1000.0
+	callVelocityWindow  = time.Hour
+	callVelocityLimit   = 10
+	maxCallDurationMins = 240.0
+)
+
+// Fraud case status values
+const (
+	fraudOpen        = "open"
+	fraudUnderReview = "under review"
+	fraudConfirmed   = "confirmed"
+	fraudDismissed   = "dismissed"
+)
+
+// Statuses an investigator may move a case to from its current status
+var fraudTransitions = map[string][]string{
+	fraudOpen:        {fraudUnderReview, fraudConfirmed, fraudDismissed},
+	fraudUnderReview: {fraudConfirmed, fraudDismissed},
+}
+
+// FraudCaseNote is one entry in the investigation trail of a case
+type FraudCaseNote struct {
+	Time     time.Time `json:"time"`
+	Operator string    `json:"operator"`
+	Status   string    `json:"status"`
+	Note     string    `json:"note"`
+}
+
+// FraudCase is opened every time a fraud rule fires
+type FraudCase struct {
+	CaseID    string          `json:"caseId"`
+	PublicKey string          `json:"publickey"`
+	MSISDN    string          `json:"msisdn"`
+	HO        string          `json:"ho"`
+	RP        string          `json:"rp"`
+	Rule      string          `json:"rule"`
+	Details   string          `json:"details"`
+	Status    string          `json:"status"`
+	OpenedAt  time.Time       `json:"openedAt"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+	History   []FraudCaseNote `json:"history"`
+}
+
+// fraudHit is a rule that fired, before it is recorded as a case
+type fraudHit struct {
+	Rule    string
+	Details string
+}
+
+//distanceKm is the great circle distance between two lat/long fixes
+func distanceKm(lat1 float64, long1 float64, lat2 float64, long2 float64) float64 {
+	const earthRadiusKm = 6371.0
+	toRad := func(d float64) float64 { return d * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLong := toRad(long2 - long1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return earthRadiusKm * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+//checkSIMClone fires when the MSISDN is already attached under another subscriber key
+func checkSIMClone(stub shim.ChaincodeStubInterface, rs rsDetailBlock) ([]fraudHit, error) {
+	digest, err := subscriberDigest(stub, rs)
+	if err != nil {
+		return nil, err
+	}
+	attachment, err := getAttachment(stub, digest)
+	if err != nil {
+		return nil, err
+	}
+	if attachment == nil || attachment.PublicKey == rs.PublicKey {
+		return nil, nil
+	}
+	return []fraudHit{{ruleSIMClone, "MSISDN " + mask(rs.MSISDN) + " is already attached as " + attachment.PublicKey + " on " + attachment.Network}}, nil
+}
+
+//checkImpossibleTravel fires when the subscriber would have to move faster than
+//maxTravelSpeedKmh between its previous fix and the new one
+func checkImpossibleTravel(rs rsDetailBlock, p GeoPoint, at time.Time) []fraudHit {
+	if rs.FixTime.IsZero() {
+		return nil
+	}
+	km := distanceKm(float64(rs.Lat), float64(rs.Long), float64(p.Lat), float64(p.Long))
+	hours := at.Sub(rs.FixTime).Hours()
+	if km == 0 || (hours > 0 && km/hours <= maxTravelSpeedKmh) {
+		return nil
+	}
+	return []fraudHit{{ruleImpossibleTravel, fmt.Sprintf("Moved %.0f km from %s in %.1f minutes", km, rs.Location, hours*60)}}
+}
+
+//checkCallVelocity fires when the subscriber starts more than callVelocityLimit calls within callVelocityWindow
+func checkCallVelocity(stub shim.ChaincodeStubInterface, rs rsDetailBlock, at time.Time) ([]fraudHit, error) {
+	cdrs, err := getCDRs(stub, rs.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	calls := 1
+	for _, cdr := range cdrs {
+		if at.Sub(cdr.StartTime) < callVelocityWindow {
+			calls++
+		}
+	}
+	if calls <= callVelocityLimit {
+		return nil, nil
+	}
+	return []fraudHit{{ruleCallVelocity, fmt.Sprintf("%d calls within %v", calls, callVelocityWindow)}}, nil
+}
+
+//checkCallDuration fires on calls longer than maxCallDurationMins
+func checkCallDuration(rs rsDetailBlock) []fraudHit {
+	if rs.Duration <= maxCallDurationMins {
+		return nil
+	}
+	return []fraudHit{{ruleExcessiveDuration, fmt.Sprintf("Call %s lasted %.1f minutes", rs.CurrentCDR, rs.Duration)}}
+}
+
+func fraudKey(caseID string) string {
+	return fraudPrefix + caseID
+}
+
+func getFraudCase(stub shim.ChaincodeStubInterface, caseID string) (FraudCase, error) {
+	var fc FraudCase
+	bytes, err := stub.GetState(fraudKey(caseID))
+	if err != nil {
+		fmt.Println("Error - Could not get fraud case : " + caseID)
+		return fc, internalError("Error retrieving fraud case " + caseID)
+	}
+	if bytes == nil {
+		return fc, notFoundError("Fraud case not found " + caseID)
+	}
+	err = json.Unmarshal(bytes, &fc)
+	if err != nil {
+		fmt.Println("Error unmarshalling fraud case " + caseID)
+		return fc, internalError("Error unmarshalling fraud case " + caseID)
+	}
+	return fc, nil
+}
+
+func putFraudCase(stub shim.ChaincodeStubInterface, fc FraudCase) error {
+	bytes, err := json.Marshal(fc)
+	if err != nil {
+		return internalError("Error marshalling fraud case " + fc.CaseID)
+	}
+	err = stub.PutState(fraudKey(fc.CaseID), bytes)
+	if err != nil {
+		fmt.Println("Error - could not write fraud case " + fc.CaseID)
+		return internalError("Error writing fraud case " + fc.CaseID)
+	}
+	return nil
+}
+
+//openFraudCases records a case for every hit, flags the subscriber and
+//returns the fraud events to emit
+func openFraudCases(stub shim.ChaincodeStubInterface, rs *rsDetailBlock, hits []fraudHit, at time.Time) ([]RoamingEvent, error) {
+	var events []RoamingEvent
+	for _, hit := range hits {
+		fmt.Println("Fraud rule fired:", hit.Rule, hit.Details)
+		var fc FraudCase
+		fc.CaseID = rs.PublicKey + ":" + stub.GetTxID() + ":" + hit.Rule
+		fc.PublicKey = rs.PublicKey
+		fc.MSISDN = mask(rs.MSISDN)
+		fc.HO = rs.HO
+		fc.RP = rs.RP
+		fc.Rule = hit.Rule
+		fc.Details = hit.Details
+		fc.Status = fraudOpen
+		fc.OpenedAt = at
+		fc.UpdatedAt = at
+		fc.History = []FraudCaseNote{{Time: at, Status: fraudOpen, Note: hit.Details}}
+		if err := putFraudCase(stub, fc); err != nil {
+			return nil, err
+		}
+		rs.addFlag(flagFraud)
+		events = append(events, newEvent(stub, eventFraudFlagged, *rs, at, FraudEvent{CaseID: fc.CaseID, Rule: fc.Rule, Details: fc.Details}))
+	}
+	return events, nil
+}
+
+//Investigators of the home operator or the roaming partner move a case along
+//	args: caseId, status, operator, note
+func (t *SimpleChaincode) updateFraudCase(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Updating fraud case")
+	if err := checkArgs("updateFraudCase", args, 4, "caseId, status, operator and note"); err != nil {
+		return nil, err
+	}
+	caseID, status, operator, note := args[0], args[1], args[2], args[3]
+	fc, err := getFraudCase(stub, caseID)
+	if err != nil {
+		return nil, err
+	}
+	if operator == "" || (operator != fc.HO && operator != fc.RP) {
+		return nil, authError("Only investigators of " + fc.HO + " or " + fc.RP + " can update fraud case " + caseID)
+	}
+	if err = requireOperator(stub, "update fraud case "+caseID+" as "+operator, operator); err != nil {
+		return nil, err
+	}
+	allowed := false
+	for _, next := range fraudTransitions[fc.Status] {
+		if next == status {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return nil, conflictError("Fraud case " + caseID + " can not move from " + fc.Status + " to " + status)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	fc.Status = status
+	fc.UpdatedAt = now
+	fc.History = append(fc.History, FraudCaseNote{Time: now, Operator: operator, Status: status, Note: note})
+	return nil, putFraudCase(stub, fc)
+}
+
+func (t *SimpleChaincode) queryFraudCase(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("queryFraudCase called")
+	if err := checkArgs("queryFraudCase", args, 1, "caseId"); err != nil {
+		return nil, err
+	}
+	fc, err := getFraudCase(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = requireOperatorOrRole(stub, "read fraud case "+fc.CaseID, []string{fc.HO, fc.RP}, roleAuditor, roleAdmin); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fraudCaseView(stub, fc))
+}
+
+//Query all fraud cases of a subscriber
+func (t *SimpleChaincode) queryFraudCases(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("queryFraudCases called")
+	if err := checkArgs("queryFraudCases", args, 1, "subscriber key"); err != nil {
+		return nil, err
+	}
+	rs, err := getSubscriber(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = requireOperatorOrRole(stub, "read the fraud cases of "+rs.PublicKey, []string{rs.HO, rs.RP}, roleAuditor, roleAdmin); err != nil {
+		return nil, err
+	}
+	cases := []FraudCase{}
+	err = rangeByPrefix(stub, fraudPrefix+args[0]+":", func(key string, value []byte) error {
+		var fc FraudCase
+		if err := json.Unmarshal(value, &fc); err != nil {
+			return internalError("Error unmarshalling fraud case " + strings.TrimPrefix(key, fraudPrefix))
+		}
+		cases = append(cases, fraudCaseView(stub, fc))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(cases)
+}
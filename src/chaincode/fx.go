@@ -0,0 +1,237 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Every operator publishes its own exchange rates as dated snapshots and
+// settles in its own currency with them. A snapshot applies from its
+// effective time until the next one, it is never changed once published so
+// statements can always be traced back to the rates they used.
+//
+// Snapshots are keyed "fxrate:<operator>:<effective RFC3339>", the keys of an
+// operator sort by effective time.
+var fxPrefix = "fxrate:"
+
+// FxRate is the value of one unit of Currency in the base currency of the snapshot
+type FxRate struct {
+	Currency string `json:"currency"`
+	Rate     Rate   `json:"rate"`
+}
+
+// RateSnapshot is a set of exchange rates an operator published
+type RateSnapshot struct {
+	SnapshotID    string    `json:"snapshotId"`
+	Operator      string    `json:"operator"`
+	Base          string    `json:"base"`
+	EffectiveFrom time.Time `json:"effectiveFrom"`
+	Rates         []FxRate  `json:"rates"`
+	PublishedAt   time.Time `json:"publishedAt"`
+}
+
+func fxKey(operator string, effective time.Time) string {
+	return fxPrefix + operator + ":" + effective.UTC().Format(time.RFC3339)
+}
+
+func (snap RateSnapshot) validate() error {
+	if snap.Operator == "" {
+		return validationError("Rate snapshot needs an operator")
+	}
+	if snap.EffectiveFrom.IsZero() {
+		return validationError("Rate snapshot needs an effective time")
+	}
+	if !validCurrency(snap.Base) {
+		return validationError("Rate snapshot needs an ISO 4217 base currency")
+	}
+	if len(snap.Rates) == 0 {
+		return validationError("Rate snapshot needs at least one rate")
+	}
+	for i, r := range snap.Rates {
+		if !validCurrency(r.Currency) {
+			return validationError(r.Currency + " is not an ISO 4217 currency code")
+		}
+		if r.Currency == snap.Base {
+			return validationError("Rate snapshot can not rate its base currency " + snap.Base)
+		}
+		if r.Rate <= 0 {
+			return validationError("Rate of " + r.Currency + " must be positive")
+		}
+		for _, other := range snap.Rates[:i] {
+			if other.Currency == r.Currency {
+				return validationError(r.Currency + " is rated twice")
+			}
+		}
+	}
+	return nil
+}
+
+//rate returns the value of one unit of currency in the base currency
+func (snap RateSnapshot) rate(currency string) (Rate, bool) {
+	if currency == snap.Base {
+		return rateScale, true
+	}
+	for _, r := range snap.Rates {
+		if r.Currency == currency {
+			return r.Rate, true
+		}
+	}
+	return 0, false
+}
+
+//convert changes amount from one currency into another through the base
+//currency and returns the rate applied
+func (snap RateSnapshot) convert(amount Money, from string, to string) (Money, Rate, error) {
+	if from == to {
+		return amount, rateScale, nil
+	}
+	rf, ok := snap.rate(from)
+	if !ok {
+		return 0, 0, conflictError("Rate snapshot " + snap.SnapshotID + " has no rate for " + from)
+	}
+	rt, ok := snap.rate(to)
+	if !ok {
+		return 0, 0, conflictError("Rate snapshot " + snap.SnapshotID + " has no rate for " + to)
+	}
+	converted, err := amount.mulDiv(int64(rf), int64(rt))
+	if err != nil {
+		return 0, 0, err
+	}
+	rate, err := Money(rateScale).mulDiv(int64(rf), int64(rt))
+	if err != nil {
+		return 0, 0, err
+	}
+	return converted, Rate(rate), nil
+}
+
+//getRateSnapshots returns the snapshots of an operator, oldest first
+func getRateSnapshots(stub shim.ChaincodeStubInterface, operator string) ([]RateSnapshot, error) {
+	snaps := []RateSnapshot{}
+	err := rangeByPrefix(stub, fxPrefix+operator+":", func(key string, value []byte) error {
+		var snap RateSnapshot
+		if err := json.Unmarshal(value, &snap); err != nil {
+			return internalError("Error unmarshalling rate snapshot " + key)
+		}
+		snaps = append(snaps, snap)
+		return nil
+	})
+	return snaps, err
+}
+
+//rateSnapshotAt returns the snapshot of an operator effective at a time
+func rateSnapshotAt(stub shim.ChaincodeStubInterface, operator string, at time.Time) (RateSnapshot, error) {
+	var effective RateSnapshot
+	snaps, err := getRateSnapshots(stub, operator)
+	if err != nil {
+		return effective, err
+	}
+	found := false
+	for _, snap := range snaps {
+		if snap.EffectiveFrom.After(at) {
+			break
+		}
+		effective, found = snap, true
+	}
+	if !found {
+		return effective, notFoundError("No exchange rates of " + operator + " effective at " + at.UTC().Format(time.RFC3339))
+	}
+	return effective, nil
+}
+
+/*		0
+	json
+	{
+		"operator": "ABC",
+		"base": "USD",
+		"effectiveFrom": "2017-01-01T00:00:00Z",
+		"rates": [{"currency": "EUR", "rate": "1.0525"}, {"currency": "GBP", "rate": "1.2340"}]
+	}
+*/
+func (t *SimpleChaincode) publishRates(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Publishing exchange rates")
+	if err := checkArgs("publishRates", args, 1, "rate snapshot"); err != nil {
+		return nil, err
+	}
+	var snap RateSnapshot
+	if err := json.Unmarshal([]byte(args[0]), &snap); err != nil {
+		return nil, validationError("Invalid rate snapshot: " + err.Error())
+	}
+	if err := snap.validate(); err != nil {
+		return nil, err
+	}
+	if err := requireOperatorOrRole(stub, "publish the exchange rates of "+snap.Operator, []string{snap.Operator}, roleAdmin); err != nil {
+		return nil, err
+	}
+	if _, err := activeOperator(stub, snap.Operator); err != nil {
+		return nil, err
+	}
+	snap.EffectiveFrom = snap.EffectiveFrom.UTC()
+	snap.SnapshotID = fxKey(snap.Operator, snap.EffectiveFrom)
+	existing, err := stub.GetState(snap.SnapshotID)
+	if err != nil {
+		return nil, internalError("Error retrieving rate snapshot " + snap.SnapshotID)
+	}
+	if existing != nil {
+		return nil, conflictError("Exchange rates " + snap.SnapshotID + " are already published")
+	}
+	if snap.PublishedAt, err = txTime(stub); err != nil {
+		return nil, err
+	}
+	bytes, err := json.Marshal(snap)
+	if err != nil {
+		return nil, internalError("Error marshalling rate snapshot " + snap.SnapshotID)
+	}
+	if err = stub.PutState(snap.SnapshotID, bytes); err != nil {
+		return nil, internalError("Error writing rate snapshot " + snap.SnapshotID)
+	}
+	fmt.Println("Success, wrote rate snapshot " + snap.SnapshotID)
+	return nil, nil
+}
+
+//Query the exchange rates of an operator, all snapshots or the one effective at a time
+//	args: operator [, time (RFC3339)]
+func (t *SimpleChaincode) queryRates(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("queryRates called")
+	if len(args) != 1 && len(args) != 2 {
+		return nil, checkArgs("queryRates", args, 1, "operator and optionally a time")
+	}
+	if err := requireRole(stub, "read exchange rates", roleOperator, roleAuditor, roleAdmin); err != nil {
+		return nil, err
+	}
+	if len(args) == 1 {
+		snaps, err := getRateSnapshots(stub, args[0])
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(snaps)
+	}
+	at, err := time.Parse(time.RFC3339, args[1])
+	if err != nil {
+		return nil, validationError("Invalid time " + args[1])
+	}
+	snap, err := rateSnapshotAt(stub, args[0], at)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(snap)
+}
@@ -0,0 +1,55 @@
+//go:build ignore
+// +build ignore
+
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+// gen_fixture writes fixture_demo.go, which holds fixtures/demo.json for
+// defaultFixture. Run it with go generate after changing the demo fixture.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	source = "../../fixtures/demo.json"
+	target = "fixture_demo.go"
+)
+
+func main() {
+	bytes, err := ioutil.ReadFile(source)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if strings.Contains(string(bytes), "`") {
+		fmt.Fprintln(os.Stderr, source+" contains a backquote, it can not be embedded as a raw string")
+		os.Exit(1)
+	}
+	out := "// Code generated by gen_fixture.go from fixtures/demo.json. DO NOT EDIT.\n\n" +
+		"package main\n\n" +
+		"//demoFixture is fixtures/demo.json\n" +
+		"const demoFixture = `" + string(bytes) + "`\n"
+	if err = ioutil.WriteFile(target, []byte(out), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
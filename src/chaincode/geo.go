@@ -0,0 +1,310 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Operators register the areas their network covers, either as a polygon
+// or as a country with its bounding box. A fix discoverRP reports for a
+// network that has registered coverage must fall into one of its areas,
+// otherwise a fraud case is opened against the discovery. Networks without
+// any registered coverage are not checked.
+//
+// Areas are keyed "coverage:<operator>:<areaId>".
+var coveragePrefix = "coverage:"
+
+var (
+	areaIDPattern  = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+)
+
+// Degrees is a latitude or longitude. Records written before positions were
+// parsed hold them as strings, Degrees reads both and writes a number.
+type Degrees float64
+
+// UnmarshalJSON reads a number or a numeric string
+func (d *Degrees) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), "\"")
+	if s == "" || s == "null" {
+		*d = 0
+		return nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*d = Degrees(v)
+	return nil
+}
+
+// GeoPoint is a position on the WGS 84 ellipsoid
+type GeoPoint struct {
+	Lat  Degrees `json:"lat"`
+	Long Degrees `json:"long"`
+}
+
+func (p GeoPoint) validate() error {
+	if math.IsNaN(float64(p.Lat)) || p.Lat < -90 || p.Lat > 90 {
+		return validationError(fmt.Sprintf("Latitude %v is not between -90 and 90", float64(p.Lat)))
+	}
+	if math.IsNaN(float64(p.Long)) || p.Long < -180 || p.Long > 180 {
+		return validationError(fmt.Sprintf("Longitude %v is not between -180 and 180", float64(p.Long)))
+	}
+	return nil
+}
+
+func (p GeoPoint) String() string {
+	return strconv.FormatFloat(float64(p.Lat), 'f', -1, 64) + "," + strconv.FormatFloat(float64(p.Long), 'f', -1, 64)
+}
+
+//parsePosition reads the lat and long arguments of a transaction
+func parsePosition(lat string, long string) (GeoPoint, error) {
+	var p GeoPoint
+	v, err := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	if err != nil {
+		return p, validationError("Latitude " + lat + " is not a number")
+	}
+	p.Lat = Degrees(v)
+	v, err = strconv.ParseFloat(strings.TrimSpace(long), 64)
+	if err != nil {
+		return p, validationError("Longitude " + long + " is not a number")
+	}
+	p.Long = Degrees(v)
+	return p, p.validate()
+}
+
+// BoundingBox spans MinLong to MaxLong eastwards, a box with MinLong greater
+// than MaxLong crosses the antimeridian
+type BoundingBox struct {
+	MinLat  Degrees `json:"minLat"`
+	MinLong Degrees `json:"minLong"`
+	MaxLat  Degrees `json:"maxLat"`
+	MaxLong Degrees `json:"maxLong"`
+}
+
+func (b BoundingBox) contains(p GeoPoint) bool {
+	if p.Lat < b.MinLat || p.Lat > b.MaxLat {
+		return false
+	}
+	if b.MinLong <= b.MaxLong {
+		return p.Long >= b.MinLong && p.Long <= b.MaxLong
+	}
+	return p.Long >= b.MinLong || p.Long <= b.MaxLong
+}
+
+// CoverageArea is an area an operator's network serves
+type CoverageArea struct {
+	AreaID       string       `json:"areaId"`
+	Operator     string       `json:"operator"`
+	Country      string       `json:"country,omitempty"`
+	Box          *BoundingBox `json:"box,omitempty"`
+	Polygon      []GeoPoint   `json:"polygon,omitempty"`
+	RegisteredAt time.Time    `json:"registeredAt"`
+}
+
+func coverageKey(operator string, areaID string) string {
+	return coveragePrefix + operator + ":" + areaID
+}
+
+func (area CoverageArea) validate() error {
+	if area.Operator == "" {
+		return validationError("Coverage area needs an operator")
+	}
+	if !areaIDPattern.MatchString(area.AreaID) {
+		return validationError("Coverage area needs an areaId of letters, digits, '-' and '_'")
+	}
+	if area.Country != "" && !countryPattern.MatchString(area.Country) {
+		return validationError(area.Country + " is not an ISO 3166 alpha-2 country code")
+	}
+	if (area.Box == nil) == (len(area.Polygon) == 0) {
+		return validationError("Coverage area needs either a box or a polygon")
+	}
+	if area.Box != nil {
+		if area.Country == "" {
+			return validationError("Bounding box of area " + area.AreaID + " needs a country")
+		}
+		for _, corner := range []GeoPoint{{area.Box.MinLat, area.Box.MinLong}, {area.Box.MaxLat, area.Box.MaxLong}} {
+			if err := corner.validate(); err != nil {
+				return err
+			}
+		}
+		if area.Box.MinLat > area.Box.MaxLat {
+			return validationError("Bounding box of area " + area.AreaID + " has minLat above maxLat")
+		}
+		return nil
+	}
+	if len(area.Polygon) < 3 {
+		return validationError("Polygon of area " + area.AreaID + " needs at least 3 points")
+	}
+	for _, p := range area.Polygon {
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//contains reports whether the area covers p. Polygons are tested in the
+//lat/long plane, an edge runs straight between its points and polygons
+//across the antimeridian have to be split.
+func (area CoverageArea) contains(p GeoPoint) bool {
+	if area.Box != nil {
+		return area.Box.contains(p)
+	}
+	inside := false
+	for i, j := 0, len(area.Polygon)-1; i < len(area.Polygon); j, i = i, i+1 {
+		a, b := area.Polygon[i], area.Polygon[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) &&
+			p.Long < (b.Long-a.Long)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Long {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+//getCoverage returns the coverage areas of an operator in areaId order
+func getCoverage(stub shim.ChaincodeStubInterface, operator string) ([]CoverageArea, error) {
+	areas := []CoverageArea{}
+	err := rangeByPrefix(stub, coveragePrefix+operator+":", func(key string, value []byte) error {
+		var area CoverageArea
+		if err := json.Unmarshal(value, &area); err != nil {
+			return internalError("Error unmarshalling coverage area " + key)
+		}
+		areas = append(areas, area)
+		return nil
+	})
+	return areas, err
+}
+
+//checkCoverage fires when the network has registered coverage and the fix is outside all of it
+func checkCoverage(stub shim.ChaincodeStubInterface, network string, p GeoPoint) ([]fraudHit, error) {
+	areas, err := getCoverage(stub, network)
+	if err != nil || len(areas) == 0 {
+		return nil, err
+	}
+	for _, area := range areas {
+		if area.contains(p) {
+			return nil, nil
+		}
+	}
+	//The case only records the coarse fix, like the subscriber record
+	coarse := GeoPoint{coarsePosition(p.Lat), coarsePosition(p.Long)}
+	return []fraudHit{{ruleOutsideCoverage, "Fix " + coarse.String() + " is outside the coverage of " + network}}, nil
+}
+
+/*		0
+	json
+	{
+		"areaId": "DE",
+		"operator": "XYZ",
+		"country": "DE",
+		"box": {"minLat": 47.27, "minLong": 5.87, "maxLat": 55.06, "maxLong": 15.04}
+	}
+	or
+	{
+		"areaId": "dallas",
+		"operator": "ABC",
+		"country": "US",
+		"polygon": [{"lat": 33.02, "long": -97.00}, {"lat": 33.02, "long": -96.55}, {"lat": 32.62, "long": -96.55}, {"lat": 32.62, "long": -97.00}]
+	}
+*/
+func (t *SimpleChaincode) registerCoverage(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Registering coverage area")
+	if err := checkArgs("registerCoverage", args, 1, "coverage area"); err != nil {
+		return nil, err
+	}
+	var area CoverageArea
+	if err := json.Unmarshal([]byte(args[0]), &area); err != nil {
+		return nil, validationError("Invalid coverage area: " + err.Error())
+	}
+	if err := area.validate(); err != nil {
+		return nil, err
+	}
+	if err := requireOperatorOrRole(stub, "register the coverage of "+area.Operator, []string{area.Operator}, roleAdmin); err != nil {
+		return nil, err
+	}
+	if _, err := activeOperator(stub, area.Operator); err != nil {
+		return nil, err
+	}
+	var err error
+	if area.RegisteredAt, err = txTime(stub); err != nil {
+		return nil, err
+	}
+	key := coverageKey(area.Operator, area.AreaID)
+	bytes, err := json.Marshal(area)
+	if err != nil {
+		return nil, internalError("Error marshalling coverage area " + key)
+	}
+	//An area registered again replaces the previous one, networks grow
+	if err = stub.PutState(key, bytes); err != nil {
+		return nil, internalError("Error writing coverage area " + key)
+	}
+	fmt.Println("Success, wrote coverage area " + key)
+	return nil, nil
+}
+
+//Remove a coverage area of an operator
+//	args: operator, areaId
+func (t *SimpleChaincode) removeCoverage(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("removeCoverage called")
+	if err := checkArgs("removeCoverage", args, 2, "operator and areaId"); err != nil {
+		return nil, err
+	}
+	if err := requireOperatorOrRole(stub, "remove the coverage of "+args[0], []string{args[0]}, roleAdmin); err != nil {
+		return nil, err
+	}
+	key := coverageKey(args[0], args[1])
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return nil, internalError("Error retrieving coverage area " + key)
+	}
+	if existing == nil {
+		return nil, notFoundError("Coverage area not found " + key)
+	}
+	if err = stub.DelState(key); err != nil {
+		return nil, internalError("Error deleting coverage area " + key)
+	}
+	return nil, nil
+}
+
+//Query the coverage areas of an operator
+//	args: operator
+func (t *SimpleChaincode) queryCoverage(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("queryCoverage called")
+	if err := checkArgs("queryCoverage", args, 1, "operator"); err != nil {
+		return nil, err
+	}
+	if err := requireRole(stub, "read coverage areas", roleOperator, roleAuditor, roleAdmin); err != nil {
+		return nil, err
+	}
+	areas, err := getCoverage(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(areas)
+}
@@ -0,0 +1,114 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// fraudCases reads the fraud cases of a subscriber as its home operator
+func (l *testLedger) fraudCases(publicKey string) []FraudCase {
+	l.t.Helper()
+	var cases []FraudCase
+	l.asOperator("ABC").mustQuery(&cases, "queryFraudCases", publicKey)
+	return cases
+}
+
+// lastFix is the latest fix of the location history of a subscriber
+func (l *testLedger) lastFix(publicKey string) LocationFix {
+	l.t.Helper()
+	_, fixes, err := getLocations(l.stub, publicKey)
+	if err != nil || len(fixes) == 0 {
+		l.t.Fatalf("locations of %s: %d fixes, %v", publicKey, len(fixes), err)
+	}
+	return fixes[len(fixes)-1]
+}
+
+func TestCoverageAreaContains(t *testing.T) {
+	dallas := CoverageArea{AreaID: "dallas", Operator: "ABC", Country: "US", Polygon: []GeoPoint{
+		{33.02, -97.00}, {33.02, -96.55}, {32.62, -96.55}, {32.62, -97.00}}}
+	pacific := CoverageArea{AreaID: "FJ", Operator: "ABC", Country: "FJ",
+		Box: &BoundingBox{MinLat: -21, MinLong: 177, MaxLat: -12, MaxLong: -178}}
+	cases := []struct {
+		area CoverageArea
+		p    GeoPoint
+		want bool
+	}{
+		{dallas, GeoPoint{32.94, -96.99}, true},
+		{dallas, GeoPoint{32.94, -97.01}, false},
+		{dallas, GeoPoint{33.10, -96.80}, false},
+		{pacific, GeoPoint{-18, 178.4}, true},
+		{pacific, GeoPoint{-18, -179.5}, true},
+		{pacific, GeoPoint{-18, 170}, false},
+	}
+	for _, c := range cases {
+		if got := c.area.contains(c.p); got != c.want {
+			t.Errorf("%s contains %s = %v, want %v", c.area.AreaID, c.p, got, c.want)
+		}
+	}
+}
+
+func TestFixOutsideCoverageOpensFraudCase(t *testing.T) {
+	l := newTestLedger(t)
+	l.asOperator("XYZ").mustInvoke("registerCoverage", `{"areaId": "DE", "operator": "XYZ", "country": "DE",
+		"box": {"minLat": 47.27, "minLong": 5.87, "maxLat": 55.06, "maxLong": 15.04}}`)
+	l.mustInvoke("discoverRP", "rs1", "XYZ", "BERLIN", "52.52", "13.40")
+	if cases := l.fraudCases("rs1"); len(cases) != 0 || len(l.lastFix("rs1").Flags) != 0 {
+		t.Fatalf("fix inside the coverage opened %+v", cases)
+	}
+
+	//A day later, slow enough to get there
+	l.advance(24 * time.Hour)
+	l.asOperator("XYZ").mustInvoke("discoverRP", "rs1", "XYZ", "DALLAS", "32.94", "-96.99")
+	cases := l.fraudCases("rs1")
+	if len(cases) != 1 || cases[0].Rule != ruleOutsideCoverage || cases[0].RP != "XYZ" {
+		t.Fatalf("fraud cases %+v, want one %s case", cases, ruleOutsideCoverage)
+	}
+	if rs := l.subscriber("rs1"); !rs.hasFlag(flagFraud) || rs.RP != "XYZ" {
+		t.Errorf("subscriber on %s with flags %v", rs.RP, rs.Flags)
+	}
+	if fix := l.lastFix("rs1"); len(fix.Flags) != 1 || fix.Flags[0] != ruleOutsideCoverage {
+		t.Errorf("fix flagged %v, want %s", fix.Flags, ruleOutsideCoverage)
+	}
+}
+
+func TestImpossibleTravelIsFlagged(t *testing.T) {
+	l := newTestLedger(t)
+	l.asOperator("XYZ").mustInvoke("discoverRP", "rs1", "XYZ", "BERLIN", "52.52", "13.40")
+	//About 880 km to Paris, in half an hour
+	l.advance(30 * time.Minute)
+	l.mustInvoke("discoverRP", "rs1", "XYZ", "PARIS", "48.86", "2.35")
+	cases := l.fraudCases("rs1")
+	if len(cases) != 1 || cases[0].Rule != ruleImpossibleTravel {
+		t.Fatalf("fraud cases %+v, want one %s case", cases, ruleImpossibleTravel)
+	}
+	if fix := l.lastFix("rs1"); len(fix.Flags) != 1 || fix.Flags[0] != ruleImpossibleTravel {
+		t.Errorf("fix flagged %v, want %s", fix.Flags, ruleImpossibleTravel)
+	}
+
+	//And back in two hours, which a plane makes
+	l.advance(2 * time.Hour)
+	l.asOperator("XYZ").mustInvoke("discoverRP", "rs1", "XYZ", "BERLIN", "52.52", "13.40")
+	if cases = l.fraudCases("rs1"); len(cases) != 1 {
+		t.Errorf("travel within %v km/h opened %+v", maxTravelSpeedKmh, cases[1:])
+	}
+	if fix := l.lastFix("rs1"); len(fix.Flags) != 0 {
+		t.Errorf("fix flagged %v", fix.Flags)
+	}
+}
@@ -0,0 +1,286 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// List queries scan the subscriber records in key order and return them a
+// page at a time. Every list query takes two optional trailing arguments,
+// the cursor returned by the previous page and the page size. An empty
+// cursor in the result means there are no more records.
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// StateRecord is one entry of a state dump, the JSON stored under key as the caller may see it
+type StateRecord struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// SubscriberPage is one page of a list query
+type SubscriberPage struct {
+	Subscribers []rsDetailBlock `json:"subscribers"`
+	Cursor      string          `json:"cursor"`
+}
+
+//pageArgs splits the optional cursor and page size off the fixed arguments of a list query
+func pageArgs(function string, args []string, fixed int, names string) (string, int, error) {
+	if len(args) < fixed || len(args) > fixed+2 {
+		return "", 0, checkArgs(function, args, fixed, names+", then optionally cursor and page size")
+	}
+	cursor := ""
+	if len(args) > fixed {
+		cursor = args[fixed]
+	}
+	if cursor != "" && !strings.HasPrefix(cursor, subscriberPrefix) {
+		return "", 0, validationError("Invalid cursor " + cursor)
+	}
+	size := defaultPageSize
+	if len(args) > fixed+1 && args[fixed+1] != "" {
+		n, err := strconv.Atoi(args[fixed+1])
+		if err != nil || n <= 0 || n > maxPageSize {
+			return "", 0, validationError("Page size must be between 1 and " + strconv.Itoa(maxPageSize))
+		}
+		size = n
+	}
+	return cursor, size, nil
+}
+
+//pageSubscribers returns up to size subscribers after cursor that match
+func pageSubscribers(stub shim.ChaincodeStubInterface, cursor string, size int, match func(rs rsDetailBlock) bool) (SubscriberPage, error) {
+	page := SubscriberPage{Subscribers: []rsDetailBlock{}}
+	start := subscriberPrefix
+	if cursor != "" {
+		start = cursor + "\x00"
+	}
+	iter, err := stub.RangeQueryState(start, subscriberPrefix+"~")
+	if err != nil {
+		return page, internalError("Error scanning range " + subscriberPrefix)
+	}
+	defer iter.Close()
+
+	last := ""
+	for iter.HasNext() {
+		key, value, err := iter.Next()
+		if err != nil {
+			return page, internalError("Error scanning range " + subscriberPrefix)
+		}
+		if !strings.HasPrefix(key, subscriberPrefix) || key <= cursor {
+			continue
+		}
+		var rs rsDetailBlock
+		if err = json.Unmarshal(value, &rs); err != nil {
+			return page, internalError("Error unmarshalling subscriber " + key)
+		}
+		if !match(rs) {
+			continue
+		}
+		//Only hand out a cursor when there really is another match
+		if len(page.Subscribers) == size {
+			page.Cursor = last
+			break
+		}
+		page.Subscribers = append(page.Subscribers, subscriberView(stub, rs))
+		last = key
+	}
+	return page, nil
+}
+
+func listPage(stub shim.ChaincodeStubInterface, cursor string, size int, match func(rs rsDetailBlock) bool) ([]byte, error) {
+	page, err := pageSubscribers(stub, cursor, size, match)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(page)
+}
+
+//List all subscribers
+//	args: [cursor [, pageSize]]
+func (t *SimpleChaincode) listSubscribers(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("listSubscribers called")
+	cursor, size, err := pageArgs("listSubscribers", args, 0, "nothing")
+	if err != nil {
+		return nil, err
+	}
+	if err = requireRole(stub, "list all subscribers", roleAuditor, roleAdmin); err != nil {
+		return nil, err
+	}
+	return listPage(stub, cursor, size, func(rs rsDetailBlock) bool { return true })
+}
+
+//List the roamers currently on a roaming partner
+//	args: rp [, cursor [, pageSize]]
+func (t *SimpleChaincode) listRoamers(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("listRoamers called")
+	cursor, size, err := pageArgs("listRoamers", args, 1, "rp")
+	if err != nil {
+		return nil, err
+	}
+	rp := args[0]
+	if err = requireOperatorOrRole(stub, "list the roamers on "+rp, []string{rp}, roleAuditor, roleAdmin); err != nil {
+		return nil, err
+	}
+	return listPage(stub, cursor, size, func(rs rsDetailBlock) bool {
+		return rs.RP == rp && rs.Roaming == "True"
+	})
+}
+
+//List the subscribers flagged "Fraud" or "OVERAGE"
+//	args: flag [, cursor [, pageSize]]
+func (t *SimpleChaincode) listFlagged(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("listFlagged called")
+	cursor, size, err := pageArgs("listFlagged", args, 1, "flag")
+	if err != nil {
+		return nil, err
+	}
+	flag := args[0]
+	if flag != flagFraud && flag != flagOverage {
+		return nil, validationError("Unknown flag " + flag + ", expecting " + flagFraud + " or " + flagOverage)
+	}
+	if err = requireRole(stub, "list flagged subscribers", roleAuditor, roleAdmin); err != nil {
+		return nil, err
+	}
+	return listPage(stub, cursor, size, func(rs rsDetailBlock) bool { return rs.hasFlag(flag) })
+}
+
+//List the subscribers last updated at or after from and before to
+//	args: from, to (RFC3339) [, cursor [, pageSize]]
+func (t *SimpleChaincode) listUpdated(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("listUpdated called")
+	cursor, size, err := pageArgs("listUpdated", args, 2, "from and to")
+	if err != nil {
+		return nil, err
+	}
+	from, err := time.Parse(time.RFC3339, args[0])
+	if err != nil {
+		return nil, validationError("Invalid time " + args[0])
+	}
+	to, err := time.Parse(time.RFC3339, args[1])
+	if err != nil {
+		return nil, validationError("Invalid time " + args[1])
+	}
+	if !to.After(from) {
+		return nil, validationError("Time window must end after it starts")
+	}
+	if err = requireRole(stub, "list updated subscribers", roleAuditor, roleAdmin); err != nil {
+		return nil, err
+	}
+	return listPage(stub, cursor, size, func(rs rsDetailBlock) bool {
+		return !rs.Time.Before(from) && rs.Time.Before(to)
+	})
+}
+
+// dumpState refuses prefixes that reach these records, the identifiers in
+// their keys and the positions and key they hold can not be masked
+var dumpRefused = []string{"subidx:", attachPrefix, locationPrefix, configPrefix}
+
+//dumpView is a dumped record as the caller may see it: subscribers, CDRs,
+//usage records and fraud cases get the views queries return, everything
+//else is dumped as stored
+func dumpView(stub shim.ChaincodeStubInterface, key string, value []byte) (json.RawMessage, error) {
+	var view interface{}
+	switch {
+	case strings.HasPrefix(key, subscriberPrefix):
+		var rs rsDetailBlock
+		if err := json.Unmarshal(value, &rs); err != nil {
+			return nil, internalError("Error unmarshalling subscriber " + key)
+		}
+		view = subscriberView(stub, rs)
+	case strings.HasPrefix(key, cdrPrefix):
+		var cdr callDetailRecord
+		if err := json.Unmarshal(value, &cdr); err != nil {
+			return nil, internalError("Error unmarshalling CDR " + key)
+		}
+		view = cdrViews(stub, cdr.HO, []callDetailRecord{cdr})[0]
+	case strings.HasPrefix(key, dataPrefix):
+		var rec DataSessionRecord
+		if err := json.Unmarshal(value, &rec); err != nil {
+			return nil, internalError("Error unmarshalling data session " + key)
+		}
+		view = usageViews(stub, rec.HO, UsageRecords{DataSessions: []DataSessionRecord{rec}}).DataSessions[0]
+	case strings.HasPrefix(key, smsPrefix):
+		var rec SMSRecord
+		if err := json.Unmarshal(value, &rec); err != nil {
+			return nil, internalError("Error unmarshalling SMS " + key)
+		}
+		view = usageViews(stub, rec.HO, UsageRecords{SMS: []SMSRecord{rec}}).SMS[0]
+	case strings.HasPrefix(key, fraudPrefix):
+		var fc FraudCase
+		if err := json.Unmarshal(value, &fc); err != nil {
+			return nil, internalError("Error unmarshalling fraud case " + key)
+		}
+		view = fraudCaseView(stub, fc)
+	default:
+		return json.RawMessage(append([]byte{}, value...)), nil
+	}
+	bytes, err := json.Marshal(view)
+	if err != nil {
+		return nil, internalError("Error marshalling " + key)
+	}
+	return json.RawMessage(bytes), nil
+}
+
+//Dump the records under one or more key prefixes, e.g. "cdr:" and
+//"operator:" for the tap export tool. Numbers are masked the way queries
+//mask them, prefixes that reach the identifier indexes, attachments,
+//location history or configuration are refused.
+//	args: prefix...
+func (t *SimpleChaincode) dumpState(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("dumpState called")
+	if len(args) == 0 {
+		return nil, checkArgs("dumpState", args, 1, "one or more key prefixes")
+	}
+	if err := requireRole(stub, "dump the ledger state", roleAuditor, roleAdmin); err != nil {
+		return nil, err
+	}
+	for _, prefix := range args {
+		if prefix == "" {
+			return nil, validationError("Empty key prefix")
+		}
+		for _, refused := range dumpRefused {
+			if strings.HasPrefix(prefix, refused) || strings.HasPrefix(refused, prefix) {
+				return nil, authError("Records under " + refused + " hold personal data and can not be dumped")
+			}
+		}
+	}
+	records := []StateRecord{}
+	for _, prefix := range args {
+		err := rangeByPrefix(stub, prefix, func(key string, value []byte) error {
+			view, err := dumpView(stub, key, value)
+			if err != nil {
+				return err
+			}
+			records = append(records, StateRecord{Key: key, Value: view})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(records)
+}
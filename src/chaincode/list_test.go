@@ -0,0 +1,119 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// pages reads a list query a page at a time and returns the keys of every page
+func (l *testLedger) pages(size string, function string, args ...string) [][]string {
+	l.t.Helper()
+	var keys [][]string
+	cursor := ""
+	for {
+		var page SubscriberPage
+		l.mustQuery(&page, function, append(args, cursor, size)...)
+		var pageKeys []string
+		for _, rs := range page.Subscribers {
+			pageKeys = append(pageKeys, rs.PublicKey)
+		}
+		keys = append(keys, pageKeys)
+		if page.Cursor == "" {
+			return keys
+		}
+		if len(keys) > 10 {
+			l.t.Fatalf("%s keeps handing out cursors, last %s", function, page.Cursor)
+		}
+		cursor = page.Cursor
+	}
+}
+
+func TestListRoamersPages(t *testing.T) {
+	l := newTestLedger(t)
+	for _, key := range []string{"rs3", "rs1", "rs2"} {
+		l.roam(key, "XYZ")
+	}
+	l.roam("rs5", "ABC")
+
+	l.asRole(roleAuditor)
+	cases := []struct {
+		size string
+		want string
+	}{
+		{"1", "rs1|rs2|rs3"},
+		{"2", "rs1,rs2|rs3"},
+		//A page that ends with the last roamer has no cursor
+		{"3", "rs1,rs2,rs3"},
+		{"", "rs1,rs2,rs3"},
+	}
+	for _, c := range cases {
+		var got []string
+		for _, page := range l.pages(c.size, "listRoamers", "XYZ") {
+			got = append(got, strings.Join(page, ","))
+		}
+		if strings.Join(got, "|") != c.want {
+			t.Errorf("listRoamers XYZ in pages of %q: %v, want %s", c.size, got, c.want)
+		}
+	}
+	if got := l.pages("2", "listRoamers", "ABC"); len(got) != 1 || strings.Join(got[0], ",") != "rs5" {
+		t.Errorf("listRoamers ABC: %v, want rs5", got)
+	}
+}
+
+func TestListUpdatedPages(t *testing.T) {
+	l := newTestLedger(t)
+	l.advance(time.Hour)
+	from := l.now
+	l.roam("rs5", "ABC")
+	l.roam("rs2", "XYZ")
+	l.advance(time.Hour)
+	to := l.now
+	l.roam("rs3", "XYZ")
+
+	l.asRole(roleAuditor)
+	window := []string{from.Format(time.RFC3339), to.Format(time.RFC3339)}
+	got := l.pages("1", "listUpdated", window...)
+	if len(got) != 2 || strings.Join(got[0], ",") != "rs2" || strings.Join(got[1], ",") != "rs5" {
+		t.Errorf("listUpdated in pages of 1: %v, want [rs2] [rs5]", got)
+	}
+	var page SubscriberPage
+	l.mustQuery(&page, "listUpdated", append(window, "", "2")...)
+	if len(page.Subscribers) != 2 || page.Cursor != "" {
+		t.Errorf("listUpdated in a page of 2: %d subscribers, cursor %q", len(page.Subscribers), page.Cursor)
+	}
+	//The cursor of the last subscriber leaves nothing to list
+	l.mustQuery(&page, "listUpdated", append(window, subscriberKey("rs5"), "2")...)
+	if len(page.Subscribers) != 0 || page.Cursor != "" {
+		t.Errorf("listUpdated after rs5: %+v", page)
+	}
+
+	for _, args := range [][]string{
+		append(window, "", "0"),
+		append(window, "", "201"),
+		append(window, "", "two"),
+		append(window, "rs2", "1"),
+	} {
+		_, err := l.stub.MockQuery("listUpdated", args)
+		if ce, ok := err.(*ChaincodeError); !ok || ce.Code != codeValidation {
+			t.Errorf("listUpdated %v: got %v, want a %s error", args, err, codeValidation)
+		}
+	}
+}
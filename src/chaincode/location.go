@@ -0,0 +1,172 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// discoverRP overwrites the position on the subscriber record, every fix is
+// also appended to the location history of the subscriber so its roaming
+// path can be traced for disputes and fraud investigations. Fixes are never
+// changed once written, only forgetSubscriber removes them.
+//
+// Fixes are keyed "location:<subscriber key>:<time>:<txid>", the time in UTC
+// to the nanosecond and always as wide, so the fixes of a subscriber sort by
+// time even within a second.
+var locationPrefix = "location:"
+
+// locationTimeFormat is RFC3339Nano without dropping trailing zeros
+var locationTimeFormat = "2006-01-02T15:04:05.000000000Z07:00"
+
+// LocationFix is one position of a subscriber, as coarse as the one on its record
+type LocationFix struct {
+	PublicKey string    `json:"publickey"`
+	Time      time.Time `json:"time"`
+	TxID      string    `json:"txid"`
+	RP        string    `json:"rp"`
+	Location  string    `json:"location"`
+	Lat       Degrees   `json:"lat"`
+	Long      Degrees   `json:"long"`
+	Flags     []string  `json:"flags,omitempty"`
+}
+
+// TrailPoint is a fix on a trail with the distance from the fix before it
+type TrailPoint struct {
+	LocationFix
+	DistanceKm float64 `json:"distanceKm"`
+}
+
+// LocationTrail is the result of queryLocationTrail
+type LocationTrail struct {
+	PublicKey  string       `json:"publickey"`
+	HO         string       `json:"ho"`
+	From       time.Time    `json:"from"`
+	To         time.Time    `json:"to"`
+	Points     []TrailPoint `json:"points"`
+	DistanceKm float64      `json:"distanceKm"`
+}
+
+func locationKey(publicKey string, at time.Time, txID string) string {
+	return locationPrefix + publicKey + ":" + at.UTC().Format(locationTimeFormat) + ":" + txID
+}
+
+//appendLocation adds a fix to the history of its subscriber
+func appendLocation(stub shim.ChaincodeStubInterface, fix LocationFix) error {
+	key := locationKey(fix.PublicKey, fix.Time, fix.TxID)
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return internalError("Error retrieving location " + key)
+	}
+	if existing != nil {
+		return conflictError("Location " + key + " is already recorded")
+	}
+	bytes, err := json.Marshal(fix)
+	if err != nil {
+		return internalError("Error marshalling location " + key)
+	}
+	if err = stub.PutState(key, bytes); err != nil {
+		fmt.Println("Error - could not write location " + key)
+		return internalError("Error writing location " + key)
+	}
+	return nil
+}
+
+//getLocations returns the ledger keys and fixes of a subscriber, oldest first
+func getLocations(stub shim.ChaincodeStubInterface, publicKey string) ([]string, []LocationFix, error) {
+	var keys []string
+	fixes := []LocationFix{}
+	err := rangeByPrefix(stub, locationPrefix+publicKey+":", func(key string, value []byte) error {
+		var fix LocationFix
+		if err := json.Unmarshal(value, &fix); err != nil {
+			return internalError("Error unmarshalling location " + key)
+		}
+		keys = append(keys, key)
+		fixes = append(fixes, fix)
+		return nil
+	})
+	return keys, fixes, err
+}
+
+//roundKm rounds a distance to 100 metres, well within what coarse fixes tell apart
+func roundKm(km float64) float64 {
+	return math.Floor(km*10+0.5) / 10
+}
+
+//trail builds the trail of the fixes from from up to but excluding to
+func trail(fixes []LocationFix, from time.Time, to time.Time) ([]TrailPoint, float64) {
+	points := []TrailPoint{}
+	total := 0.0
+	for _, fix := range fixes {
+		if fix.Time.Before(from) || !fix.Time.Before(to) {
+			continue
+		}
+		point := TrailPoint{LocationFix: fix}
+		if len(points) > 0 {
+			prev := points[len(points)-1]
+			point.DistanceKm = distanceKm(float64(prev.Lat), float64(prev.Long), float64(fix.Lat), float64(fix.Long))
+			total += point.DistanceKm
+			point.DistanceKm = roundKm(point.DistanceKm)
+		}
+		points = append(points, point)
+	}
+	return points, roundKm(total)
+}
+
+//Query the roaming path of a subscriber over a period, the fixes from from up
+//to but excluding to with the visited network at each of them
+//	args: subscriber key, from, to (RFC3339)
+func (t *SimpleChaincode) queryLocationTrail(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("queryLocationTrail called")
+	if err := checkArgs("queryLocationTrail", args, 3, "subscriber key, from and to"); err != nil {
+		return nil, err
+	}
+	from, err := time.Parse(time.RFC3339, args[1])
+	if err != nil {
+		return nil, validationError("Invalid time " + args[1])
+	}
+	to, err := time.Parse(time.RFC3339, args[2])
+	if err != nil {
+		return nil, validationError("Invalid time " + args[2])
+	}
+	if !to.After(from) {
+		return nil, validationError("Trail period must end after it starts")
+	}
+	rs, err := getSubscriber(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	//The path goes across networks, a roaming partner only sees the subscriber's current state
+	if !hasRole(stub, roleSubscriber) || certAttribute(stub, attrSubscriber) != rs.PublicKey {
+		if err = requireOperatorOrRole(stub, "read the location trail of "+rs.PublicKey, []string{rs.HO}, roleAuditor, roleAdmin); err != nil {
+			return nil, err
+		}
+	}
+	_, fixes, err := getLocations(stub, rs.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	result := LocationTrail{PublicKey: rs.PublicKey, HO: rs.HO, From: from, To: to}
+	result.Points, result.DistanceKm = trail(fixes, from, to)
+	return json.Marshal(result)
+}
@@ -0,0 +1,74 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocationTrail(t *testing.T) {
+	l := newTestLedger(t)
+	l.asRole(roleAdmin).mustInvoke("registerOperator", `{"id": "DEF", "tadig": "FRADF", "mccmnc": ["208-01"], "name": "DEF", "settlementCurrency": "EUR"}`)
+	discover := func(txID string, rp string, loc string, lat string, long string) {
+		t.Helper()
+		l.asOperator(rp)
+		if _, err := l.stub.MockInvoke(txID, "discoverRP", []string{"rs1", rp, loc, lat, long}); err != nil {
+			t.Fatalf("discoverRP %s %s: %v", rp, loc, err)
+		}
+	}
+	discover("tx-1", "XYZ", "BERLIN", "52.52", "13.40")
+	from := l.now.Add(time.Minute)
+	l.advance(time.Hour)
+	discover("tx-2", "XYZ", "BERLIN", "52.53", "13.40")
+	l.advance(2 * time.Hour)
+	//Two fixes within the same second, the later one with a txid that sorts first
+	discover("tx-4", "DEF", "PARIS", "48.86", "2.35")
+	l.advance(400 * time.Millisecond)
+	discover("tx-3", "DEF", "PARIS", "48.87", "2.35")
+	to := l.now.Add(2 * time.Hour).Truncate(time.Second)
+	l.advance(2 * time.Hour)
+	discover("tx-5", "XYZ", "BERLIN", "52.52", "13.40")
+
+	var trail LocationTrail
+	l.asOperator("ABC").mustQuery(&trail, "queryLocationTrail", "rs1", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	want := []struct {
+		txID string
+		rp   string
+		km   float64
+	}{
+		{"tx-2", "XYZ", 0},
+		{"tx-4", "DEF", roundKm(distanceKm(52.53, 13.40, 48.86, 2.35))},
+		{"tx-3", "DEF", roundKm(distanceKm(48.86, 2.35, 48.87, 2.35))},
+	}
+	if len(trail.Points) != len(want) {
+		t.Fatalf("got %d points, want %d: %+v", len(trail.Points), len(want), trail.Points)
+	}
+	for i, w := range want {
+		if p := trail.Points[i]; p.TxID != w.txID || p.RP != w.rp || p.DistanceKm != w.km {
+			t.Errorf("point %d: txid %s, rp %s, %v km, want %s, %s, %v km", i, p.TxID, p.RP, p.DistanceKm, w.txID, w.rp, w.km)
+		}
+	}
+	total := roundKm(distanceKm(52.53, 13.40, 48.86, 2.35) + distanceKm(48.86, 2.35, 48.87, 2.35))
+	if trail.DistanceKm != total {
+		t.Errorf("trail distance %v km, want %v km", trail.DistanceKm, total)
+	}
+	if trail.HO != "ABC" || !trail.From.Equal(from) || !trail.To.Equal(to) {
+		t.Errorf("trail of %s from %v to %v, want ABC from %v to %v", trail.HO, trail.From, trail.To, from, to)
+	}
+}
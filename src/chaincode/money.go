@@ -0,0 +1,205 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Money is a fixed point amount with moneyDecimals digits after the point.
+// Charges are summed across many CDRs and between operators, so they are
+// kept as integers to avoid float64 rounding drift.
+type Money int64
+
+const moneyDecimals = 4
+const moneyScale = 10000
+
+// Active ISO 4217 currency codes, XDR included as roaming partners often
+// settle in special drawing rights
+var isoCurrencies = strings.Fields(`
+	AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND BOB BRL
+	BSD BTN BWP BYN BZD CAD CDF CHF CLP CNY COP CRC CUP CVE CZK DJF DKK DOP DZD EGP
+	ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF GTQ GYD HKD HNL HTG HUF IDR ILS INR
+	IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW KWD KYD KZT LAK LBP LKR LRD LSL
+	LYD MAD MDL MGA MKD MMK MNT MOP MRU MUR MVR MWK MXN MYR MZN NAD NGN NIO NOK NPR
+	NZD OMR PAB PEN PGK PHP PKR PLN PYG QAR RON RSD RUB RWF SAR SBD SCR SDG SEK SGD
+	SHP SLE SOS SRD SSP STN SVC SYP SZL THB TJS TMT TND TOP TRY TTD TWD TZS UAH UGX
+	USD UYU UZS VES VND VUV WST XAF XCD XDR XOF XPF YER ZAR ZMW ZWL`)
+
+//validCurrency reports whether code is an ISO 4217 currency code
+func validCurrency(code string) bool {
+	for _, c := range isoCurrencies {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+//parseMoney reads a decimal string such as "12.5" or "-0.0125"
+func parseMoney(s string) (Money, error) {
+	v, err := parseDecimal(s, moneyDecimals)
+	return Money(v), err
+}
+
+func (m Money) String() string {
+	return formatDecimal(int64(m), moneyDecimals)
+}
+
+//parseDecimal reads a decimal string into an integer with decimals implied
+//digits. It takes one optional leading sign, then digits with at most one
+//point among them, and fails on amounts an int64 can not hold.
+func parseDecimal(s string, decimals int) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, errors.New("Empty amount")
+	}
+	amount := s
+	neg := false
+	if s[0] == '-' || s[0] == '+' {
+		neg = s[0] == '-'
+		s = s[1:]
+	}
+	whole, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	if whole+frac == "" || !isDigits(whole) || !isDigits(frac) {
+		return 0, errors.New("Invalid amount " + amount)
+	}
+	if len(frac) > decimals {
+		return 0, errors.New("Too many decimals in amount " + amount)
+	}
+	frac = frac + strings.Repeat("0", decimals-len(frac))
+	var v int64
+	for _, c := range whole + frac {
+		d := int64(c - '0')
+		if v > (math.MaxInt64-d)/10 {
+			return 0, errors.New("Amount " + amount + " is out of range")
+		}
+		v = v*10 + d
+	}
+	if neg {
+		v = -v
+	}
+	return v, nil
+}
+
+//isDigits reports whether s holds nothing but ASCII digits
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+//formatDecimal writes an integer with decimals implied digits as a decimal string
+func formatDecimal(v int64, decimals int) string {
+	neg := v < 0
+	if neg {
+		v = -v
+	}
+	digits := strconv.FormatInt(v, 10)
+	if len(digits) <= decimals {
+		digits = strings.Repeat("0", decimals-len(digits)+1) + digits
+	}
+	s := digits[:len(digits)-decimals] + "." + digits[len(digits)-decimals:]
+	if neg {
+		s = "-" + s
+	}
+	return s
+}
+
+//MarshalJSON writes the amount as a decimal string so that no client reads it as a float
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+//UnmarshalJSON accepts both "1.25" and 1.25
+func (m *Money) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), "\"")
+	if s == "" || s == "null" {
+		*m = 0
+		return nil
+	}
+	v, err := parseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+//mulDiv returns m*num/den rounded half away from zero. The product is
+//taken in a big.Int, converting large totals at a rate overflows an int64,
+//and a result that does not fit back into Money is an error.
+func (m Money) mulDiv(num int64, den int64) (Money, error) {
+	p := new(big.Int).Mul(big.NewInt(int64(m)), big.NewInt(num))
+	d := big.NewInt(den)
+	q, r := new(big.Int).QuoRem(p, d, new(big.Int))
+	r.Abs(r).Mul(r, big.NewInt(2))
+	if r.Cmp(new(big.Int).Abs(d)) >= 0 {
+		if p.Sign()*d.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	if !q.IsInt64() {
+		return 0, validationError(fmt.Sprintf("Amount %s times %d / %d is out of range", m, num, den))
+	}
+	return Money(q.Int64()), nil
+}
+
+// Rate is an exchange rate with rateDecimals digits after the point
+type Rate int64
+
+const rateDecimals = 8
+const rateScale = 100000000
+
+func parseRate(s string) (Rate, error) {
+	v, err := parseDecimal(s, rateDecimals)
+	return Rate(v), err
+}
+
+func (r Rate) String() string {
+	return formatDecimal(int64(r), rateDecimals)
+}
+
+//MarshalJSON writes the rate as a decimal string like Money
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+//UnmarshalJSON accepts both "1.0825" and 1.0825
+func (r *Rate) UnmarshalJSON(b []byte) error {
+	v, err := parseRate(strings.Trim(string(b), "\""))
+	if err != nil {
+		return err
+	}
+	*r = v
+	return nil
+}
@@ -0,0 +1,93 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	valid := []struct {
+		in   string
+		want Money
+	}{
+		{"0", 0},
+		{"12", 120000},
+		{"12.5", 125000},
+		{"-0.0125", -125},
+		{"+1.5", 15000},
+		{".25", 2500},
+		{"3.", 30000},
+		{" 7.1 ", 71000},
+		{"922337203685477.5807", 922337203685477*moneyScale + 5807},
+		{"-922337203685477.5807", -(922337203685477*moneyScale + 5807)},
+	}
+	for _, c := range valid {
+		got, err := parseMoney(c.in)
+		if err != nil || got != c.want {
+			t.Errorf("parseMoney(%q) = %v, %v, want %v", c.in, got, err, c.want)
+		}
+	}
+	for _, in := range []string{"", "-", ".", "+-1.5", "--1", "1.-5", "1.+5", "1-", "1.2.3", "1e3", "0x10", "1,5", "1. 5",
+		"1.23456", "922337203685477.5808", "99999999999999999999"} {
+		if got, err := parseMoney(in); err == nil {
+			t.Errorf("parseMoney(%q) = %v, want an error", in, got)
+		}
+	}
+}
+
+func TestMoneyRoundTrip(t *testing.T) {
+	for _, s := range []string{"0.0000", "0.0125", "-0.0125", "12.5000", "-922337203685477.5807"} {
+		m, err := parseMoney(s)
+		if err != nil {
+			t.Fatalf("parseMoney(%q): %v", s, err)
+		}
+		if m.String() != s {
+			t.Errorf("parseMoney(%q).String() = %q", s, m.String())
+		}
+	}
+	if r, err := parseRate("1.08234567"); err != nil || r.String() != "1.08234567" {
+		t.Errorf("parseRate = %v, %v", r, err)
+	}
+}
+
+func TestMulDivRoundsHalfAwayFromZero(t *testing.T) {
+	cases := []struct {
+		m        Money
+		num, den int64
+		want     Money
+	}{
+		{10000, 1, 3, 3333},
+		{20000, 1, 3, 6667},
+		{5, 1, 2, 3},
+		{-5, 1, 2, -3},
+		{5000 * moneyScale, 61, 60, 50833333},
+	}
+	for _, c := range cases {
+		got, err := c.m.mulDiv(c.num, c.den)
+		if err != nil {
+			t.Errorf("%v.mulDiv(%d, %d): %v", c.m, c.num, c.den, err)
+		} else if got != c.want {
+			t.Errorf("%v.mulDiv(%d, %d) = %v, want %v", c.m, c.num, c.den, got, c.want)
+		}
+	}
+	if got, err := Money(math.MaxInt64 / 2).mulDiv(3, 1); err == nil {
+		t.Errorf("mulDiv overflowing an int64 = %v, want an error", got)
+	}
+}
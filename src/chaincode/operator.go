@@ -0,0 +1,274 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Operators are keyed by the short name used as HO and RP everywhere else,
+// e.g. "operator:ABC". The name is also part of the keys of agreements,
+// statements and subscriber indexes, so it is restricted to characters
+// that can not run into the next part of such a key.
+var operatorPrefix = "operator:"
+
+// Operator status values
+const (
+	operatorActive   = "Active"
+	operatorInactive = "Inactive"
+)
+
+var (
+	operatorIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+	tadigPattern      = regexp.MustCompile(`^[A-Z]{3}[A-Z0-9]{2}$`)
+	mccmncPattern     = regexp.MustCompile(`^[0-9]{3}-[0-9]{2,3}$`)
+)
+
+// Operator is a home operator or roaming partner that is a member of the network
+type Operator struct {
+	ID                 string    `json:"id"`
+	TADIG              string    `json:"tadig"`
+	MCCMNC             []string  `json:"mccmnc"`
+	Name               string    `json:"name"`
+	SettlementCurrency string    `json:"settlementCurrency"`
+	SigningCert        string    `json:"signingCert"`
+	Status             string    `json:"status"`
+	RegisteredAt       time.Time `json:"registeredAt"`
+	UpdatedAt          time.Time `json:"updatedAt"`
+}
+
+func operatorKey(id string) string {
+	return operatorPrefix + id
+}
+
+//validateOperatorIDs rejects ids that would make the keys they are part of ambiguous
+func validateOperatorIDs(ids ...string) error {
+	for _, id := range ids {
+		if !operatorIDPattern.MatchString(id) {
+			return validationError("Invalid operator id " + id + ", expecting up to 32 letters, digits, '_' or '-'")
+		}
+	}
+	return nil
+}
+
+//validate checks an operator record before it is written
+func (o Operator) validate() error {
+	if o.ID == "" || o.Name == "" {
+		return validationError("Operator needs an id and a name")
+	}
+	if err := validateOperatorIDs(o.ID); err != nil {
+		return err
+	}
+	if !tadigPattern.MatchString(o.TADIG) {
+		return validationError("Invalid TADIG code " + o.TADIG)
+	}
+	if len(o.MCCMNC) == 0 {
+		return validationError("Operator needs at least one MCC-MNC")
+	}
+	for _, m := range o.MCCMNC {
+		if !mccmncPattern.MatchString(m) {
+			return validationError("Invalid MCC-MNC " + m + ", expecting e.g. 310-010")
+		}
+	}
+	if !validCurrency(o.SettlementCurrency) {
+		return validationError("Operator needs an ISO 4217 settlement currency")
+	}
+	return nil
+}
+
+func getOperator(stub shim.ChaincodeStubInterface, id string) (Operator, error) {
+	var op Operator
+	bytes, err := stub.GetState(operatorKey(id))
+	if err != nil {
+		fmt.Println("Error - Could not get operator : " + id)
+		return op, internalError("Error retrieving operator " + id)
+	}
+	if bytes == nil {
+		return op, notFoundError("Unknown operator " + id)
+	}
+	err = json.Unmarshal(bytes, &op)
+	if err != nil {
+		return op, internalError("Error unmarshalling operator " + id)
+	}
+	return op, nil
+}
+
+func putOperator(stub shim.ChaincodeStubInterface, op Operator) error {
+	bytes, err := json.Marshal(op)
+	if err != nil {
+		return internalError("Error marshalling operator " + op.ID)
+	}
+	err = stub.PutState(operatorKey(op.ID), bytes)
+	if err != nil {
+		fmt.Println("Error - could not write operator " + op.ID)
+		return internalError("Error writing operator " + op.ID)
+	}
+	fmt.Println("Success, wrote operator " + op.ID)
+	return nil
+}
+
+//activeOperator returns the operator if it is registered and active
+func activeOperator(stub shim.ChaincodeStubInterface, id string) (Operator, error) {
+	op, err := getOperator(stub, id)
+	if err != nil {
+		return op, err
+	}
+	if op.Status != operatorActive {
+		return op, conflictError("Operator " + id + " is " + op.Status)
+	}
+	return op, nil
+}
+
+func parseOperator(arg string) (Operator, error) {
+	var op Operator
+	err := json.Unmarshal([]byte(arg), &op)
+	if err != nil {
+		return op, validationError("Invalid operator: " + err.Error())
+	}
+	return op, op.validate()
+}
+
+/*		0
+	json
+	{
+		"id": "XYZ",
+		"tadig": "DEUXY",
+		"mccmnc": ["262-01", "262-06"],
+		"name": "XYZ Mobilfunk",
+		"settlementCurrency": "EUR",
+		"signingCert": "-----BEGIN CERTIFICATE-----\n..."
+	}
+*/
+func (t *SimpleChaincode) registerOperator(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Registering operator")
+	if err := checkArgs("registerOperator", args, 1, "operator record"); err != nil {
+		return nil, err
+	}
+	if err := requireRole(stub, "register operators", roleAdmin); err != nil {
+		return nil, err
+	}
+	op, err := parseOperator(args[0])
+	if err != nil {
+		return nil, err
+	}
+	existing, err := stub.GetState(operatorKey(op.ID))
+	if err != nil {
+		return nil, internalError("Error retrieving operator " + op.ID)
+	}
+	if existing != nil {
+		return nil, conflictError("Operator " + op.ID + " is already registered")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	op.Status = operatorActive
+	op.RegisteredAt = now
+	op.UpdatedAt = now
+	return nil, putOperator(stub, op)
+}
+
+//updateOperator replaces the details of an operator. Status and registration
+//time are kept, deactivateOperator is the only way to change the status.
+func (t *SimpleChaincode) updateOperator(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Updating operator")
+	if err := checkArgs("updateOperator", args, 1, "operator record"); err != nil {
+		return nil, err
+	}
+	if err := requireRole(stub, "update operators", roleAdmin); err != nil {
+		return nil, err
+	}
+	updated, err := parseOperator(args[0])
+	if err != nil {
+		return nil, err
+	}
+	op, err := getOperator(stub, updated.ID)
+	if err != nil {
+		return nil, err
+	}
+	updated.Status = op.Status
+	updated.RegisteredAt = op.RegisteredAt
+	updated.UpdatedAt, err = txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	return nil, putOperator(stub, updated)
+}
+
+//deactivateOperator stops an operator from taking part in new roaming. Its
+//history stays on the ledger.
+func (t *SimpleChaincode) deactivateOperator(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Deactivating operator")
+	if err := checkArgs("deactivateOperator", args, 1, "operator id"); err != nil {
+		return nil, err
+	}
+	if err := requireRole(stub, "deactivate operators", roleAdmin); err != nil {
+		return nil, err
+	}
+	op, err := getOperator(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if op.Status == operatorInactive {
+		return nil, conflictError("Operator " + op.ID + " is already inactive")
+	}
+	op.Status = operatorInactive
+	op.UpdatedAt, err = txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	return nil, putOperator(stub, op)
+}
+
+//Operators are public membership information, any enrolled user may read them
+func (t *SimpleChaincode) queryOperator(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("queryOperator called")
+	if err := checkArgs("queryOperator", args, 1, "operator id"); err != nil {
+		return nil, err
+	}
+	op, err := getOperator(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(op)
+}
+
+func (t *SimpleChaincode) listOperators(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("listOperators called")
+	if err := checkArgs("listOperators", args, 0, "nothing"); err != nil {
+		return nil, err
+	}
+	operators := []Operator{}
+	err := rangeByPrefix(stub, operatorPrefix, func(key string, value []byte) error {
+		var op Operator
+		if err := json.Unmarshal(value, &op); err != nil {
+			return internalError("Error unmarshalling operator " + key)
+		}
+		operators = append(operators, op)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(operators)
+}
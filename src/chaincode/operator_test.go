@@ -0,0 +1,43 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import "testing"
+
+func TestOperatorIDs(t *testing.T) {
+	op := Operator{Name: "DEF", TADIG: "FRADF", MCCMNC: []string{"208-01"}, SettlementCurrency: "EUR"}
+	for id, valid := range map[string]bool{
+		"DEF":                               true,
+		"def_2-x":                           true,
+		"":                                  false,
+		"ABC:XYZ":                           false,
+		"DE F":                              false,
+		"DEF/":                              false,
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456": false,
+	} {
+		op.ID = id
+		if err := op.validate(); (err == nil) != valid {
+			t.Errorf("operator id %q: got %v", id, err)
+		}
+	}
+
+	l := newTestLedger(t)
+	l.asRole(roleAdmin).mustFail(codeValidation, "registerOperator", `{"id": "ABC:XYZ", "tadig": "FRADF", "mccmnc": ["208-01"], "name": "DEF", "settlementCurrency": "EUR"}`)
+	//Agreements and rate cards of a fixture are not checked against the registered operators
+	l.mustFail(codeValidation, "loadFixture", `{"agreements": [{"ho": "ABC", "rp": "XYZ:2017", "validFrom": "2017-01-01T00:00:00Z"}]}`)
+}
@@ -0,0 +1,124 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+// Command piivault keeps the subscriber secrets of a home operator in a
+// file store and protects, reveals and discloses subscriber data with them.
+//
+//	piivault -store vault -key rs8 protect  < record.json     envelope for enterData
+//	piivault -store vault -key rs8 reveal   < subscriber.json  record of queryMSISDN output
+//	piivault -store vault -key rs8 -field name disclose < subscriber.json
+//	piivault -store vault -key rs8 forget
+//
+// disclose prints the value and salt of one field, the arguments of the
+// chaincode query verifyPII. forget destroys the key and salts of the
+// subscriber, the erasure that goes with the chaincode's forgetSubscriber;
+// nothing sealed for it can be revealed afterwards.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"chaincode/pii"
+)
+
+func main() {
+	dir := flag.String("store", "pii_vault", "directory of the secrets file store")
+	key := flag.String("key", "", "subscriber key")
+	field := flag.String("field", "", "field to disclose")
+	flag.Parse()
+
+	if err := run(*dir, *key, *field, flag.Arg(0), os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "piivault:", err)
+		os.Exit(1)
+	}
+}
+
+func run(dir string, key string, field string, command string, in io.Reader, out io.Writer) error {
+	if key == "" {
+		return errors.New("-key is required")
+	}
+	store, err := pii.NewFileStore(dir)
+	if err != nil {
+		return err
+	}
+	switch command {
+	case "protect":
+		var rec pii.Record
+		if err = json.NewDecoder(in).Decode(&rec); err != nil {
+			return err
+		}
+		env, err := pii.Protect(store, key, rec)
+		if err != nil {
+			return err
+		}
+		return json.NewEncoder(out).Encode(env)
+	case "reveal":
+		rec, _, err := reveal(store, key, in)
+		if err != nil {
+			return err
+		}
+		return json.NewEncoder(out).Encode(rec)
+	case "disclose":
+		rec, env, err := reveal(store, key, in)
+		if err != nil {
+			return err
+		}
+		secrets, err := store.Get(key)
+		if err != nil {
+			return err
+		}
+		salt, ok := secrets.Salts[field]
+		if !ok {
+			return errors.New("unknown field " + field)
+		}
+		value := rec.Value(field)
+		if !env.Verify(field, salt, value) {
+			return errors.New("value of " + field + " does not match its commitment")
+		}
+		return json.NewEncoder(out).Encode(map[string]string{"field": field, "value": value, "salt": base64.StdEncoding.EncodeToString(salt)})
+	case "forget":
+		err = store.Delete(key)
+		if err == pii.ErrNotFound {
+			return errors.New("no secrets for " + key + " in " + dir)
+		}
+		return err
+	}
+	return errors.New("unknown command " + command + ", expecting protect, reveal, disclose or forget")
+}
+
+//reveal reads an envelope, on its own or as the pii of a subscriber record, and opens it
+func reveal(store pii.Store, key string, in io.Reader) (pii.Record, pii.Envelope, error) {
+	var doc struct {
+		pii.Envelope
+		PII *pii.Envelope `json:"pii"`
+	}
+	if err := json.NewDecoder(in).Decode(&doc); err != nil {
+		return pii.Record{}, pii.Envelope{}, err
+	}
+	env := doc.Envelope
+	if doc.PII != nil {
+		env = *doc.PII
+	}
+	rec, err := pii.Reveal(store, key, env)
+	return rec, env, err
+}
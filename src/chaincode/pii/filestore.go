@@ -0,0 +1,99 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package pii
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// FileStore is the reference Store, one JSON file per subscriber readable
+// only by the owner, e.g. "<dir>/rs1.json". The Node app writes the same
+// layout, both can share a directory.
+type FileStore struct {
+	Dir string
+}
+
+var storeNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// NewFileStore opens the store in dir, creating the directory if needed
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{Dir: dir}, nil
+}
+
+func (fs *FileStore) path(publicKey string) (string, error) {
+	if !storeNamePattern.MatchString(publicKey) {
+		return "", errors.New("pii: subscriber key " + publicKey + " can not be used as a file name")
+	}
+	return filepath.Join(fs.Dir, publicKey+".json"), nil
+}
+
+// Get reads the secrets of a subscriber
+func (fs *FileStore) Get(publicKey string) (Secrets, error) {
+	var s Secrets
+	path, err := fs.path(publicKey)
+	if err != nil {
+		return s, err
+	}
+	bytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, ErrNotFound
+	}
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(bytes, &s)
+	return s, err
+}
+
+// Put writes the secrets of a subscriber, replacing the file in one rename
+func (fs *FileStore) Put(s Secrets) error {
+	path, err := fs.path(s.PublicKey)
+	if err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, bytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Delete removes the secrets of a subscriber
+func (fs *FileStore) Delete(publicKey string) error {
+	path, err := fs.path(publicKey)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
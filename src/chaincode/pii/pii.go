@@ -0,0 +1,235 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+// Package pii protects the personal data of a subscriber before its home
+// operator submits it to the roaming chaincode. Everything in a transaction
+// ends up in the blocks of every peer, so the data has to be protected on
+// the operator's side:
+//
+//   - the fields are sealed with AES-256-GCM under a key of the subscriber,
+//     the sealed blob goes on chain
+//   - every field gets a commitment, the HMAC-SHA256 of the value under a
+//     salt of its own, so one field can be proven to an auditor by
+//     disclosing its value and salt without revealing the others
+//
+// The key and salts never leave the operator, they are kept in a Store.
+// Deleting them from the store makes the blob on chain unreadable for good.
+package pii
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Names of the protected fields, in the order their commitments are listed
+const (
+	FieldName    = "name"
+	FieldAddress = "address"
+	FieldMSISDN  = "msisdn"
+	FieldLat     = "lat"
+	FieldLong    = "long"
+)
+
+// Fields lists the protected fields in commitment order
+var Fields = []string{FieldName, FieldAddress, FieldMSISDN, FieldLat, FieldLong}
+
+const (
+	keySize  = 32
+	saltSize = 16
+)
+
+// ErrNotFound is returned by a Store that holds no secrets for a subscriber
+var ErrNotFound = errors.New("pii: no secrets for subscriber")
+
+// Record is the personal data of a subscriber
+type Record struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	MSISDN  string `json:"msisdn"`
+	Lat     string `json:"lat"`
+	Long    string `json:"long"`
+}
+
+// Value returns the value of a field, "" for an unknown field
+func (r Record) Value(field string) string {
+	switch field {
+	case FieldName:
+		return r.Name
+	case FieldAddress:
+		return r.Address
+	case FieldMSISDN:
+		return r.MSISDN
+	case FieldLat:
+		return r.Lat
+	case FieldLong:
+		return r.Long
+	}
+	return ""
+}
+
+// Secrets are the key and salts of one subscriber
+type Secrets struct {
+	PublicKey string            `json:"publicKey"`
+	Key       []byte            `json:"key"`
+	Salts     map[string][]byte `json:"salts"`
+}
+
+// Store keeps the secrets of subscribers off chain. Get and Delete return
+// ErrNotFound for a subscriber the store holds nothing for.
+type Store interface {
+	Get(publicKey string) (Secrets, error)
+	Put(s Secrets) error
+	Delete(publicKey string) error
+}
+
+// Commitment binds one field to its value
+type Commitment struct {
+	Field string `json:"field"`
+	Hash  string `json:"hash"`
+}
+
+// Envelope is what goes on chain, the argument pii of enterData
+type Envelope struct {
+	Blob        string       `json:"blob"`
+	Commitments []Commitment `json:"commitments"`
+}
+
+// Commit returns the commitment of a value under a salt
+func Commit(salt []byte, value string) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether value and salt open the commitment of field
+func (e Envelope) Verify(field string, salt []byte, value string) bool {
+	for _, c := range e.Commitments {
+		if c.Field == field {
+			return hmac.Equal([]byte(c.Hash), []byte(Commit(salt, value)))
+		}
+	}
+	return false
+}
+
+// Protect seals the record of a subscriber and commits to its fields. The
+// subscriber's secrets are created on first use and reused after that.
+func Protect(store Store, publicKey string, rec Record) (Envelope, error) {
+	var env Envelope
+	secrets, err := store.Get(publicKey)
+	if err == ErrNotFound {
+		if secrets, err = newSecrets(publicKey); err == nil {
+			err = store.Put(secrets)
+		}
+	}
+	if err != nil {
+		return env, err
+	}
+	plain, err := json.Marshal(rec)
+	if err != nil {
+		return env, err
+	}
+	blob, err := seal(secrets.Key, plain, []byte(publicKey))
+	if err != nil {
+		return env, err
+	}
+	env.Blob = base64.StdEncoding.EncodeToString(blob)
+	for _, field := range Fields {
+		env.Commitments = append(env.Commitments, Commitment{Field: field, Hash: Commit(secrets.Salts[field], rec.Value(field))})
+	}
+	return env, nil
+}
+
+// Reveal opens the blob of an envelope with the subscriber's key
+func Reveal(store Store, publicKey string, env Envelope) (Record, error) {
+	var rec Record
+	secrets, err := store.Get(publicKey)
+	if err != nil {
+		return rec, err
+	}
+	blob, err := base64.StdEncoding.DecodeString(env.Blob)
+	if err != nil {
+		return rec, fmt.Errorf("pii: invalid blob: %v", err)
+	}
+	plain, err := open(secrets.Key, blob, []byte(publicKey))
+	if err != nil {
+		return rec, err
+	}
+	err = json.Unmarshal(plain, &rec)
+	return rec, err
+}
+
+func newSecrets(publicKey string) (Secrets, error) {
+	s := Secrets{PublicKey: publicKey, Key: make([]byte, keySize), Salts: map[string][]byte{}}
+	if _, err := io.ReadFull(rand.Reader, s.Key); err != nil {
+		return s, err
+	}
+	for _, field := range Fields {
+		salt := make([]byte, saltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return s, err
+		}
+		s.Salts[field] = salt
+	}
+	return s, nil
+}
+
+//seal encrypts plain and returns the nonce followed by the ciphertext. The
+//subscriber key is the additional data, a blob can not be moved to another
+//subscriber.
+func seal(key []byte, plain []byte, ad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, ad), nil
+}
+
+func open(key []byte, blob []byte, ad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) < gcm.NonceSize() {
+		return nil, errors.New("pii: blob too short")
+	}
+	plain, err := gcm.Open(nil, blob[:gcm.NonceSize()], blob[gcm.NonceSize():], ad)
+	if err != nil {
+		return nil, errors.New("pii: blob does not open with the subscriber's key")
+	}
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,506 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// A subscriber can have a plan with monthly allowances and roaming bundles.
+// Rated usage is drawn from a bundle valid on the serving network first and
+// from the monthly allowance after that. The usage of each calendar month
+// (UTC) is kept under its own key, so a new month starts from zero.
+//
+// Subscribers without a plan are rated as before and never capped.
+var (
+	planPrefix      = "plan:"
+	planUsagePrefix = "planusage:"
+)
+
+const (
+	bytesPerMB              = 1024 * 1024
+	defaultOverageThreshold = 100
+)
+
+// Allowance is an amount of voice minutes, messages and data. A service with
+// no allowance is not included, any use of it counts as overage.
+type Allowance struct {
+	VoiceMinutes int64 `json:"voiceMinutes"`
+	SMS          int64 `json:"sms"`
+	DataMB       int64 `json:"dataMB"`
+}
+
+// Usage counts voice seconds, messages and data bytes
+type Usage struct {
+	VoiceSeconds int64 `json:"voiceSeconds"`
+	SMS          int64 `json:"sms"`
+	DataBytes    int64 `json:"dataBytes"`
+}
+
+// Bundle is a roaming add-on valid on one roaming partner, or on any when RP is empty
+type Bundle struct {
+	Name      string    `json:"name"`
+	RP        string    `json:"rp"`
+	Allowance Allowance `json:"allowance"`
+	ValidFrom time.Time `json:"validFrom"`
+	ValidTo   time.Time `json:"validTo"`
+	Used      Usage     `json:"used"`
+}
+
+// Plan is the tariff plan of a subscriber. Overage is flagged once the
+// monthly usage of a service reaches OverageThreshold percent of its
+// allowance. With HardCap set CallOut is blocked once the voice allowance is
+// used up, and with a SpendingLimit once the month's charges reach it. Every
+// charge counts towards the spend in Currency, charges in other currencies
+// are converted with the exchange rates of the home operator and can not be
+// posted while it has none for them.
+type Plan struct {
+	PublicKey        string    `json:"publickey"`
+	Name             string    `json:"name"`
+	Monthly          Allowance `json:"monthly"`
+	Bundles          []Bundle  `json:"bundles"`
+	OverageThreshold int       `json:"overageThreshold"`
+	HardCap          bool      `json:"hardCap"`
+	SpendingLimit    Money     `json:"spendingLimit"`
+	Currency         string    `json:"currency"`
+}
+
+// MonthlyUsage is the usage of a subscriber's monthly allowance in one month.
+// Overage holds the allowances, voice, sms or data, that have reached the
+// overage threshold.
+type MonthlyUsage struct {
+	PublicKey string          `json:"publickey"`
+	Month     string          `json:"month"`
+	Used      Usage           `json:"used"`
+	Spend     Money           `json:"spend"`
+	Overage   map[string]bool `json:"overageServices,omitempty"`
+	Capped    bool            `json:"capped"`
+}
+
+// AllowanceStatus is the result of queryAllowance
+type AllowanceStatus struct {
+	Plan      Plan         `json:"plan"`
+	Usage     MonthlyUsage `json:"usage"`
+	Remaining Allowance    `json:"remaining"`
+}
+
+func planKey(publicKey string) string {
+	return planPrefix + publicKey
+}
+
+func planUsageKey(publicKey string, month string) string {
+	return planUsagePrefix + publicKey + ":" + month
+}
+
+func usageMonth(at time.Time) string {
+	return at.UTC().Format("2006-01")
+}
+
+//units returns the allowance of a service in the units usage is counted in
+func (a Allowance) units(service string) int64 {
+	switch service {
+	case rateVoiceOut, rateVoiceIn:
+		return a.VoiceMinutes * 60
+	case rateSMS, rateSMSIn:
+		return a.SMS
+	case rateData:
+		return a.DataMB * bytesPerMB
+	}
+	return 0
+}
+
+//allowanceOf is the allowance a rated service counts against, incoming and
+//outgoing calls share the voice minutes and messages the SMS
+func allowanceOf(service string) string {
+	switch service {
+	case rateVoiceOut, rateVoiceIn:
+		return serviceVoice
+	case rateSMS, rateSMSIn:
+		return serviceSMS
+	}
+	return service
+}
+
+func (u Usage) units(service string) int64 {
+	switch service {
+	case rateVoiceOut, rateVoiceIn:
+		return u.VoiceSeconds
+	case rateSMS, rateSMSIn:
+		return u.SMS
+	case rateData:
+		return u.DataBytes
+	}
+	return 0
+}
+
+func (u *Usage) add(service string, n int64) {
+	switch service {
+	case rateVoiceOut, rateVoiceIn:
+		u.VoiceSeconds += n
+	case rateSMS, rateSMSIn:
+		u.SMS += n
+	case rateData:
+		u.DataBytes += n
+	}
+}
+
+//remaining is what is left of allowance a after usage u, never below zero
+func remaining(a Allowance, u Usage) Allowance {
+	left := func(allowed int64, used int64, per int64) int64 {
+		if used >= allowed*per {
+			return 0
+		}
+		return (allowed*per - used) / per
+	}
+	return Allowance{
+		VoiceMinutes: left(a.VoiceMinutes, u.VoiceSeconds, 60),
+		SMS:          left(a.SMS, u.SMS, 1),
+		DataMB:       left(a.DataMB, u.DataBytes, bytesPerMB),
+	}
+}
+
+func (p Plan) validate() error {
+	if p.PublicKey == "" {
+		return validationError("Plan needs a subscriber key")
+	}
+	if p.Monthly.VoiceMinutes < 0 || p.Monthly.SMS < 0 || p.Monthly.DataMB < 0 {
+		return validationError("Plan allowances can not be negative")
+	}
+	if p.OverageThreshold < 0 || p.OverageThreshold > 100 {
+		return validationError("Overage threshold must be a percentage between 0 and 100, 0 for the default of 100")
+	}
+	if p.SpendingLimit < 0 {
+		return validationError("Spending limit can not be negative")
+	}
+	if p.SpendingLimit > 0 && !validCurrency(p.Currency) {
+		return validationError("A spending limit needs an ISO 4217 currency code")
+	}
+	for _, b := range p.Bundles {
+		if err := b.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b Bundle) validate() error {
+	if b.Name == "" {
+		return validationError("Bundle needs a name")
+	}
+	if b.Allowance.VoiceMinutes < 0 || b.Allowance.SMS < 0 || b.Allowance.DataMB < 0 {
+		return validationError("Bundle allowances can not be negative")
+	}
+	if !b.ValidTo.After(b.ValidFrom) {
+		return validationError("Bundle " + b.Name + " must end after it starts")
+	}
+	return nil
+}
+
+//appliesTo reports whether the bundle covers usage on rp at time at
+func (b Bundle) appliesTo(rp string, at time.Time) bool {
+	if at.Before(b.ValidFrom) || !at.Before(b.ValidTo) {
+		return false
+	}
+	return b.RP == "" || b.RP == rp
+}
+
+//getPlan returns the plan of a subscriber, found is false if it has none
+func getPlan(stub shim.ChaincodeStubInterface, publicKey string) (Plan, bool, error) {
+	var plan Plan
+	bytes, err := stub.GetState(planKey(publicKey))
+	if err != nil {
+		return plan, false, internalError("Error retrieving plan of " + publicKey)
+	}
+	if bytes == nil {
+		return plan, false, nil
+	}
+	if err = json.Unmarshal(bytes, &plan); err != nil {
+		return plan, false, internalError("Error unmarshalling plan of " + publicKey)
+	}
+	return plan, true, nil
+}
+
+func putPlan(stub shim.ChaincodeStubInterface, plan Plan) error {
+	bytes, err := json.Marshal(plan)
+	if err != nil {
+		return internalError("Error marshalling plan of " + plan.PublicKey)
+	}
+	if err = stub.PutState(planKey(plan.PublicKey), bytes); err != nil {
+		fmt.Println("Error - could not write plan of " + plan.PublicKey)
+		return internalError("Error writing plan of " + plan.PublicKey)
+	}
+	return nil
+}
+
+//getMonthlyUsage returns the usage of a month, zero if nothing was used yet
+func getMonthlyUsage(stub shim.ChaincodeStubInterface, publicKey string, month string) (MonthlyUsage, error) {
+	usage := MonthlyUsage{PublicKey: publicKey, Month: month}
+	bytes, err := stub.GetState(planUsageKey(publicKey, month))
+	if err != nil {
+		return usage, internalError("Error retrieving usage of " + publicKey + " in " + month)
+	}
+	if bytes == nil {
+		return usage, nil
+	}
+	if err = json.Unmarshal(bytes, &usage); err != nil {
+		return usage, internalError("Error unmarshalling usage of " + publicKey + " in " + month)
+	}
+	return usage, nil
+}
+
+func putMonthlyUsage(stub shim.ChaincodeStubInterface, usage MonthlyUsage) error {
+	bytes, err := json.Marshal(usage)
+	if err != nil {
+		return internalError("Error marshalling usage of " + usage.PublicKey)
+	}
+	if err = stub.PutState(planUsageKey(usage.PublicKey, usage.Month), bytes); err != nil {
+		fmt.Println("Error - could not write usage of " + usage.PublicKey)
+		return internalError("Error writing usage of " + usage.PublicKey)
+	}
+	return nil
+}
+
+//spendIn converts a charge into the currency of a plan with the exchange
+//rates the home operator published for the time of the usage
+func spendIn(stub shim.ChaincodeStubInterface, ho string, charge Money, from string, to string, at time.Time) (Money, error) {
+	if from == to || charge == 0 {
+		return charge, nil
+	}
+	snap, err := rateSnapshotAt(stub, ho, at)
+	if err != nil {
+		return 0, err
+	}
+	spend, _, err := snap.convert(charge, from, to)
+	return spend, err
+}
+
+//chargeAllowance draws rated usage from the subscriber's bundles and monthly
+//allowance. It flags overage on the subscriber when the threshold is crossed
+//and returns the events of what changed.
+func chargeAllowance(stub shim.ChaincodeStubInterface, rs *rsDetailBlock, service string, used int64, charge Money, currency string, at time.Time) ([]RoamingEvent, error) {
+	plan, found, err := getPlan(stub, rs.PublicKey)
+	if err != nil || !found {
+		return nil, err
+	}
+	month, err := getMonthlyUsage(stub, rs.PublicKey, usageMonth(at))
+	if err != nil {
+		return nil, err
+	}
+
+	//Roaming bundles first, in the order they were added
+	left := used
+	if rs.RP != "" && rs.RP != rs.HO {
+		for i := range plan.Bundles {
+			b := &plan.Bundles[i]
+			if left == 0 || !b.appliesTo(rs.RP, at) {
+				continue
+			}
+			free := b.Allowance.units(service) - b.Used.units(service)
+			if free <= 0 {
+				continue
+			}
+			if free > left {
+				free = left
+			}
+			b.Used.add(service, free)
+			left -= free
+		}
+		if err = putPlan(stub, plan); err != nil {
+			return nil, err
+		}
+	}
+	month.Used.add(service, left)
+	if plan.Currency != "" {
+		spend, err := spendIn(stub, rs.HO, charge, currency, plan.Currency, at)
+		if err != nil {
+			return nil, err
+		}
+		month.Spend = month.Spend + spend
+	}
+
+	var events []RoamingEvent
+	threshold := plan.OverageThreshold
+	if threshold == 0 {
+		threshold = defaultOverageThreshold
+	}
+	if !month.Overage[allowanceOf(service)] && month.Used.units(service) > 0 &&
+		month.Used.units(service)*100 >= plan.Monthly.units(service)*int64(threshold) {
+		if month.Overage == nil {
+			month.Overage = map[string]bool{}
+		}
+		month.Overage[allowanceOf(service)] = true
+		rs.addFlag(flagOverage)
+		fmt.Println("Overage of " + rs.PublicKey + " on " + service)
+		events = append(events, newEvent(stub, eventOverage, *rs, at, OverageEvent{Flag: flagOverage, Service: service, Month: month.Month}))
+	}
+	if !month.Capped {
+		reason := ""
+		if plan.HardCap && month.Used.VoiceSeconds > 0 && month.Used.VoiceSeconds >= plan.Monthly.units(rateVoiceOut) {
+			reason = "voice allowance used up"
+		} else if plan.SpendingLimit > 0 && month.Spend >= plan.SpendingLimit {
+			reason = "spending limit of " + plan.SpendingLimit.String() + " " + plan.Currency + " reached"
+		}
+		if reason != "" {
+			month.Capped = true
+			fmt.Println("Capped " + rs.PublicKey + ": " + reason)
+			events = append(events, newEvent(stub, eventUsageCapped, *rs, at, CapEvent{Month: month.Month, Reason: reason}))
+		}
+	}
+	return events, putMonthlyUsage(stub, month)
+}
+
+//requireNotCapped rejects new outgoing calls of a subscriber that hit its hard cap or spending limit
+func requireNotCapped(stub shim.ChaincodeStubInterface, rs rsDetailBlock, at time.Time) error {
+	month, err := getMonthlyUsage(stub, rs.PublicKey, usageMonth(at))
+	if err != nil {
+		return err
+	}
+	if month.Capped {
+		fmt.Println("Error - " + rs.PublicKey + " is capped for " + month.Month)
+		return conflictError("Outgoing calls of " + rs.PublicKey + " are blocked for " + month.Month + ", the plan limit is reached")
+	}
+	return nil
+}
+
+/*		0
+	json
+	{
+		"publickey": "rs1",
+		"name": "Travel 500",
+		"monthly": {"voiceMinutes": 500, "sms": 100, "dataMB": 2048},
+		"bundles": [],                                 (optional, see addBundle)
+		"overageThreshold": 80,                        (percent, default 100)
+		"hardCap": true,                               (optional)
+		"spendingLimit": "50.00",                      (optional)
+		"currency": "EUR"
+	}
+*/
+func (t *SimpleChaincode) setPlan(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Setting plan")
+	if err := checkArgs("setPlan", args, 1, "plan record"); err != nil {
+		return nil, err
+	}
+	var plan Plan
+	if err := json.Unmarshal([]byte(args[0]), &plan); err != nil {
+		return nil, validationError("Invalid plan: " + err.Error())
+	}
+	if err := plan.validate(); err != nil {
+		return nil, err
+	}
+	rs, err := getSubscriber(stub, plan.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	//The home operator sells the plan
+	if err = requireOperatorOrRole(stub, "set the plan of "+rs.PublicKey, []string{rs.HO}, roleAdmin); err != nil {
+		return nil, err
+	}
+	//Only chargeAllowance counts what bundles used, a bundle the plan already
+	//had keeps its count and any other starts from zero
+	old, found, err := getPlan(stub, plan.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	for i := range plan.Bundles {
+		b := &plan.Bundles[i]
+		b.Used = Usage{}
+		for _, prev := range old.Bundles {
+			if found && prev.Name == b.Name && prev.RP == b.RP && prev.ValidFrom.Equal(b.ValidFrom) {
+				b.Used = prev.Used
+			}
+		}
+	}
+	return nil, putPlan(stub, plan)
+}
+
+/*		0		1
+	key		json
+	"rs1"	{
+				"name": "EU week",
+				"rp": "XYZ",                           (empty for any roaming partner)
+				"allowance": {"voiceMinutes": 60, "sms": 50, "dataMB": 1024},
+				"validFrom": "2017-01-01T00:00:00Z",
+				"validTo": "2017-01-08T00:00:00Z"
+			}
+*/
+func (t *SimpleChaincode) addBundle(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Adding bundle")
+	if err := checkArgs("addBundle", args, 2, "subscriber key and bundle record"); err != nil {
+		return nil, err
+	}
+	var bundle Bundle
+	if err := json.Unmarshal([]byte(args[1]), &bundle); err != nil {
+		return nil, validationError("Invalid bundle: " + err.Error())
+	}
+	bundle.Used = Usage{}
+	if err := bundle.validate(); err != nil {
+		return nil, err
+	}
+	rs, err := getSubscriber(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = requireOperatorOrRole(stub, "add bundles for "+rs.PublicKey, []string{rs.HO}, roleAdmin); err != nil {
+		return nil, err
+	}
+	plan, found, err := getPlan(stub, rs.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, notFoundError("Subscriber " + rs.PublicKey + " has no plan")
+	}
+	plan.Bundles = append(plan.Bundles, bundle)
+	return nil, putPlan(stub, plan)
+}
+
+//Query the plan of a subscriber and its usage in a month
+//	args: subscriber key, month (YYYY-MM)
+func (t *SimpleChaincode) queryAllowance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("queryAllowance called")
+	if err := checkArgs("queryAllowance", args, 2, "subscriber key and month"); err != nil {
+		return nil, err
+	}
+	month := args[1]
+	if _, err := time.Parse("2006-01", month); err != nil {
+		return nil, validationError("Invalid month " + month + ", expecting YYYY-MM")
+	}
+	rs, err := getSubscriber(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = requireSubscriberRead(stub, rs); err != nil {
+		return nil, err
+	}
+	plan, found, err := getPlan(stub, rs.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, notFoundError("Subscriber " + rs.PublicKey + " has no plan")
+	}
+	usage, err := getMonthlyUsage(stub, rs.PublicKey, month)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(AllowanceStatus{Plan: plan, Usage: usage, Remaining: remaining(plan.Monthly, usage.Used)})
+}
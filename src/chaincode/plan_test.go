@@ -0,0 +1,140 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSpendingLimitCountsConvertedCharges(t *testing.T) {
+	l := newTestLedger(t)
+	l.asOperator("ABC")
+	l.mustInvoke("setPlan", `{"publickey": "rs1", "name": "Capped", "monthly": {"voiceMinutes": 500},
+		"spendingLimit": "10", "currency": "USD"}`)
+	l.mustInvoke("publishRates", `{"operator": "ABC", "base": "USD",
+		"effectiveFrom": "2017-01-01T00:00:00Z", "rates": [{"currency": "EUR", "rate": "1.10"}]}`)
+	//The roaming partner charges EUR, 5.00 a minute
+	l.roam("rs1", "XYZ")
+	l.call("rs1", "4930123456", time.Minute)
+	l.call("rs1", "4930123456", time.Minute)
+
+	var status AllowanceStatus
+	l.asOperator("ABC").mustQuery(&status, "queryAllowance", "rs1", "2017-03")
+	if status.Usage.Spend.String() != "11.0000" || !status.Usage.Capped {
+		t.Fatalf("spend %s USD, capped %v; want 11.0000 USD and capped", status.Usage.Spend, status.Usage.Capped)
+	}
+	l.asOperator("XYZ").mustFail(codeStateConflict, "CallOut", "rs1", "4930123456")
+}
+
+func TestFraudAndOverageFlagsAreKept(t *testing.T) {
+	l := newTestLedger(t)
+	l.asOperator("ABC").mustInvoke("setPlan", `{"publickey": "rs1", "name": "Small", "monthly": {"voiceMinutes": 1}}`)
+	l.asOperator("XYZ").mustInvoke("registerCoverage", `{"areaId": "DE", "operator": "XYZ", "country": "DE",
+		"box": {"minLat": 47.27, "minLong": 5.87, "maxLat": 55.06, "maxLong": 15.04}}`)
+	l.mustInvoke("discoverRP", "rs1", "XYZ", "DALLAS", "32.94", "-96.99")
+	l.mustInvoke("authentication", "rs1")
+	l.mustInvoke("updateRates", "rs1")
+	l.call("rs1", "4930123456", time.Minute)
+
+	if rs := l.subscriber("rs1"); !rs.hasFlag(flagFraud) || !rs.hasFlag(flagOverage) || len(rs.Flags) != 2 {
+		t.Fatalf("flags %v, want Fraud and OVERAGE", rs.Flags)
+	}
+	l.asRole(roleAuditor)
+	for _, flag := range []string{flagFraud, flagOverage} {
+		var page SubscriberPage
+		l.mustQuery(&page, "listFlagged", flag)
+		if len(page.Subscribers) != 1 || page.Subscribers[0].PublicKey != "rs1" {
+			t.Errorf("listFlagged %s: %+v", flag, page.Subscribers)
+		}
+	}
+}
+
+func TestLegacyFlagIsKept(t *testing.T) {
+	rs := rsDetailBlock{Flag: flagFraud}
+	rs.addFlag(flagOverage)
+	rs.addFlag(flagOverage)
+	if rs.Flag != "" || len(rs.Flags) != 2 || !rs.hasFlag(flagFraud) || !rs.hasFlag(flagOverage) {
+		t.Errorf("flag %q, flags %v", rs.Flag, rs.Flags)
+	}
+}
+
+func TestSetPlanIgnoresUsedCounters(t *testing.T) {
+	l := newTestLedger(t)
+	plan := `{"publickey": "rs1", "name": "Travel", "monthly": {"voiceMinutes": 100},
+		"bundles": [{"name": "EU week", "rp": "XYZ", "allowance": {"voiceMinutes": 60},
+			"validFrom": "2017-03-01T00:00:00Z", "validTo": "2017-03-08T00:00:00Z", "used": {"voiceSeconds": -600}}]}`
+	l.asOperator("ABC").mustInvoke("setPlan", plan)
+	if p, _, _ := getPlan(l.stub, "rs1"); p.Bundles[0].Used != (Usage{}) {
+		t.Fatalf("setPlan took the used counters of the caller: %+v", p.Bundles[0].Used)
+	}
+	l.roam("rs1", "XYZ")
+	l.call("rs1", "4930123456", 2*time.Minute)
+	l.asOperator("ABC").mustInvoke("setPlan", plan)
+	if p, _, _ := getPlan(l.stub, "rs1"); p.Bundles[0].Used.VoiceSeconds != 120 {
+		t.Errorf("setPlan again reset the bundle to %+v, want the 120 seconds used", p.Bundles[0].Used)
+	}
+}
+
+func TestOverageIsFlaggedPerService(t *testing.T) {
+	l := newTestLedger(t)
+	l.asOperator("ABC").mustInvoke("setPlan", `{"publickey": "rs1", "name": "Small", "monthly": {"voiceMinutes": 1, "sms": 2, "dataMB": 100}}`)
+	l.asOperator("ABC").mustFail(codeValidation, "setPlan", `{"publickey": "rs1", "name": "Small", "overageThreshold": 101}`)
+	l.roam("rs1", "XYZ")
+	overages := func() []string {
+		var services []string
+		for _, e := range l.events() {
+			if e.Name != eventOverage {
+				continue
+			}
+			var overage OverageEvent
+			if err := json.Unmarshal(e.Data, &overage); err != nil {
+				t.Fatalf("decoding overage %s: %v", e.Data, err)
+			}
+			services = append(services, overage.Service)
+		}
+		return services
+	}
+
+	l.call("rs1", "4930123456", time.Minute)
+	if got := overages(); len(got) != 1 || got[0] != rateVoiceOut {
+		t.Fatalf("overages after the voice allowance %v, want %s", got, rateVoiceOut)
+	}
+	l.mustInvoke("CallIn", "rs1", "4930123456")
+	l.advance(time.Minute)
+	l.mustInvoke("CallEnd", "rs1")
+	l.mustInvoke("CallPay", "rs1")
+	if got := overages(); len(got) != 0 {
+		t.Fatalf("voice overage raised again by an incoming call: %v", got)
+	}
+	l.mustInvoke("SMSOut", "rs1", "4930123456")
+	if got := overages(); len(got) != 0 {
+		t.Fatalf("overages with an SMS left %v", got)
+	}
+	l.mustInvoke("SMSOut", "rs1", "4930123456")
+	if got := overages(); len(got) != 1 || got[0] != rateSMS {
+		t.Fatalf("overages after the SMS allowance %v, want %s", got, rateSMS)
+	}
+
+	var status AllowanceStatus
+	l.asOperator("ABC").mustQuery(&status, "queryAllowance", "rs1", "2017-03")
+	if len(status.Usage.Overage) != 2 || !status.Usage.Overage[serviceVoice] || !status.Usage.Overage[serviceSMS] {
+		t.Errorf("overage of %v, want voice and SMS", status.Usage.Overage)
+	}
+}
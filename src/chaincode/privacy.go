@@ -0,0 +1,331 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// The home operator protects the personal data of a subscriber before it is
+// submitted, see the pii package. Transactions are kept by every peer for
+// good, so enterData only takes the sealed blob with a commitment per field,
+// and of the MSISDN its masked form and its digest, see queryMSISDNDigest.
+// The name, address, number and home position are in the blob only.
+//
+// World state holds numbers masked, in subscribers, CDRs, usage records,
+// fraud cases and attachments alike. Records written before that may still
+// hold them in clear, the views below mask them for everyone but the home
+// operator. Positions reported by discoverRP must be rounded to
+// positionDecimals, enough for fraud checks.
+//
+// Fixtures are for demo and test data, their subscribers come with the
+// number and position in clear in the transaction that loads them.
+//
+// The numbers of the other party of a call or SMS are arguments of CallOut,
+// CallIn, SMSOut and SMSIn and so are in those transactions in clear, world
+// state only keeps them masked.
+//
+// Only the home operator sees a subscriber as stored, everyone else gets a
+// redacted view without the blob.
+var piiFields = []string{"name", "address", "msisdn", "lat", "long"}
+
+// Keys never hold an MSISDN in clear. The index and attachment records name
+// it by its HMAC-SHA256 under a key that Init generates once and keeps in
+// world state. Every peer can read that key, so whoever has the state
+// database can still recompute digests and, phone numbers being few, reverse
+// them. The digests keep numbers out of key listings, dumps and logs, they
+// are not access control.
+var (
+	configPrefix = "config:"
+	msisdnKeyKey = configPrefix + "msisdnkey"
+)
+
+// Two decimals of a degree are about a kilometre
+const positionDecimals = 2
+
+// Numbers are masked down to their last maskKeep digits
+const maskKeep = 4
+
+var maskedPattern = regexp.MustCompile(`^\*+[0-9]{0,4}$`)
+
+// PIICommitment is the HMAC-SHA256 of one field under a salt the home operator keeps
+type PIICommitment struct {
+	Field string `json:"field"`
+	Hash  string `json:"hash"`
+}
+
+// PIIEnvelope is the protected personal data of a subscriber
+type PIIEnvelope struct {
+	Blob        string          `json:"blob,omitempty"`
+	Commitments []PIICommitment `json:"commitments"`
+}
+
+//parsePIIEnvelope reads the pii argument of enterData, it needs a blob and a
+//commitment for every field in order
+func parsePIIEnvelope(arg string) (*PIIEnvelope, error) {
+	var env PIIEnvelope
+	if err := json.Unmarshal([]byte(arg), &env); err != nil {
+		return nil, validationError("Invalid PII envelope: " + err.Error())
+	}
+	if _, err := base64.StdEncoding.DecodeString(env.Blob); err != nil || env.Blob == "" {
+		return nil, validationError("PII envelope needs a base64 blob")
+	}
+	if len(env.Commitments) != len(piiFields) {
+		return nil, validationError("PII envelope needs commitments for " + strings.Join(piiFields, ", "))
+	}
+	for i, c := range env.Commitments {
+		if c.Field != piiFields[i] {
+			return nil, validationError("PII envelope needs commitments for " + strings.Join(piiFields, ", "))
+		}
+		if !sha256Pattern.MatchString(c.Hash) {
+			return nil, validationError("Commitment of " + c.Field + " is not a hex HMAC-SHA256")
+		}
+	}
+	return &env, nil
+}
+
+//initMSISDNKey generates the MSISDN key unless the ledger already has one,
+//from the transaction so that every peer derives the same key
+func initMSISDNKey(stub shim.ChaincodeStubInterface) error {
+	existing, err := stub.GetState(msisdnKeyKey)
+	if err != nil {
+		return internalError("Error retrieving " + msisdnKeyKey)
+	}
+	if existing != nil {
+		return nil
+	}
+	at, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	key := sha256.Sum256([]byte(stub.GetTxID() + "|" + at.Format(time.RFC3339Nano)))
+	if err = stub.PutState(msisdnKeyKey, key[:]); err != nil {
+		return internalError("Error writing " + msisdnKeyKey)
+	}
+	return nil
+}
+
+//msisdnDigest is the hex HMAC-SHA256 an MSISDN is keyed by
+func msisdnDigest(stub shim.ChaincodeStubInterface, msisdn string) (string, error) {
+	key, err := stub.GetState(msisdnKeyKey)
+	if err != nil {
+		return "", internalError("Error retrieving " + msisdnKeyKey)
+	}
+	if key == nil {
+		return "", internalError("The MSISDN key is missing, the ledger was not initialised")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msisdn))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+//subscriberDigest is the digest of the MSISDN of a subscriber. Records
+//written before only the digest was kept have the number in clear.
+func subscriberDigest(stub shim.ChaincodeStubInterface, rs rsDetailBlock) (string, error) {
+	if rs.MSISDNDigest != "" {
+		return rs.MSISDNDigest, nil
+	}
+	return msisdnDigest(stub, rs.MSISDN)
+}
+
+//parseMaskedMSISDN checks the masked MSISDN and digest enterData takes in place of the number
+func parseMaskedMSISDN(masked string, digest string) error {
+	if !maskedPattern.MatchString(masked) {
+		return validationError("MSISDN " + masked + " is not masked, expecting e.g. *******4567")
+	}
+	if !sha256Pattern.MatchString(digest) {
+		return validationError("MSISDN digest is not a hex HMAC-SHA256, see queryMSISDNDigest")
+	}
+	return nil
+}
+
+//coarse reports whether a position has no more than positionDecimals decimals
+func (p GeoPoint) coarse() bool {
+	return coarsePosition(p.Lat) == p.Lat && coarsePosition(p.Long) == p.Long
+}
+
+//coarsePosition rounds a latitude or longitude to positionDecimals
+func coarsePosition(d Degrees) Degrees {
+	v, _ := strconv.ParseFloat(strconv.FormatFloat(float64(d), 'f', positionDecimals, 64), 64)
+	return Degrees(v)
+}
+
+//mask replaces all but the last maskKeep characters of a number with '*'
+func mask(s string) string {
+	if len(s) <= maskKeep {
+		return strings.Repeat("*", len(s))
+	}
+	return strings.Repeat("*", len(s)-maskKeep) + s[len(s)-maskKeep:]
+}
+
+// MSISDNDigest is the result of queryMSISDNDigest
+type MSISDNDigest struct {
+	MSISDN string `json:"msisdn"`
+	Digest string `json:"digest"`
+}
+
+//Mask an MSISDN and compute its digest, the form enterData takes it in. A
+//query is answered by the peer and not recorded, unlike the arguments of an invoke.
+//	args: msisdn
+func (t *SimpleChaincode) queryMSISDNDigest(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("queryMSISDNDigest called")
+	if err := checkArgs("queryMSISDNDigest", args, 1, "msisdn"); err != nil {
+		return nil, err
+	}
+	if err := requireRole(stub, "digest MSISDNs", roleOperator); err != nil {
+		return nil, err
+	}
+	digest, err := msisdnDigest(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(MSISDNDigest{MSISDN: mask(args[0]), Digest: digest})
+}
+
+//redactSubscriber drops what only the home operator may see
+func redactSubscriber(rs rsDetailBlock) rsDetailBlock {
+	rs.Name = ""
+	rs.Address = ""
+	rs.MSISDN = mask(rs.MSISDN)
+	rs.IMSI = mask(rs.IMSI)
+	rs.ICCID = mask(rs.ICCID)
+	rs.Destination = mask(rs.Destination)
+	rs.Lat = coarsePosition(rs.Lat)
+	rs.Long = coarsePosition(rs.Long)
+	if rs.PII != nil {
+		rs.PII = &PIIEnvelope{Commitments: rs.PII.Commitments}
+	}
+	return rs
+}
+
+//subscriberView is the subscriber as the caller may see it
+func subscriberView(stub shim.ChaincodeStubInterface, rs rsDetailBlock) rsDetailBlock {
+	if isOperator(stub, rs.HO) {
+		return rs
+	}
+	return redactSubscriber(rs)
+}
+
+//cdrViews masks the numbers in the CDRs of a subscriber unless the caller is
+//its home operator, CDRs written before numbers were masked in state have them in clear
+func cdrViews(stub shim.ChaincodeStubInterface, ho string, cdrs []callDetailRecord) []callDetailRecord {
+	if isOperator(stub, ho) {
+		return cdrs
+	}
+	views := make([]callDetailRecord, len(cdrs))
+	for i, cdr := range cdrs {
+		cdr.MSISDN = mask(cdr.MSISDN)
+		cdr.CallingParty = mask(cdr.CallingParty)
+		cdr.Destination = mask(cdr.Destination)
+		views[i] = cdr
+	}
+	return views
+}
+
+//usageViews masks the numbers in the usage records of a subscriber unless
+//the caller is its home operator, for records written before they were masked in state
+func usageViews(stub shim.ChaincodeStubInterface, ho string, usage UsageRecords) UsageRecords {
+	if isOperator(stub, ho) {
+		return usage
+	}
+	views := UsageRecords{DataSessions: make([]DataSessionRecord, len(usage.DataSessions)), SMS: make([]SMSRecord, len(usage.SMS))}
+	for i, rec := range usage.DataSessions {
+		rec.MSISDN = mask(rec.MSISDN)
+		views.DataSessions[i] = rec
+	}
+	for i, rec := range usage.SMS {
+		rec.MSISDN = mask(rec.MSISDN)
+		rec.CallingParty = mask(rec.CallingParty)
+		rec.Destination = mask(rec.Destination)
+		views.SMS[i] = rec
+	}
+	return views
+}
+
+//fraudCaseView masks the MSISDN of a fraud case, also where the notes quote
+//it, unless the caller is the home operator
+func fraudCaseView(stub shim.ChaincodeStubInterface, fc FraudCase) FraudCase {
+	if isOperator(stub, fc.HO) || fc.MSISDN == "" {
+		return fc
+	}
+	masked := mask(fc.MSISDN)
+	fc.Details = strings.Replace(fc.Details, fc.MSISDN, masked, -1)
+	history := make([]FraudCaseNote, len(fc.History))
+	for i, note := range fc.History {
+		note.Note = strings.Replace(note.Note, fc.MSISDN, masked, -1)
+		history[i] = note
+	}
+	fc.History = history
+	fc.MSISDN = masked
+	return fc
+}
+
+// PIIVerification is the result of verifyPII
+type PIIVerification struct {
+	PublicKey string `json:"publickey"`
+	Field     string `json:"field"`
+	Match     bool   `json:"match"`
+}
+
+//Check a disclosed value of a subscriber field against its commitment. The
+//home operator hands out the value and salt, e.g. with piivault disclose.
+//	args: subscriber key, field, value, salt (base64)
+func (t *SimpleChaincode) verifyPII(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("verifyPII called")
+	if err := checkArgs("verifyPII", args, 4, "subscriber key, field, value and salt"); err != nil {
+		return nil, err
+	}
+	rs, err := getSubscriber(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = requireSubscriberRead(stub, rs); err != nil {
+		return nil, err
+	}
+	salt, err := base64.StdEncoding.DecodeString(args[3])
+	if err != nil {
+		return nil, validationError("Salt is not base64")
+	}
+	if rs.PII == nil {
+		return nil, notFoundError("Subscriber " + rs.PublicKey + " has no PII commitments")
+	}
+	hash := ""
+	for _, c := range rs.PII.Commitments {
+		if c.Field == args[1] {
+			hash = c.Hash
+		}
+	}
+	if hash == "" {
+		return nil, validationError("Unknown field " + args[1] + ", expecting one of " + strings.Join(piiFields, ", "))
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(args[2]))
+	match := hmac.Equal([]byte(hash), []byte(hex.EncodeToString(mac.Sum(nil))))
+	return json.Marshal(PIIVerification{PublicKey: rs.PublicKey, Field: args[1], Match: match})
+}
@@ -0,0 +1,194 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The numbers of the calls the privacy tests make, rs1 calls testDestination
+const (
+	testMSISDN      = "14691234567"
+	testDestination = "4930123456"
+)
+
+//inClear reports whether data holds one of the test numbers unmasked
+func inClear(data string) bool {
+	return strings.Contains(data, testMSISDN) || strings.Contains(data, testDestination)
+}
+
+func TestNumbersStayOutOfKeysAndEvents(t *testing.T) {
+	l := newTestLedger(t)
+	l.asOperator("XYZ")
+	steps := [][]string{
+		{"discoverRP", "rs1", "XYZ", "BERLIN", "52.52", "13.40"},
+		{"authentication", "rs1"},
+		{"updateRates", "rs1"},
+		{"CallOut", "rs1", testDestination},
+		{"CallEnd", "rs1"},
+		{"CallPay", "rs1"},
+		{"CallIn", "rs1", testDestination},
+		{"CallEnd", "rs1"},
+		{"SMSOut", "rs1", testDestination},
+	}
+	for _, step := range steps {
+		l.advance(time.Minute)
+		l.mustInvoke(step[0], step[1:]...)
+		if inClear(string(l.stub.EventPayload)) {
+			t.Errorf("%s event carries a number in clear: %s", step[0], l.stub.EventPayload)
+		}
+	}
+	if e := l.events()[0]; e.MSISDN != mask(testMSISDN) {
+		t.Errorf("event MSISDN %q, want %q", e.MSISDN, mask(testMSISDN))
+	}
+
+	indexed := false
+	for key, value := range l.stub.State {
+		if inClear(key) || inClear(string(value)) {
+			t.Errorf("%s holds a number in clear: %s", key, value)
+		}
+		indexed = indexed || strings.HasPrefix(key, msisdnIndexPrefix)
+	}
+	if !indexed {
+		t.Fatalf("no MSISDN index records")
+	}
+
+	//Whoever knows the number still finds the subscriber by it
+	var found []rsDetailBlock
+	l.asOperator("ABC").mustQuery(&found, "querySubscriberByMSISDN", testMSISDN)
+	if len(found) != 1 || found[0].PublicKey != "rs1" || found[0].MSISDN != mask(testMSISDN) {
+		t.Errorf("querySubscriberByMSISDN found %+v", found)
+	}
+	l.mustQuery(&found, "querySubscriberByMSISDN", testMSISDN, "ABC")
+	if len(found) != 1 || found[0].PublicKey != "rs1" {
+		t.Errorf("querySubscriberByMSISDN of ABC found %+v", found)
+	}
+	var attachment Attachment
+	l.mustQuery(&attachment, "queryAttachment", testMSISDN)
+	if attachment.PublicKey != "rs1" || attachment.MSISDN != mask(testMSISDN) {
+		t.Errorf("attachment %+v", attachment)
+	}
+}
+
+func TestDumpStateMasksNumbers(t *testing.T) {
+	l := newTestLedger(t)
+	l.asOperator("ABC").mustInvoke("enterData", l.enterArgs("rs1", testMSISDN, "ABC")...)
+	l.roam("rs1", "XYZ")
+	l.call("rs1", testDestination, time.Minute)
+	l.mustInvoke("SMSOut", "rs1", testDestination)
+
+	var records []StateRecord
+	l.asRole(roleAuditor).mustQuery(&records, "dumpState", "sub:", "cdr:", "sms:")
+	kinds := map[string]int{}
+	for _, rec := range records {
+		kinds[strings.SplitN(rec.Key, ":", 2)[0]]++
+		if inClear(string(rec.Value)) || strings.Contains(string(rec.Value), "c2VhbGVk") {
+			t.Errorf("dump of %s holds personal data: %s", rec.Key, rec.Value)
+		}
+	}
+	if kinds["sub"] != 7 || kinds["cdr"] != 1 || kinds["sms"] != 1 {
+		t.Errorf("dumped %v", kinds)
+	}
+
+	for _, prefix := range []string{"subidx:", "subidx:msisdn:", "s", "attach:", "location:rs1:", "config:"} {
+		_, err := l.stub.MockQuery("dumpState", []string{"operator:", prefix})
+		if ce, ok := err.(*ChaincodeError); !ok || ce.Code != codeUnauthorized {
+			t.Errorf("dumpState %q: got %v, want an unauthorized error", prefix, err)
+		}
+	}
+
+	var subscribers []rsDetailBlock
+	l.mustQuery(&subscribers, "listSubscribersByOperator", "ABC")
+	for _, rs := range subscribers {
+		if inClear(rs.MSISDN) || rs.PII != nil && rs.PII.Blob != "" {
+			t.Errorf("auditor lists %s with MSISDN %s and PII %+v", rs.PublicKey, rs.MSISDN, rs.PII)
+		}
+	}
+	l.asOperator("ABC").mustQuery(&subscribers, "listSubscribersByOperator", "ABC")
+	if subscribers[0].MSISDN != mask(testMSISDN) || subscribers[0].PII == nil || subscribers[0].PII.Blob == "" {
+		t.Errorf("home operator lists %+v", subscribers[0])
+	}
+}
+
+func TestFraudCasesMaskTheNumberForThePartner(t *testing.T) {
+	l := newTestLedger(t)
+	l.asOperator("XYZ").mustInvoke("registerCoverage", `{"areaId": "DE", "operator": "XYZ", "country": "DE",
+		"box": {"minLat": 47.27, "minLong": 5.87, "maxLat": 55.06, "maxLong": 15.04}}`)
+	l.mustInvoke("discoverRP", "rs1", "XYZ", "DALLAS", "32.94", "-96.99")
+	if events := l.events(); len(events) != 2 || events[1].Name != eventFraudFlagged || events[1].MSISDN != mask(testMSISDN) {
+		t.Errorf("events %s", l.stub.EventPayload)
+	}
+
+	var cases []FraudCase
+	l.mustQuery(&cases, "queryFraudCases", "rs1")
+	if len(cases) != 1 || cases[0].MSISDN != mask(testMSISDN) {
+		t.Fatalf("roaming partner reads cases %+v", cases)
+	}
+	var fc FraudCase
+	l.mustQuery(&fc, "queryFraudCase", cases[0].CaseID)
+	if fc.MSISDN != mask(testMSISDN) {
+		t.Errorf("roaming partner reads case MSISDN %s", fc.MSISDN)
+	}
+	var stored FraudCase
+	bytes, _ := l.stub.GetState(fraudKey(fc.CaseID))
+	if json.Unmarshal(bytes, &stored); stored.MSISDN != mask(testMSISDN) {
+		t.Errorf("case stored with MSISDN %s", stored.MSISDN)
+	}
+	var records []StateRecord
+	l.asRole(roleAuditor).mustQuery(&records, "dumpState", "fraud:")
+	if len(records) != 1 || inClear(string(records[0].Value)) {
+		t.Errorf("fraud dump %+v", records)
+	}
+}
+
+func TestFraudCaseViewMasksQuotedNumbers(t *testing.T) {
+	l := newTestLedger(t)
+	fc := FraudCase{MSISDN: testMSISDN, HO: "ABC", Details: "MSISDN " + testMSISDN + " is already attached",
+		History: []FraudCaseNote{{Note: "MSISDN " + testMSISDN + " is already attached"}}}
+	view := fraudCaseView(l.asOperator("XYZ").stub, fc)
+	if inClear(view.Details) || inClear(view.History[0].Note) || view.MSISDN != mask(testMSISDN) {
+		t.Errorf("view %+v", view)
+	}
+	if !inClear(fc.History[0].Note) {
+		t.Errorf("the view changed the stored notes")
+	}
+}
+
+func TestEnterDataTakesNoNumberOrPositionInClear(t *testing.T) {
+	l := newTestLedger(t)
+	l.asOperator("ABC")
+	var digest MSISDNDigest
+	l.mustQuery(&digest, "queryMSISDNDigest", testMSISDN)
+	if args := l.enterArgs("rs8", testMSISDN, "ABC"); digest.MSISDN != args[1] || digest.Digest != args[2] {
+		t.Errorf("queryMSISDNDigest %+v, enterData takes %v", digest, args[1:3])
+	}
+	if _, err := l.asRole(roleAuditor).stub.MockQuery("queryMSISDNDigest", []string{testMSISDN}); err == nil {
+		t.Errorf("an auditor digested an MSISDN")
+	}
+
+	l.asOperator("ABC")
+	l.mustFail(codeValidation, "enterData", "rs8", testMSISDN, digest.Digest, "ABC", testEnvelope())
+	l.mustFail(codeValidation, "enterData", "rs8", digest.MSISDN, "not a digest", "ABC", testEnvelope())
+	//Under the old arguments the position went where the envelope is now
+	l.mustFail(codeValidation, "enterData", "rs8", digest.MSISDN, digest.Digest, "ABC", "32.94", "-96.99", testEnvelope())
+	l.asOperator("XYZ").mustFail(codeValidation, "discoverRP", "rs1", "XYZ", "BERLIN", "52.5212", "13.40")
+	l.mustFail(codeValidation, "discoverRP", "rs1", "XYZ", "BERLIN", "52.52", "13.4049")
+}
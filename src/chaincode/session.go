@@ -0,0 +1,163 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Session states of a subscriber. The roaming call flow is
+//
+//	Idle -> discoverRP -> Discovered -> authentication -> Authenticated
+//	     -> updateRates -> RatesRegistered -> CallOut or CallIn -> InCall
+//	     -> CallEnd -> CallEnded -> CallPay -> RatesRegistered
+//
+// A subscriber on its home network skips discovery and authenticates from
+// Idle. A failed authentication leaves the subscriber Discovered. A
+// subscriber forgotten with forgetSubscriber stays Forgotten for good.
+//
+// Data sessions run alongside the call flow without a state of their own,
+// but a subscriber can not be discovered on another network while one is
+// open: only the network that opened it may end it.
+const (
+	stateIdle            = "Idle"
+	stateDiscovered      = "Discovered"
+	stateAuthenticated   = "Authenticated"
+	stateRatesRegistered = "RatesRegistered"
+	stateInCall          = "InCall"
+	stateCallEnded       = "CallEnded"
+	stateForgotten       = "Forgotten"
+)
+
+// A transition moves a subscriber from any of the from states to the to state
+type transition struct {
+	action string
+	from   []string
+	to     string
+}
+
+// Kept in call flow order, allowedActions lists the next actions in this order
+var sessionTransitions = []transition{
+	{"discoverRP", []string{stateIdle, stateDiscovered, stateAuthenticated, stateRatesRegistered}, stateDiscovered},
+	{"authentication", []string{stateIdle, stateDiscovered, stateAuthenticated, stateRatesRegistered}, stateAuthenticated},
+	{"updateRates", []string{stateAuthenticated, stateRatesRegistered}, stateRatesRegistered},
+	{"CallOut", []string{stateRatesRegistered}, stateInCall},
+	{"CallIn", []string{stateRatesRegistered}, stateInCall},
+	{"CallEnd", []string{stateInCall}, stateCallEnded},
+	{"CallPay", []string{stateCallEnded}, stateRatesRegistered},
+}
+
+// SessionState is the result of querySessionState
+type SessionState struct {
+	PublicKey      string   `json:"publickey"`
+	State          string   `json:"state"`
+	AllowedActions []string `json:"allowedActions"`
+}
+
+//sessionState is the state of a subscriber. Records written before the state
+//machine existed have none and start over as Idle.
+func sessionState(rs rsDetailBlock) string {
+	if rs.State == "" {
+		return stateIdle
+	}
+	return rs.State
+}
+
+//allowedActions lists the actions a subscriber in the state may take next
+func allowedActions(state string) []string {
+	actions := []string{}
+	for _, tr := range sessionTransitions {
+		for _, from := range tr.from {
+			if from == state {
+				actions = append(actions, tr.action)
+				break
+			}
+		}
+	}
+	return actions
+}
+
+//advance moves the subscriber on by action, rejecting actions its current state does not allow
+func advance(rs *rsDetailBlock, action string) error {
+	state := sessionState(*rs)
+	for _, tr := range sessionTransitions {
+		if tr.action != action {
+			continue
+		}
+		for _, from := range tr.from {
+			if from != state {
+				continue
+			}
+			if action == "discoverRP" && rs.CurrentData != "" {
+				return conflictError(action + " is not allowed for " + rs.PublicKey + " while data session " +
+					rs.CurrentData + " is open, end it first")
+			}
+			rs.State = tr.to
+			return nil
+		}
+	}
+	allowed := allowedActions(state)
+	fmt.Println("Error - " + action + " not allowed for " + rs.PublicKey + " in state " + state)
+	return conflictError(action + " is not allowed for " + rs.PublicKey + " in state " + state +
+		", allowed next: " + strings.Join(allowed, ", "))
+}
+
+//requireRatesRegistered passes subscribers that have registered rates, data
+//sessions and SMS need that but run alongside calls without changing the state
+func requireRatesRegistered(rs rsDetailBlock, action string) error {
+	state := sessionState(rs)
+	if state == stateRatesRegistered || state == stateInCall || state == stateCallEnded {
+		return nil
+	}
+	return conflictError("Can not " + action + " of " + rs.PublicKey + " in state " + state + ", rates are not registered")
+}
+
+//openSession describes the call or data session a subscriber has open, or is
+//"" if there is none. A call is open until it is charged.
+func openSession(rs rsDetailBlock) string {
+	state := sessionState(rs)
+	if state == stateInCall || state == stateCallEnded {
+		return "call " + rs.CurrentCDR
+	}
+	if rs.CurrentData != "" {
+		return "data session " + rs.CurrentData
+	}
+	return ""
+}
+
+//Query the session state of a subscriber and the actions it may take next
+//	args: subscriber key
+func (t *SimpleChaincode) querySessionState(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("querySessionState called")
+	if err := checkArgs("querySessionState", args, 1, "subscriber key"); err != nil {
+		return nil, err
+	}
+	rs, err := getSubscriber(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = requireSubscriberRead(stub, rs); err != nil {
+		return nil, err
+	}
+	state := sessionState(rs)
+	return json.Marshal(SessionState{PublicKey: rs.PublicKey, State: state, AllowedActions: allowedActions(state)})
+}
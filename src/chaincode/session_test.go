@@ -0,0 +1,80 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionTransitions(t *testing.T) {
+	l := newTestLedger(t)
+	steps := []struct {
+		operator string
+		function string
+		args     []string
+		code     string // "" when the step is allowed
+		state    string // state after the step
+	}{
+		{"ABC", "CallOut", []string{"rs1", "4930123456"}, codeStateConflict, stateIdle},
+		{"ABC", "updateRates", []string{"rs1"}, codeStateConflict, stateIdle},
+		{"ABC", "CallEnd", []string{"rs1"}, codeStateConflict, stateIdle},
+		{"XYZ", "discoverRP", []string{"rs1", "XYZ", "BERLIN", "52.52", "13.40"}, "", stateDiscovered},
+		{"XYZ", "updateRates", []string{"rs1"}, codeStateConflict, stateDiscovered},
+		{"XYZ", "CallIn", []string{"rs1", "4930123456"}, codeStateConflict, stateDiscovered},
+		{"XYZ", "authentication", []string{"rs1"}, "", stateAuthenticated},
+		{"XYZ", "CallPay", []string{"rs1"}, codeStateConflict, stateAuthenticated},
+		{"XYZ", "updateRates", []string{"rs1"}, "", stateRatesRegistered},
+		{"XYZ", "CallEnd", []string{"rs1"}, codeStateConflict, stateRatesRegistered},
+		{"XYZ", "CallOut", []string{"rs1", "4930123456"}, "", stateInCall},
+		{"XYZ", "CallOut", []string{"rs1", "4930123456"}, codeStateConflict, stateInCall},
+		{"XYZ", "discoverRP", []string{"rs1", "XYZ", "BERLIN", "52.52", "13.40"}, codeStateConflict, stateInCall},
+		{"XYZ", "authentication", []string{"rs1"}, codeStateConflict, stateInCall},
+		{"XYZ", "CallEnd", []string{"rs1"}, "", stateCallEnded},
+		{"XYZ", "CallIn", []string{"rs1", "4930123456"}, codeStateConflict, stateCallEnded},
+		{"XYZ", "CallPay", []string{"rs1"}, "", stateRatesRegistered},
+		{"XYZ", "DataSessionStart", []string{"rs1"}, "", stateRatesRegistered},
+		{"XYZ", "discoverRP", []string{"rs1", "XYZ", "BERLIN", "52.52", "13.40"}, codeStateConflict, stateRatesRegistered},
+		{"XYZ", "CallIn", []string{"rs1", "4930123456"}, "", stateInCall},
+		{"XYZ", "CallEnd", []string{"rs1"}, "", stateCallEnded},
+		{"XYZ", "CallPay", []string{"rs1"}, "", stateRatesRegistered},
+		{"XYZ", "DataSessionEnd", []string{"rs1", "1048576"}, "", stateRatesRegistered},
+		{"XYZ", "discoverRP", []string{"rs1", "XYZ", "BERLIN", "52.52", "13.40"}, "", stateDiscovered},
+		{"XYZ", "authentication", []string{"rs1"}, "", stateAuthenticated},
+	}
+	for i, step := range steps {
+		l.asOperator(step.operator)
+		l.advance(time.Minute)
+		_, err := l.invoke(step.function, step.args...)
+		if step.code == "" && err != nil {
+			t.Fatalf("step %d, %s: %v", i, step.function, err)
+		}
+		if ce, ok := err.(*ChaincodeError); step.code != "" && (!ok || ce.Code != step.code) {
+			t.Fatalf("step %d, %s: got %v, want a %s error", i, step.function, err, step.code)
+		}
+		var state SessionState
+		l.mustQuery(&state, "querySessionState", "rs1")
+		if state.State != step.state {
+			t.Fatalf("step %d, %s: state %s, want %s", i, step.function, state.State, step.state)
+		}
+		if want := strings.Join(allowedActions(step.state), ","); strings.Join(state.AllowedActions, ",") != want {
+			t.Errorf("step %d: allowed %v, want %s", i, state.AllowedActions, want)
+		}
+	}
+}
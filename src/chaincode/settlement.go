@@ -0,0 +1,597 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// A settlement statement closes a billing period between two operators. It
+// covers the roaming usage in both directions: what the subscribers of each
+// operator used on the other's network, as charged in the CDRs, data
+// sessions and SMS records. Statements are keyed by the two operators in
+// alphabetical order and the start of the period, e.g.
+// "settlement:ABC:XYZ:2017-01-01T00:00:00Z", so periods of a pair can be
+// checked for overlap with one range scan.
+//
+// A record is settled once it is on a statement of its pair. Usage that was
+// charged after the period it started in was closed is carried into the
+// next statement, as are adjustments. A disputed statement is reissued by
+// closing its period again once the disputes over its calls are resolved.
+var settlementPrefix = "settlement:"
+
+// Statement status values. An Accepted statement is final and immutable.
+const (
+	statementIssued            = "Issued"
+	statementPartiallyAccepted = "PartiallyAccepted"
+	statementDisputed          = "Disputed"
+	statementAccepted          = "Accepted"
+)
+
+// LineItem sums the charged usage of one service that Debtor owes Creditor
+type LineItem struct {
+	Debtor   string `json:"debtor"`
+	Creditor string `json:"creditor"`
+	Service  string `json:"service"`
+	Currency string `json:"currency"`
+	Records  int    `json:"records"`
+	Units    int64  `json:"units"`
+	Amount   Money  `json:"amount"`
+}
+
+// CurrencyTotal nets what the operators owe each other in one currency. A
+// positive Net is owed by OperatorA to OperatorB, a negative one the other way.
+type CurrencyTotal struct {
+	Currency string `json:"currency"`
+	AOwesB   Money  `json:"aOwesB"`
+	BOwesA   Money  `json:"bOwesA"`
+	Net      Money  `json:"net"`
+	Payer    string `json:"payer"`
+	Payee    string `json:"payee"`
+}
+
+// AppliedRate is an exchange rate a statement was converted with
+type AppliedRate struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Rate Rate   `json:"rate"`
+}
+
+// SettlementTotal is what one operator of a statement receives and pays,
+// converted into its settlement currency with the exchange rates it had
+// published for the end of the period. SnapshotID and Rates are empty when
+// nothing needed converting.
+type SettlementTotal struct {
+	Operator   string        `json:"operator"`
+	Currency   string        `json:"currency"`
+	Receivable Money         `json:"receivable"`
+	Payable    Money         `json:"payable"`
+	Net        Money         `json:"net"`
+	SnapshotID string        `json:"snapshotId,omitempty"`
+	Rates      []AppliedRate `json:"rates"`
+}
+
+// StatementAction records an acceptance or dispute by one of the operators
+type StatementAction struct {
+	Operator string    `json:"operator"`
+	Action   string    `json:"action"`
+	Reason   string    `json:"reason,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// SettlementStatement of a billing period between OperatorA and OperatorB
+type SettlementStatement struct {
+	StatementID string            `json:"statementId"`
+	OperatorA   string            `json:"operatorA"`
+	OperatorB   string            `json:"operatorB"`
+	From        time.Time         `json:"from"`
+	To          time.Time         `json:"to"`
+	IssuedAt    time.Time         `json:"issuedAt"`
+	LineItems   []LineItem        `json:"lineItems"`
+	Totals      []CurrencyTotal   `json:"totals"`
+	Settlement  []SettlementTotal `json:"settlement"`
+	Records     []string          `json:"records"`
+	AcceptedByA bool              `json:"acceptedByA"`
+	AcceptedByB bool              `json:"acceptedByB"`
+	History     []StatementAction `json:"history"`
+	Status      string            `json:"status"`
+}
+
+// ratedRecord is the part of a CDR, data session or SMS record settlement needs
+type ratedRecord struct {
+	ID       string
+	HO       string
+	RP       string
+	Service  string
+	Units    int64
+	Start    time.Time
+	Charges  Money
+	Currency string
+}
+
+//operatorPair orders two operators the way statements are keyed
+func operatorPair(op1 string, op2 string) (string, string) {
+	if op2 < op1 {
+		return op2, op1
+	}
+	return op1, op2
+}
+
+func settlementPairPrefix(a string, b string) string {
+	return settlementPrefix + a + ":" + b + ":"
+}
+
+func settlementKey(a string, b string, from time.Time) string {
+	return settlementPairPrefix(a, b) + from.UTC().Format(time.RFC3339)
+}
+
+//chargedRecords calls fn with every charged roaming CDR, data session and
+//SMS, in that order and each in key order
+func chargedRecords(stub shim.ChaincodeStubInterface, fn func(rec ratedRecord) error) error {
+	roaming := func(ho string, rp string) bool { return rp != "" && rp != ho }
+	err := rangeByPrefix(stub, cdrPrefix, func(key string, value []byte) error {
+		var cdr callDetailRecord
+		if err := json.Unmarshal(value, &cdr); err != nil {
+			return internalError("Error unmarshalling CDR " + key)
+		}
+		if cdr.Status != cdrStatusCharged || !roaming(cdr.HO, cdr.RP) {
+			return nil
+		}
+		return fn(ratedRecord{cdr.CDRID, cdr.HO, cdr.RP, cdrService(cdr), cdrSeconds(cdr), cdr.StartTime, cdr.Charges, cdr.Currency})
+	})
+	if err != nil {
+		return err
+	}
+	err = rangeByPrefix(stub, dataPrefix, func(key string, value []byte) error {
+		var rec DataSessionRecord
+		if err := json.Unmarshal(value, &rec); err != nil {
+			return internalError("Error unmarshalling data session " + key)
+		}
+		if rec.Status != usageStatusCharged || !roaming(rec.HO, rec.RP) {
+			return nil
+		}
+		return fn(ratedRecord{rec.RecordID, rec.HO, rec.RP, rateData, rec.Bytes, rec.StartTime, rec.Charges, rec.Currency})
+	})
+	if err != nil {
+		return err
+	}
+	return rangeByPrefix(stub, smsPrefix, func(key string, value []byte) error {
+		var rec SMSRecord
+		if err := json.Unmarshal(value, &rec); err != nil {
+			return internalError("Error unmarshalling SMS " + key)
+		}
+		if rec.Status != usageStatusCharged || !roaming(rec.HO, rec.RP) {
+			return nil
+		}
+		service := rateSMS
+		if rec.TransType == smsIn {
+			service = rateSMSIn
+		}
+		return fn(ratedRecord{rec.RecordID, rec.HO, rec.RP, service, 1, rec.Time, rec.Charges, rec.Currency})
+	})
+}
+
+//addRecord books a charged record on the statement. The home operator owes
+//the roaming partner for the usage of its subscribers.
+func (s *SettlementStatement) addRecord(rec ratedRecord) {
+	s.Records = append(s.Records, rec.ID)
+	found := false
+	for i := range s.LineItems {
+		li := &s.LineItems[i]
+		if li.Debtor == rec.HO && li.Service == rec.Service && li.Currency == rec.Currency {
+			li.Records++
+			li.Units += rec.Units
+			li.Amount = li.Amount + rec.Charges
+			found = true
+			break
+		}
+	}
+	if !found {
+		s.LineItems = append(s.LineItems, LineItem{Debtor: rec.HO, Creditor: rec.RP, Service: rec.Service, Currency: rec.Currency, Records: 1, Units: rec.Units, Amount: rec.Charges})
+	}
+}
+
+//computeTotals nets the line items per currency, in the order currencies first appear
+func (s *SettlementStatement) computeTotals() {
+	s.Totals = []CurrencyTotal{}
+	for _, li := range s.LineItems {
+		i := 0
+		for i < len(s.Totals) && s.Totals[i].Currency != li.Currency {
+			i++
+		}
+		if i == len(s.Totals) {
+			s.Totals = append(s.Totals, CurrencyTotal{Currency: li.Currency})
+		}
+		if li.Debtor == s.OperatorA {
+			s.Totals[i].AOwesB = s.Totals[i].AOwesB + li.Amount
+		} else {
+			s.Totals[i].BOwesA = s.Totals[i].BOwesA + li.Amount
+		}
+	}
+	for i := range s.Totals {
+		t := &s.Totals[i]
+		t.Net = t.AOwesB - t.BOwesA
+		t.Payer, t.Payee = s.OperatorA, s.OperatorB
+		if t.Net < 0 {
+			t.Payer, t.Payee = s.OperatorB, s.OperatorA
+		}
+	}
+}
+
+//settlementTotal converts the totals of the statement into the settlement
+//currency of one of its operators
+func (s *SettlementStatement) settlementTotal(stub shim.ChaincodeStubInterface, operator string) (SettlementTotal, error) {
+	st := SettlementTotal{Operator: operator, Rates: []AppliedRate{}}
+	op, err := getOperator(stub, operator)
+	if err != nil {
+		return st, err
+	}
+	st.Currency = op.SettlementCurrency
+	var snap RateSnapshot
+	for _, t := range s.Totals {
+		receivable, payable := t.BOwesA, t.AOwesB
+		if operator == s.OperatorB {
+			receivable, payable = t.AOwesB, t.BOwesA
+		}
+		if t.Currency != st.Currency {
+			if st.SnapshotID == "" {
+				if snap, err = rateSnapshotAt(stub, operator, s.To); err != nil {
+					return st, err
+				}
+				st.SnapshotID = snap.SnapshotID
+			}
+			var rate Rate
+			if receivable, rate, err = snap.convert(receivable, t.Currency, st.Currency); err != nil {
+				return st, err
+			}
+			if payable, _, err = snap.convert(payable, t.Currency, st.Currency); err != nil {
+				return st, err
+			}
+			st.Rates = append(st.Rates, AppliedRate{From: t.Currency, To: st.Currency, Rate: rate})
+		}
+		st.Receivable = st.Receivable + receivable
+		st.Payable = st.Payable + payable
+	}
+	st.Net = st.Receivable - st.Payable
+	return st, nil
+}
+
+//getStatement reads a statement by its id, which is its key. Ids that are the
+//key of something else are not found, statements are written back under their id.
+func getStatement(stub shim.ChaincodeStubInterface, id string) (SettlementStatement, error) {
+	var s SettlementStatement
+	if !strings.HasPrefix(id, settlementPrefix) {
+		return s, notFoundError("Statement not found " + id)
+	}
+	bytes, err := stub.GetState(id)
+	if err != nil {
+		return s, internalError("Error retrieving statement " + id)
+	}
+	if bytes == nil {
+		return s, notFoundError("Statement not found " + id)
+	}
+	if err = json.Unmarshal(bytes, &s); err != nil {
+		return s, internalError("Error unmarshalling statement " + id)
+	}
+	if s.StatementID != id {
+		return s, notFoundError("Statement not found " + id)
+	}
+	return s, nil
+}
+
+//putStatement writes a statement, refusing to touch one both operators accepted
+func putStatement(stub shim.ChaincodeStubInterface, s SettlementStatement) error {
+	existing, err := stub.GetState(s.StatementID)
+	if err != nil {
+		return internalError("Error retrieving statement " + s.StatementID)
+	}
+	if existing != nil {
+		var old SettlementStatement
+		if err = json.Unmarshal(existing, &old); err == nil && old.Status == statementAccepted {
+			fmt.Println("Error - statement is already accepted : " + s.StatementID)
+			return conflictError("Statement " + s.StatementID + " is accepted by both operators and can not be modified")
+		}
+	}
+	bytes, err := json.Marshal(s)
+	if err != nil {
+		return internalError("Error marshalling statement " + s.StatementID)
+	}
+	if err = stub.PutState(s.StatementID, bytes); err != nil {
+		fmt.Println("Error - could not write statement " + s.StatementID)
+		return internalError("Error writing statement " + s.StatementID)
+	}
+	fmt.Println("Success, wrote statement " + s.StatementID)
+	return nil
+}
+
+//getStatements returns the statements between two operators, oldest period first
+func getStatements(stub shim.ChaincodeStubInterface, op1 string, op2 string) ([]SettlementStatement, error) {
+	a, b := operatorPair(op1, op2)
+	statements := []SettlementStatement{}
+	err := rangeByPrefix(stub, settlementPairPrefix(a, b), func(key string, value []byte) error {
+		var s SettlementStatement
+		if err := json.Unmarshal(value, &s); err != nil {
+			return internalError("Error unmarshalling statement " + key)
+		}
+		statements = append(statements, s)
+		return nil
+	})
+	return statements, err
+}
+
+//statementParty returns which of the statement's operators the caller acts for
+func statementParty(stub shim.ChaincodeStubInterface, s SettlementStatement, action string) (string, error) {
+	if err := requireOperator(stub, action+" statement "+s.StatementID, s.OperatorA, s.OperatorB); err != nil {
+		return "", err
+	}
+	return certAttribute(stub, attrOperator), nil
+}
+
+//requireResolvedDisputes passes a statement whose disputed calls all have a resolved dispute
+func requireResolvedDisputes(stub shim.ChaincodeStubInterface, s SettlementStatement) error {
+	for _, id := range s.Records {
+		owner, err := indexOwner(stub, disputeIndexKey(id))
+		if err != nil {
+			return err
+		}
+		if owner == "" {
+			continue
+		}
+		d, err := getDispute(stub, owner)
+		if err != nil {
+			return err
+		}
+		if d.Status != disputeResolved {
+			return conflictError("Statement " + s.StatementID + " can not be reissued before dispute " + d.DisputeID + " is resolved")
+		}
+	}
+	return nil
+}
+
+//Close the billing period from (inclusive) to (exclusive) between two
+//operators. The statement books the unsettled usage that started before the
+//end of the period and the unsettled adjustments. Closing the period of a
+//disputed statement again reissues it, both operators have to accept anew.
+//	args: ho, rp, from, to (RFC3339)
+func (t *SimpleChaincode) closeSettlementPeriod(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Closing settlement period")
+	if err := checkArgs("closeSettlementPeriod", args, 4, "ho, rp, from and to"); err != nil {
+		return nil, err
+	}
+	if args[0] == args[1] {
+		return nil, validationError("A statement needs two different operators")
+	}
+	from, err := time.Parse(time.RFC3339, args[2])
+	if err != nil {
+		return nil, validationError("Invalid time " + args[2])
+	}
+	to, err := time.Parse(time.RFC3339, args[3])
+	if err != nil {
+		return nil, validationError("Invalid time " + args[3])
+	}
+	if !to.After(from) {
+		return nil, validationError("Billing period must end after it starts")
+	}
+	if err = requireOperatorOrRole(stub, "close the billing period of "+args[0]+" and "+args[1], args[:2], roleAdmin); err != nil {
+		return nil, err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if to.After(now) {
+		return nil, validationError("Billing period can not end in the future")
+	}
+
+	a, b := operatorPair(args[0], args[1])
+	previous, err := getStatements(stub, a, b)
+	if err != nil {
+		return nil, err
+	}
+	var reissued *SettlementStatement
+	for i, p := range previous {
+		if !from.Before(p.To) || !p.From.Before(to) {
+			continue
+		}
+		if p.Status != statementDisputed || !p.From.Equal(from) || !p.To.Equal(to) {
+			return nil, conflictError("Billing period overlaps statement " + p.StatementID)
+		}
+		if err = requireResolvedDisputes(stub, p); err != nil {
+			return nil, err
+		}
+		reissued = &previous[i]
+	}
+	settled := map[string]bool{}
+	for _, p := range previous {
+		if reissued == nil || p.StatementID != reissued.StatementID {
+			for _, id := range p.Records {
+				settled[id] = true
+			}
+		}
+	}
+
+	s := SettlementStatement{
+		StatementID: settlementKey(a, b, from),
+		OperatorA:   a,
+		OperatorB:   b,
+		From:        from.UTC(),
+		To:          to.UTC(),
+		IssuedAt:    now,
+		LineItems:   []LineItem{},
+		Records:     []string{},
+		History:     []StatementAction{},
+		Status:      statementIssued,
+	}
+	if reissued != nil {
+		s.History = append(reissued.History, StatementAction{Operator: certAttribute(stub, attrOperator), Action: "reissue", Time: now})
+	}
+	//Usage of earlier periods that was charged after they were closed is carried in
+	err = chargedRecords(stub, func(rec ratedRecord) error {
+		pair := (rec.HO == a && rec.RP == b) || (rec.HO == b && rec.RP == a)
+		if pair && rec.Start.Before(to) && !settled[rec.ID] {
+			s.addRecord(rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	//Resolved disputes correct what was charged before, whenever they were resolved
+	err = adjustmentRecords(stub, a, b, func(rec ratedRecord) error {
+		if !settled[rec.ID] {
+			s.addRecord(rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.computeTotals()
+	//Each operator settles in its own currency at the rates of the cut-off
+	s.Settlement = []SettlementTotal{}
+	for _, op := range []string{a, b} {
+		st, err := s.settlementTotal(stub, op)
+		if err != nil {
+			return nil, err
+		}
+		s.Settlement = append(s.Settlement, st)
+	}
+	if err = putStatement(stub, s); err != nil {
+		return nil, err
+	}
+
+	event := newOperatorEvent(stub, eventStatementIssued, a, b, now, StatementEvent{StatementID: s.StatementID, Status: s.Status})
+	return nil, setEvents(stub, []RoamingEvent{event})
+}
+
+//Accept a statement on behalf of the caller's operator
+//	args: statement id
+func (t *SimpleChaincode) acceptStatement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Accepting statement")
+	if err := checkArgs("acceptStatement", args, 1, "statement id"); err != nil {
+		return nil, err
+	}
+	s, err := getStatement(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	party, err := statementParty(stub, s, "accept")
+	if err != nil {
+		return nil, err
+	}
+	if s.Status == statementAccepted {
+		return nil, conflictError("Statement " + s.StatementID + " is already accepted")
+	}
+	if (party == s.OperatorA && s.AcceptedByA) || (party == s.OperatorB && s.AcceptedByB) {
+		return nil, conflictError(party + " already accepted statement " + s.StatementID)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if party == s.OperatorA {
+		s.AcceptedByA = true
+	} else {
+		s.AcceptedByB = true
+	}
+	s.Status = statementPartiallyAccepted
+	if s.AcceptedByA && s.AcceptedByB {
+		s.Status = statementAccepted
+	}
+	s.History = append(s.History, StatementAction{Operator: party, Action: "accept", Time: now})
+	if err = putStatement(stub, s); err != nil {
+		return nil, err
+	}
+
+	event := newOperatorEvent(stub, eventStatementAccepted, s.OperatorA, s.OperatorB, now, StatementEvent{StatementID: s.StatementID, Status: s.Status, Operator: party})
+	return nil, setEvents(stub, []RoamingEvent{event})
+}
+
+//Dispute a statement on behalf of the caller's operator. Any acceptance so
+//far is withdrawn, both operators have to accept again.
+//	args: statement id, reason
+func (t *SimpleChaincode) disputeStatement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Disputing statement")
+	if err := checkArgs("disputeStatement", args, 2, "statement id and reason"); err != nil {
+		return nil, err
+	}
+	if args[1] == "" {
+		return nil, validationError("A dispute needs a reason")
+	}
+	s, err := getStatement(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	party, err := statementParty(stub, s, "dispute")
+	if err != nil {
+		return nil, err
+	}
+	if s.Status == statementAccepted {
+		return nil, conflictError("Statement " + s.StatementID + " is accepted by both operators and can not be disputed")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	s.AcceptedByA = false
+	s.AcceptedByB = false
+	s.Status = statementDisputed
+	s.History = append(s.History, StatementAction{Operator: party, Action: "dispute", Reason: args[1], Time: now})
+	if err = putStatement(stub, s); err != nil {
+		return nil, err
+	}
+
+	event := newOperatorEvent(stub, eventStatementDisputed, s.OperatorA, s.OperatorB, now, StatementEvent{StatementID: s.StatementID, Status: s.Status, Operator: party, Reason: args[1]})
+	return nil, setEvents(stub, []RoamingEvent{event})
+}
+
+func (t *SimpleChaincode) queryStatement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("queryStatement called")
+	if err := checkArgs("queryStatement", args, 1, "statement id"); err != nil {
+		return nil, err
+	}
+	s, err := getStatement(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = requireOperatorOrRole(stub, "read statement "+s.StatementID, []string{s.OperatorA, s.OperatorB}, roleAuditor, roleAdmin); err != nil {
+		return nil, err
+	}
+	return json.Marshal(s)
+}
+
+//Query the statements between two operators, oldest period first
+func (t *SimpleChaincode) queryStatements(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("queryStatements called")
+	if err := checkArgs("queryStatements", args, 2, "two operators"); err != nil {
+		return nil, err
+	}
+	if err := requireOperatorOrRole(stub, "read the statements of "+args[0]+" and "+args[1], args, roleAuditor, roleAdmin); err != nil {
+		return nil, err
+	}
+	statements, err := getStatements(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(statements)
+}
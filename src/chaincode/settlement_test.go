@@ -0,0 +1,173 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+//statement reads a statement of ABC and XYZ by the start of its period
+func (l *testLedger) statement(from string) SettlementStatement {
+	l.t.Helper()
+	var s SettlementStatement
+	l.asOperator("ABC").mustQuery(&s, "queryStatement", "settlement:ABC:XYZ:"+from)
+	return s
+}
+
+//publishTestRates gives both demo operators exchange rates, 1 EUR is 1.10 USD and 1 USD is 0.90 EUR
+func (l *testLedger) publishTestRates() {
+	l.t.Helper()
+	l.asOperator("ABC").mustInvoke("publishRates", `{"operator": "ABC", "base": "USD",
+		"effectiveFrom": "2017-01-01T00:00:00Z", "rates": [{"currency": "EUR", "rate": "1.10"}]}`)
+	l.asOperator("XYZ").mustInvoke("publishRates", `{"operator": "XYZ", "base": "EUR",
+		"effectiveFrom": "2017-01-01T00:00:00Z", "rates": [{"currency": "USD", "rate": "0.90"}]}`)
+}
+
+func TestSettlementTotals(t *testing.T) {
+	l := newTestLedger(t)
+	l.publishTestRates()
+	//ABC owes XYZ 5.00 EUR, XYZ owes ABC 10.00 USD
+	l.roam("rs1", "XYZ")
+	l.call("rs1", "4930123456", time.Minute)
+	l.roam("rs4", "ABC")
+	l.call("rs4", "14691234567", 2*time.Minute)
+	l.advance(24 * time.Hour)
+	l.asOperator("XYZ").mustInvoke("closeSettlementPeriod", "XYZ", "ABC", "2017-03-01T00:00:00Z", "2017-03-02T00:00:00Z")
+
+	s := l.statement("2017-03-01T00:00:00Z")
+	if s.OperatorA != "ABC" || s.OperatorB != "XYZ" || len(s.Records) != 2 || s.Status != statementIssued {
+		t.Fatalf("statement %s of %s and %s, %d records, %s", s.StatementID, s.OperatorA, s.OperatorB, len(s.Records), s.Status)
+	}
+	totals := map[string]string{}
+	for _, ct := range s.Totals {
+		totals[ct.Currency] = ct.AOwesB.String() + " " + ct.BOwesA.String() + " " + ct.Net.String() + " " + ct.Payer
+	}
+	if totals["EUR"] != "5.0000 0.0000 5.0000 ABC" || totals["USD"] != "0.0000 10.0000 -10.0000 XYZ" {
+		t.Errorf("totals %v", totals)
+	}
+	want := map[string]string{"ABC": "USD 10.0000 5.5000 4.5000", "XYZ": "EUR 5.0000 9.0000 -4.0000"}
+	for _, st := range s.Settlement {
+		got := st.Currency + " " + st.Receivable.String() + " " + st.Payable.String() + " " + st.Net.String()
+		if got != want[st.Operator] || st.SnapshotID == "" || len(st.Rates) != 1 {
+			t.Errorf("settlement of %s: %s with snapshot %q and rates %v, want %s", st.Operator, got, st.SnapshotID, st.Rates, want[st.Operator])
+		}
+	}
+
+	//The next period starts where this one ended, it can not overlap it
+	l.asOperator("ABC").mustFail(codeStateConflict, "closeSettlementPeriod", "ABC", "XYZ", "2017-03-01T12:00:00Z", "2017-03-02T06:00:00Z")
+	l.mustInvoke("acceptStatement", s.StatementID)
+	l.asOperator("XYZ").mustInvoke("acceptStatement", s.StatementID)
+	if s = l.statement("2017-03-01T00:00:00Z"); s.Status != statementAccepted {
+		t.Errorf("status %s after both operators accepted", s.Status)
+	}
+}
+
+func TestLateChargesAreSettledInTheNextPeriod(t *testing.T) {
+	l := newTestLedger(t)
+	l.publishTestRates()
+	l.roam("rs1", "XYZ")
+	l.mustInvoke("CallOut", "rs1", "4930123456")
+	l.advance(time.Minute)
+	l.mustInvoke("CallEnd", "rs1")
+	//The call of the morning is only charged after the morning is closed
+	l.advance(3 * time.Hour)
+	l.asOperator("ABC").mustInvoke("closeSettlementPeriod", "ABC", "XYZ", "2017-03-01T00:00:00Z", "2017-03-01T12:00:00Z")
+	if s := l.statement("2017-03-01T00:00:00Z"); len(s.Records) != 0 {
+		t.Fatalf("morning statement books %v before the call is charged", s.Records)
+	}
+	l.asOperator("XYZ").mustInvoke("CallPay", "rs1")
+
+	l.advance(12 * time.Hour)
+	l.asOperator("ABC").mustInvoke("closeSettlementPeriod", "ABC", "XYZ", "2017-03-01T12:00:00Z", "2017-03-02T00:00:00Z")
+	cdr := l.cdrs("rs1")[0]
+	s := l.statement("2017-03-01T12:00:00Z")
+	if len(s.Records) != 1 || s.Records[0] != cdr.CDRID || s.Totals[0].AOwesB.String() != "5.0000" {
+		t.Fatalf("afternoon statement books %v with totals %+v, want the late charged %s", s.Records, s.Totals, cdr.CDRID)
+	}
+
+	l.advance(24 * time.Hour)
+	l.asOperator("ABC").mustInvoke("closeSettlementPeriod", "ABC", "XYZ", "2017-03-02T00:00:00Z", "2017-03-03T00:00:00Z")
+	if s = l.statement("2017-03-02T00:00:00Z"); len(s.Records) != 0 {
+		t.Errorf("the call is settled again in %v", s.Records)
+	}
+}
+
+func TestDisputedStatementIsReissued(t *testing.T) {
+	l := newTestLedger(t)
+	l.publishTestRates()
+	l.roam("rs1", "XYZ")
+	l.call("rs1", "4930123456", time.Minute)
+	cdr := l.cdrs("rs1")[0]
+	l.advance(24 * time.Hour)
+	period := []string{"ABC", "XYZ", "2017-03-01T00:00:00Z", "2017-03-02T00:00:00Z"}
+	l.asOperator("ABC").mustInvoke("closeSettlementPeriod", period...)
+	s := l.statement("2017-03-01T00:00:00Z")
+
+	//An issued statement is not closed again
+	l.asOperator("ABC").mustFail(codeStateConflict, "closeSettlementPeriod", period...)
+	l.mustInvoke("raiseDispute", `{"records": ["`+cdr.CDRID+`"], "proposed": "2.00"}`)
+	l.mustInvoke("disputeStatement", s.StatementID, "call dropped after setup")
+	l.mustFail(codeStateConflict, "closeSettlementPeriod", period...)
+
+	owner, _ := l.stub.GetState(disputeIndexKey(cdr.CDRID))
+	l.asOperator("XYZ").mustInvoke("acceptDispute", string(owner))
+	l.advance(time.Hour)
+	l.asOperator("XYZ").mustFail(codeStateConflict, "closeSettlementPeriod", "ABC", "XYZ", "2017-03-01T00:00:00Z", "2017-03-01T12:00:00Z")
+	l.mustInvoke("closeSettlementPeriod", period...)
+
+	s = l.statement("2017-03-01T00:00:00Z")
+	if s.Status != statementIssued || s.AcceptedByA || s.AcceptedByB || !s.IssuedAt.Equal(l.now) {
+		t.Fatalf("reissued statement %s, accepted %v/%v, issued at %s", s.Status, s.AcceptedByA, s.AcceptedByB, s.IssuedAt)
+	}
+	if len(s.Records) != 2 || len(s.Totals) != 1 || s.Totals[0].Net.String() != "2.0000" {
+		t.Errorf("reissued statement books %v with totals %+v, want the call and its adjustment netting 2.0000", s.Records, s.Totals)
+	}
+	if len(s.History) != 2 || s.History[0].Action != "dispute" || s.History[1].Action != "reissue" {
+		t.Errorf("history %+v", s.History)
+	}
+
+	//The adjustment is settled with the reissued statement
+	l.advance(24 * time.Hour)
+	l.asOperator("ABC").mustInvoke("closeSettlementPeriod", "ABC", "XYZ", "2017-03-02T00:00:00Z", "2017-03-03T00:00:00Z")
+	if s = l.statement("2017-03-02T00:00:00Z"); len(s.Records) != 0 {
+		t.Errorf("next statement books %v again", s.Records)
+	}
+}
+
+func TestStatementsAreOnlyReadUnderTheirOwnKey(t *testing.T) {
+	l := newTestLedger(t)
+	before, _ := l.stub.GetState(subscriberKey("rs1"))
+	l.asOperator("ABC").mustFail(codeNotFound, "acceptStatement", subscriberKey("rs1"))
+	l.mustFail(codeNotFound, "disputeStatement", operatorKey("ABC"), "not a statement")
+	if after, _ := l.stub.GetState(subscriberKey("rs1")); string(after) != string(before) {
+		t.Errorf("acceptStatement rewrote sub:rs1 as %s", after)
+	}
+
+	l.publishTestRates()
+	l.roam("rs1", "XYZ")
+	l.call("rs1", "4930123456", time.Minute)
+	l.advance(24 * time.Hour)
+	l.asOperator("ABC").mustInvoke("closeSettlementPeriod", "ABC", "XYZ", "2017-03-01T00:00:00Z", "2017-03-02T00:00:00Z")
+	id := "settlement:ABC:XYZ:2017-03-01T00:00:00Z"
+	stored, _ := l.stub.GetState(id)
+	l.stub.MockTransactionStart("copy")
+	l.stub.PutState(id+"x", stored)
+	l.stub.MockTransactionEnd("copy")
+	l.mustFail(codeNotFound, "acceptStatement", id+"x")
+}
@@ -0,0 +1,362 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Subscriber records are keyed by their subscriber key ("rs1"). Secondary
+// index records point from an MSISDN, IMSI or ICCID, and from the home
+// operator, back to that key. An MSISDN is unique per home operator, IMSIs
+// and ICCIDs are unique across the network. The MSISDN index is keyed by
+// the digest of the number, see msisdnDigest.
+var subscriberPrefix = "sub:"
+
+// Secondary index prefixes
+var (
+	msisdnIndexPrefix   = "subidx:msisdn:"
+	imsiIndexPrefix     = "subidx:imsi:"
+	iccidIndexPrefix    = "subidx:iccid:"
+	operatorIndexPrefix = "subidx:ho:"
+)
+
+// Subscriber keys end up inside the keys of CDRs, usage, fraud cases and
+// location fixes, where a range scan over "cdr:rs1:" must not reach the
+// records of "rs1:x". They are restricted to the characters of area ids.
+var subscriberKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+//validateSubscriberKey rejects keys that could overlap the ranges of another subscriber
+func validateSubscriberKey(key string) error {
+	if !subscriberKeyPattern.MatchString(key) {
+		return validationError("Invalid subscriber key " + key + ", expecting letters, digits, '_' or '-'")
+	}
+	return nil
+}
+
+func subscriberKey(publicKey string) string {
+	return subscriberPrefix + publicKey
+}
+
+//msisdnIndexPrefixOf is where the index records of an MSISDN start, the
+//digest comes first so that one range scan finds its holders across all operators
+func msisdnIndexPrefixOf(stub shim.ChaincodeStubInterface, msisdn string) (string, error) {
+	digest, err := msisdnDigest(stub, msisdn)
+	if err != nil {
+		return "", err
+	}
+	return msisdnIndexPrefix + digest + ":", nil
+}
+
+func msisdnIndexKey(digest string, ho string) string {
+	return msisdnIndexPrefix + digest + ":" + ho
+}
+
+func imsiIndexKey(imsi string) string {
+	return imsiIndexPrefix + imsi
+}
+
+func iccidIndexKey(iccid string) string {
+	return iccidIndexPrefix + iccid
+}
+
+func operatorIndexKey(ho string, publicKey string) string {
+	return operatorIndexPrefix + ho + ":" + publicKey
+}
+
+//indexKeys returns the index records of a subscriber
+func (rs rsDetailBlock) indexKeys(stub shim.ChaincodeStubInterface) ([]string, error) {
+	digest, err := subscriberDigest(stub, rs)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{msisdnIndexKey(digest, rs.HO), operatorIndexKey(rs.HO, rs.PublicKey)}
+	if rs.IMSI != "" {
+		keys = append(keys, imsiIndexKey(rs.IMSI))
+	}
+	if rs.ICCID != "" {
+		keys = append(keys, iccidIndexKey(rs.ICCID))
+	}
+	return keys, nil
+}
+
+//getSubscriber reads the record of a subscriber key
+func getSubscriber(stub shim.ChaincodeStubInterface, key string) (rsDetailBlock, error) {
+	var rs rsDetailBlock
+	if err := validateSubscriberKey(key); err != nil {
+		return rs, err
+	}
+	bytes, err := stub.GetState(subscriberKey(key))
+	if err != nil {
+		fmt.Printf("Error - Could not get User details : %s\n", key)
+		return rs, internalError("Error retrieving subscriber " + key)
+	}
+	if bytes == nil {
+		return rs, notFoundError("Subscriber not found " + key)
+	}
+	fmt.Printf("Success - User details found %s\n", key)
+	err = json.Unmarshal(bytes, &rs)
+	if err != nil {
+		return rs, internalError("Error unmarshalling subscriber " + key)
+	}
+	return rs, nil
+}
+
+// Subscriber flags. A subscriber can carry several, Flags holds each once.
+// Records written before there were several only have the one in Flag.
+const (
+	flagFraud   = "Fraud"
+	flagOverage = "OVERAGE"
+)
+
+//hasFlag reports whether the subscriber carries the flag
+func (rs rsDetailBlock) hasFlag(flag string) bool {
+	if rs.Flag == flag {
+		return true
+	}
+	for _, f := range rs.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+//addFlag flags the subscriber, keeping the flags it already has
+func (rs *rsDetailBlock) addFlag(flag string) {
+	if rs.Flag != "" {
+		legacy := rs.Flag
+		rs.Flag = ""
+		if !rs.hasFlag(legacy) {
+			rs.Flags = append(rs.Flags, legacy)
+		}
+	}
+	if !rs.hasFlag(flag) {
+		rs.Flags = append(rs.Flags, flag)
+	}
+}
+
+//putSubscriber writes the record of a subscriber under its key. It does not
+//touch the indexes, use registerSubscriber when MSISDN, IMSI, ICCID or HO change.
+func putSubscriber(stub shim.ChaincodeStubInterface, rs rsDetailBlock) error {
+	bytes, err := json.Marshal(rs)
+	if err != nil {
+		return internalError("Error marshalling subscriber " + rs.PublicKey)
+	}
+	err = stub.PutState(subscriberKey(rs.PublicKey), bytes)
+	if err != nil {
+		fmt.Println("Error - could not Marshall in msisdn")
+		return internalError("Error writing subscriber " + rs.PublicKey)
+	}
+	fmt.Println("Success, updated record")
+	return nil
+}
+
+//indexOwner returns the subscriber key an index record points to, or "" if there is none
+func indexOwner(stub shim.ChaincodeStubInterface, key string) (string, error) {
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return "", internalError("Error retrieving index " + key)
+	}
+	return string(bytes), nil
+}
+
+//registerSubscriber writes a new or re-entered subscriber together with its
+//index records, rejecting identifiers that belong to another subscriber
+func registerSubscriber(stub shim.ChaincodeStubInterface, rs rsDetailBlock) error {
+	if rs.PublicKey == "" || rs.MSISDNDigest == "" || rs.HO == "" {
+		return validationError("Subscriber needs a key, an msisdn digest and a home operator")
+	}
+	if err := validateSubscriberKey(rs.PublicKey); err != nil {
+		return err
+	}
+	keys, err := rs.indexKeys(stub)
+	if err != nil {
+		return err
+	}
+	//Checked in a fixed order so every peer reports the same conflict
+	unique := [][2]string{{keys[0], "MSISDN " + mask(rs.MSISDN) + " of " + rs.HO}}
+	if rs.IMSI != "" {
+		unique = append(unique, [2]string{imsiIndexKey(rs.IMSI), "IMSI " + rs.IMSI})
+	}
+	if rs.ICCID != "" {
+		unique = append(unique, [2]string{iccidIndexKey(rs.ICCID), "ICCID " + rs.ICCID})
+	}
+	for _, u := range unique {
+		owner, err := indexOwner(stub, u[0])
+		if err != nil {
+			return err
+		}
+		if owner != "" && owner != rs.PublicKey {
+			return conflictError(u[1] + " is already registered to subscriber " + owner)
+		}
+	}
+
+	//Drop the index records of the previous version of the record
+	old, err := getSubscriber(stub, rs.PublicKey)
+	if err == nil {
+		oldKeys, err := old.indexKeys(stub)
+		if err != nil {
+			return err
+		}
+		for _, key := range oldKeys {
+			if err = stub.DelState(key); err != nil {
+				return internalError("Error deleting index " + key)
+			}
+		}
+	} else if ce, ok := err.(*ChaincodeError); !ok || ce.Code != codeNotFound {
+		return err
+	}
+
+	for _, key := range keys {
+		if err = stub.PutState(key, []byte(rs.PublicKey)); err != nil {
+			return internalError("Error writing index " + key)
+		}
+	}
+	return putSubscriber(stub, rs)
+}
+
+//subscribersByIndex loads the subscribers the index records under prefix point to
+func subscribersByIndex(stub shim.ChaincodeStubInterface, prefix string) ([]rsDetailBlock, error) {
+	var keys []string
+	err := rangeByPrefix(stub, prefix, func(key string, value []byte) error {
+		keys = append(keys, string(value))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	subscribers := []rsDetailBlock{}
+	for _, key := range keys {
+		rs, err := getSubscriber(stub, key)
+		if err != nil {
+			return nil, err
+		}
+		subscribers = append(subscribers, rs)
+	}
+	return subscribers, nil
+}
+
+//subscribersByIndexKey loads the subscriber a single index record points to
+func subscribersByIndexKey(stub shim.ChaincodeStubInterface, key string) ([]rsDetailBlock, error) {
+	owner, err := indexOwner(stub, key)
+	if err != nil || owner == "" {
+		return nil, err
+	}
+	rs, err := getSubscriber(stub, owner)
+	if err != nil {
+		return nil, err
+	}
+	return []rsDetailBlock{rs}, nil
+}
+
+//Query the subscribers holding an MSISDN, optionally only the one of a home operator
+//	args: msisdn [, ho]
+func (t *SimpleChaincode) querySubscriberByMSISDN(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("querySubscriberByMSISDN called")
+	if len(args) != 2 {
+		if err := checkArgs("querySubscriberByMSISDN", args, 1, "msisdn and optionally ho"); err != nil {
+			return nil, err
+		}
+	}
+	prefix, err := msisdnIndexPrefixOf(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	var subscribers []rsDetailBlock
+	if len(args) == 2 {
+		subscribers, err = subscribersByIndexKey(stub, prefix+args[1])
+	} else {
+		subscribers, err = subscribersByIndex(stub, prefix)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(subscribers) == 0 {
+		return nil, notFoundError("No subscriber with MSISDN " + mask(args[0]))
+	}
+	//An MSISDN can be held at several operators, only return the ones the caller may read
+	readable := []rsDetailBlock{}
+	for _, rs := range subscribers {
+		if err = requireSubscriberRead(stub, rs); err == nil {
+			readable = append(readable, subscriberView(stub, rs))
+		}
+	}
+	if len(readable) == 0 {
+		return nil, err
+	}
+	return json.Marshal(readable)
+}
+
+//querySubscriberByUniqueID looks up a subscriber by an identifier that is unique network wide
+func querySubscriberByUniqueID(stub shim.ChaincodeStubInterface, indexKey string, what string) ([]byte, error) {
+	owner, err := indexOwner(stub, indexKey)
+	if err != nil {
+		return nil, err
+	}
+	if owner == "" {
+		return nil, notFoundError("No subscriber with " + what)
+	}
+	rs, err := getSubscriber(stub, owner)
+	if err != nil {
+		return nil, err
+	}
+	if err = requireSubscriberRead(stub, rs); err != nil {
+		return nil, err
+	}
+	return json.Marshal(subscriberView(stub, rs))
+}
+
+func (t *SimpleChaincode) querySubscriberByIMSI(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("querySubscriberByIMSI called")
+	if err := checkArgs("querySubscriberByIMSI", args, 1, "imsi"); err != nil {
+		return nil, err
+	}
+	return querySubscriberByUniqueID(stub, imsiIndexKey(args[0]), "IMSI "+args[0])
+}
+
+func (t *SimpleChaincode) querySubscriberByICCID(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("querySubscriberByICCID called")
+	if err := checkArgs("querySubscriberByICCID", args, 1, "iccid"); err != nil {
+		return nil, err
+	}
+	return querySubscriberByUniqueID(stub, iccidIndexKey(args[0]), "ICCID "+args[0])
+}
+
+//List the subscribers of a home operator
+func (t *SimpleChaincode) listSubscribersByOperator(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("listSubscribersByOperator called")
+	if err := checkArgs("listSubscribersByOperator", args, 1, "ho"); err != nil {
+		return nil, err
+	}
+	if err := requireOperatorOrRole(stub, "list the subscribers of "+args[0], args, roleAuditor, roleAdmin); err != nil {
+		return nil, err
+	}
+	subscribers, err := subscribersByIndex(stub, operatorIndexPrefix+args[0]+":")
+	if err != nil {
+		return nil, err
+	}
+	for i, rs := range subscribers {
+		subscribers[i] = subscriberView(stub, rs)
+	}
+	return json.Marshal(subscribers)
+}
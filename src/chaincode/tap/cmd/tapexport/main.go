@@ -0,0 +1,103 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+// Command tapexport writes the TAP-like batch of a roaming partner for the
+// calls of a home operator's subscribers in a period. It reads one or more
+// state dumps returned by the chaincode query dumpState, e.g.
+//
+//	dumpState "cdr:" "operator:"  >  state.json
+//	tapexport -dump state.json -ho ABC -rp XYZ \
+//		-from 2017-01-01T00:00:00Z -to 2017-02-01T00:00:00Z -seq 1 -out CDXYZABC00001.json
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"chaincode/tap"
+)
+
+func main() {
+	dumps := flag.String("dump", "-", "comma separated state dump files, - reads stdin")
+	ho := flag.String("ho", "", "home operator, the recipient of the batch")
+	rp := flag.String("rp", "", "roaming partner, the sender of the batch")
+	from := flag.String("from", "", "start of the period (RFC3339)")
+	to := flag.String("to", "", "end of the period (RFC3339), exclusive")
+	seq := flag.Int("seq", 1, "file sequence number")
+	test := flag.Bool("test", false, "mark the batch as test data")
+	out := flag.String("out", "-", "output file, - writes stdout")
+	flag.Parse()
+
+	if err := run(*dumps, *ho, *rp, *from, *to, *seq, *test, *out); err != nil {
+		fmt.Fprintln(os.Stderr, "tapexport:", err)
+		os.Exit(1)
+	}
+}
+
+func run(dumps string, ho string, rp string, from string, to string, seq int, test bool, out string) error {
+	opts := tap.Options{HO: ho, RP: rp, Sequence: seq, Created: time.Now().UTC().Truncate(time.Second), Test: test}
+	var err error
+	if opts.From, err = time.Parse(time.RFC3339, from); err != nil {
+		return fmt.Errorf("Invalid -from %q", from)
+	}
+	if opts.To, err = time.Parse(time.RFC3339, to); err != nil {
+		return fmt.Errorf("Invalid -to %q", to)
+	}
+
+	var records []tap.Record
+	for _, name := range strings.Split(dumps, ",") {
+		recs, err := readDump(name)
+		if err != nil {
+			return err
+		}
+		records = append(records, recs...)
+	}
+	batch, err := tap.Build(records, opts)
+	if err != nil {
+		return err
+	}
+
+	if out == "-" {
+		return tap.Write(os.Stdout, batch)
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if err = tap.Write(f, batch); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readDump(name string) ([]tap.Record, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	return tap.ReadDump(r)
+}
@@ -0,0 +1,372 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+// Package tap converts the call detail records of the roaming chaincode into
+// a transfer batch laid out like a GSMA TAP3 file: batch control info,
+// accounting and network info, one call event per CDR and the audit control
+// info with the totals. It works on a state dump as returned by the
+// chaincode query dumpState, e.g. of the prefixes "cdr:" and "operator:".
+// The dump only holds masked numbers, so the call events carry them masked.
+//
+// The batch is written as JSON rather than ASN.1, field names follow TAP3
+// so it can be mapped onto a real encoder.
+package tap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TAP3 version written in the batch control info
+const (
+	SpecificationVersion = 3
+	ReleaseVersion       = 12
+)
+
+// Charges are transferred as integers with TapDecimalPlaces implied
+// decimals, the same precision the chaincode keeps amounts in
+const TapDecimalPlaces = 4
+
+// Key prefixes and values of the chaincode records the export reads
+const (
+	cdrPrefix      = "cdr:"
+	operatorPrefix = "operator:"
+	cdrCharged     = "Charged"
+	callOut        = "Call Out"
+	callIn         = "Call In"
+)
+
+// Call event types
+const (
+	MobileOriginatedCall = "MOC"
+	MobileTerminatedCall = "MTC"
+)
+
+// Record is one entry of a state dump
+type Record struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// CDR is the part of a chaincode call detail record the export needs
+type CDR struct {
+	CDRID        string    `json:"cdrid"`
+	MSISDN       string    `json:"msisdn"`
+	HO           string    `json:"ho"`
+	RP           string    `json:"rp"`
+	TransType    string    `json:"transtype"`
+	CallingParty string    `json:"callingparty"`
+	Destination  string    `json:"destination"`
+	StartTime    time.Time `json:"starttime"`
+	EndTime      time.Time `json:"endtime"`
+	Charges      string    `json:"charges"`
+	Currency     string    `json:"currency"`
+	Status       string    `json:"status"`
+}
+
+// Operator is the part of a chaincode operator record the export needs
+type Operator struct {
+	ID     string   `json:"id"`
+	TADIG  string   `json:"tadig"`
+	MCCMNC []string `json:"mccmnc"`
+	Name   string   `json:"name"`
+}
+
+// Options select the CDRs of a batch and fill its control info
+type Options struct {
+	HO       string    // home operator, the recipient
+	RP       string    // roaming partner, the sender
+	From     time.Time // first call start included
+	To       time.Time // first call start no longer included
+	Sequence int       // file sequence number, 1 to 99999
+	Created  time.Time // file creation time
+	Test     bool      // mark the file as test data
+}
+
+// BatchControlInfo identifies the batch
+type BatchControlInfo struct {
+	Sender                     string    `json:"sender"`
+	Recipient                  string    `json:"recipient"`
+	FileSequenceNumber         string    `json:"fileSequenceNumber"`
+	FileCreationTimeStamp      time.Time `json:"fileCreationTimeStamp"`
+	TransferCutOffTimeStamp    time.Time `json:"transferCutOffTimeStamp"`
+	FileAvailableTimeStamp     time.Time `json:"fileAvailableTimeStamp"`
+	SpecificationVersionNumber int       `json:"specificationVersionNumber"`
+	ReleaseVersionNumber       int       `json:"releaseVersionNumber"`
+	FileTypeIndicator          string    `json:"fileTypeIndicator,omitempty"`
+}
+
+// AccountingInfo gives the currency and precision of all charges
+type AccountingInfo struct {
+	LocalCurrency    string `json:"localCurrency"`
+	TapCurrency      string `json:"tapCurrency"`
+	TapDecimalPlaces int    `json:"tapDecimalPlaces"`
+}
+
+// NetworkInfo gives the time offset of all time stamps
+type NetworkInfo struct {
+	UtcTimeOffset string `json:"utcTimeOffset"`
+}
+
+// ChargeInformation is the charge of one call event
+type ChargeInformation struct {
+	ChargedItem     string `json:"chargedItem"`
+	ChargeType      string `json:"chargeType"`
+	Charge          int64  `json:"charge"`
+	ChargeableUnits int64  `json:"chargeableUnits"`
+}
+
+// CallEvent is a mobile originated or terminated call
+type CallEvent struct {
+	Type                    string            `json:"type"`
+	RecordID                string            `json:"recordId"`
+	Msisdn                  string            `json:"msisdn"`
+	CallingNumber           string            `json:"callingNumber,omitempty"`
+	CalledNumber            string            `json:"calledNumber,omitempty"`
+	CallEventStartTimeStamp time.Time         `json:"callEventStartTimeStamp"`
+	TotalCallEventDuration  int64             `json:"totalCallEventDuration"`
+	ChargeInformation       ChargeInformation `json:"chargeInformation"`
+}
+
+// EventTotal sums the call events of one type
+type EventTotal struct {
+	Type     string `json:"type"`
+	Count    int    `json:"count"`
+	Duration int64  `json:"duration"`
+	Charge   int64  `json:"charge"`
+}
+
+// AuditControlInfo lets the recipient check the batch is complete
+type AuditControlInfo struct {
+	EarliestCallTimeStamp time.Time    `json:"earliestCallTimeStamp"`
+	LatestCallTimeStamp   time.Time    `json:"latestCallTimeStamp"`
+	TotalCharge           int64        `json:"totalCharge"`
+	TotalTaxValue         int64        `json:"totalTaxValue"`
+	TotalDiscountValue    int64        `json:"totalDiscountValue"`
+	CallEventDetailsCount int          `json:"callEventDetailsCount"`
+	Totals                []EventTotal `json:"totals"`
+}
+
+// Batch is a transfer batch of the calls of HO subscribers on RP
+type Batch struct {
+	BatchControlInfo BatchControlInfo `json:"batchControlInfo"`
+	AccountingInfo   AccountingInfo   `json:"accountingInfo"`
+	NetworkInfo      NetworkInfo      `json:"networkInfo"`
+	CallEvents       []CallEvent      `json:"callEventDetails"`
+	AuditControlInfo AuditControlInfo `json:"auditControlInfo"`
+}
+
+// ReadDump reads a state dump, a JSON array of key and value pairs
+func ReadDump(r io.Reader) ([]Record, error) {
+	var records []Record
+	if err := json.NewDecoder(r).Decode(&records); err != nil {
+		return nil, fmt.Errorf("Invalid state dump: %v", err)
+	}
+	return records, nil
+}
+
+// Build converts the charged calls of opts.HO subscribers on opts.RP that
+// started in the period into a batch. The operators must be in the dump as
+// well, their TADIG codes address the batch.
+func Build(records []Record, opts Options) (Batch, error) {
+	var batch Batch
+	if opts.HO == "" || opts.RP == "" || opts.HO == opts.RP {
+		return batch, errors.New("A batch needs two different operators")
+	}
+	if !opts.To.After(opts.From) {
+		return batch, errors.New("Period must end after it starts")
+	}
+	if opts.Sequence < 1 || opts.Sequence > 99999 {
+		return batch, errors.New("File sequence number must be between 1 and 99999")
+	}
+
+	operators := map[string]Operator{}
+	cdrs := []CDR{}
+	for _, rec := range records {
+		switch {
+		case strings.HasPrefix(rec.Key, operatorPrefix):
+			var op Operator
+			if err := json.Unmarshal(rec.Value, &op); err != nil {
+				return batch, fmt.Errorf("Invalid operator %s: %v", rec.Key, err)
+			}
+			operators[op.ID] = op
+		case strings.HasPrefix(rec.Key, cdrPrefix):
+			var cdr CDR
+			if err := json.Unmarshal(rec.Value, &cdr); err != nil {
+				return batch, fmt.Errorf("Invalid CDR %s: %v", rec.Key, err)
+			}
+			if cdr.Status != cdrCharged || cdr.HO != opts.HO || cdr.RP != opts.RP {
+				continue
+			}
+			if cdr.StartTime.Before(opts.From) || !cdr.StartTime.Before(opts.To) {
+				continue
+			}
+			cdrs = append(cdrs, cdr)
+		}
+	}
+	sender, ok := operators[opts.RP]
+	if !ok || sender.TADIG == "" {
+		return batch, errors.New("No TADIG code for " + opts.RP + " in the dump")
+	}
+	recipient, ok := operators[opts.HO]
+	if !ok || recipient.TADIG == "" {
+		return batch, errors.New("No TADIG code for " + opts.HO + " in the dump")
+	}
+	//Calls in time order, the key breaks ties so every run writes the same file
+	sort.Sort(byStart(cdrs))
+
+	fileType := ""
+	if opts.Test {
+		fileType = "T"
+	}
+	batch.BatchControlInfo = BatchControlInfo{
+		Sender:                     sender.TADIG,
+		Recipient:                  recipient.TADIG,
+		FileSequenceNumber:         fmt.Sprintf("%05d", opts.Sequence),
+		FileCreationTimeStamp:      opts.Created.UTC(),
+		TransferCutOffTimeStamp:    opts.To.UTC(),
+		FileAvailableTimeStamp:     opts.Created.UTC(),
+		SpecificationVersionNumber: SpecificationVersion,
+		ReleaseVersionNumber:       ReleaseVersion,
+		FileTypeIndicator:          fileType,
+	}
+	batch.NetworkInfo = NetworkInfo{UtcTimeOffset: "+0000"}
+	batch.CallEvents = []CallEvent{}
+	batch.AuditControlInfo.Totals = []EventTotal{}
+
+	currency := ""
+	for _, cdr := range cdrs {
+		if currency == "" {
+			currency = cdr.Currency
+		} else if cdr.Currency != currency {
+			return batch, fmt.Errorf("CDR %s is in %s, the batch is in %s", cdr.CDRID, cdr.Currency, currency)
+		}
+		event, err := callEvent(cdr)
+		if err != nil {
+			return batch, err
+		}
+		batch.CallEvents = append(batch.CallEvents, event)
+		batch.AuditControlInfo.add(event)
+	}
+	batch.AccountingInfo = AccountingInfo{LocalCurrency: currency, TapCurrency: currency, TapDecimalPlaces: TapDecimalPlaces}
+	return batch, nil
+}
+
+// Write writes the batch as indented JSON
+func Write(w io.Writer, batch Batch) error {
+	bytes, err := json.MarshalIndent(batch, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(bytes, '\n'))
+	return err
+}
+
+type byStart []CDR
+
+func (c byStart) Len() int      { return len(c) }
+func (c byStart) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byStart) Less(i, j int) bool {
+	if !c[i].StartTime.Equal(c[j].StartTime) {
+		return c[i].StartTime.Before(c[j].StartTime)
+	}
+	return c[i].CDRID < c[j].CDRID
+}
+
+// callEvent maps a CDR onto a call event. Calls are charged by duration.
+func callEvent(cdr CDR) (CallEvent, error) {
+	event := CallEvent{
+		RecordID:                cdr.CDRID,
+		Msisdn:                  cdr.MSISDN,
+		CallEventStartTimeStamp: cdr.StartTime.UTC(),
+	}
+	switch cdr.TransType {
+	case callOut:
+		event.Type = MobileOriginatedCall
+		event.CallingNumber = cdr.MSISDN
+		event.CalledNumber = cdr.Destination
+	case callIn:
+		event.Type = MobileTerminatedCall
+		event.CallingNumber = cdr.CallingParty
+		event.CalledNumber = cdr.MSISDN
+	default:
+		return event, fmt.Errorf("CDR %s has unknown call type %q", cdr.CDRID, cdr.TransType)
+	}
+	charge, err := parseAmount(cdr.Charges)
+	if err != nil {
+		return event, fmt.Errorf("CDR %s: %v", cdr.CDRID, err)
+	}
+	duration := int64(cdr.EndTime.Sub(cdr.StartTime) / time.Second)
+	if duration < 0 {
+		duration = 0
+	}
+	event.TotalCallEventDuration = duration
+	event.ChargeInformation = ChargeInformation{ChargedItem: "D", ChargeType: "00", Charge: charge, ChargeableUnits: duration}
+	return event, nil
+}
+
+// add counts an event into the audit control info and its type total
+func (a *AuditControlInfo) add(event CallEvent) {
+	at := event.CallEventStartTimeStamp
+	if a.CallEventDetailsCount == 0 || at.Before(a.EarliestCallTimeStamp) {
+		a.EarliestCallTimeStamp = at
+	}
+	if a.CallEventDetailsCount == 0 || at.After(a.LatestCallTimeStamp) {
+		a.LatestCallTimeStamp = at
+	}
+	a.CallEventDetailsCount++
+	a.TotalCharge += event.ChargeInformation.Charge
+
+	i := 0
+	for i < len(a.Totals) && a.Totals[i].Type != event.Type {
+		i++
+	}
+	if i == len(a.Totals) {
+		a.Totals = append(a.Totals, EventTotal{Type: event.Type})
+	}
+	a.Totals[i].Count++
+	a.Totals[i].Duration += event.TotalCallEventDuration
+	a.Totals[i].Charge += event.ChargeInformation.Charge
+}
+
+// amountPattern is a chaincode amount with at most TapDecimalPlaces decimals
+var amountPattern = regexp.MustCompile(fmt.Sprintf(`^-?[0-9]+(\.[0-9]{0,%d})?$`, TapDecimalPlaces))
+
+// parseAmount reads a chaincode amount such as "12.5000" into an integer
+// with TapDecimalPlaces implied decimals
+func parseAmount(s string) (int64, error) {
+	if !amountPattern.MatchString(s) {
+		return 0, errors.New("Invalid amount " + s)
+	}
+	whole, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	frac = frac + strings.Repeat("0", TapDecimalPlaces-len(frac))
+	amount, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return 0, errors.New("Amount " + s + " is out of range")
+	}
+	return amount, nil
+}
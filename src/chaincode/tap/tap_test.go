@@ -0,0 +1,154 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package tap
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testPeriod = time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+
+func testOptions() Options {
+	return Options{HO: "ABC", RP: "XYZ", From: testPeriod, To: testPeriod.AddDate(0, 1, 0), Sequence: 7, Created: testPeriod.AddDate(0, 1, 1)}
+}
+
+func testRecord(key string, v interface{}) Record {
+	bytes, _ := json.Marshal(v)
+	return Record{Key: key, Value: bytes}
+}
+
+func testCDR(id string, transType string, start time.Time, d time.Duration, charges string, currency string) CDR {
+	return CDR{CDRID: "cdr:" + id, MSISDN: "1469***4567", HO: "ABC", RP: "XYZ", TransType: transType,
+		CallingParty: "4930***3456", Destination: "4930***3456", StartTime: start, EndTime: start.Add(d),
+		Charges: charges, Currency: currency, Status: cdrCharged}
+}
+
+// testDump holds both operators and the CDRs
+func testDump(cdrs ...CDR) []Record {
+	records := []Record{
+		testRecord("operator:ABC", Operator{ID: "ABC", TADIG: "USAAB", MCCMNC: []string{"310-010"}, Name: "ABC Wireless"}),
+		testRecord("operator:XYZ", Operator{ID: "XYZ", TADIG: "DEUXY", MCCMNC: []string{"262-01"}, Name: "XYZ Mobilfunk"}),
+	}
+	for _, cdr := range cdrs {
+		records = append(records, testRecord(cdr.CDRID, cdr))
+	}
+	return records
+}
+
+func TestBuild(t *testing.T) {
+	day := testPeriod.Add(9 * time.Hour)
+	uncharged := testCDR("rs1:0000000004", callOut, day, time.Minute, "5.0000", "EUR")
+	uncharged.Status = "Ended"
+	otherRP := testCDR("rs2:0000000001", callOut, day, time.Minute, "5.0000", "EUR")
+	otherRP.RP = "DEF"
+	records := testDump(
+		testCDR("rs1:0000000002", callIn, day.Add(time.Hour), 90*time.Second, "1.5000", "EUR"),
+		testCDR("rs1:0000000003", callOut, day.Add(time.Hour), 2*time.Minute, "10.0000", "EUR"),
+		testCDR("rs1:0000000001", callOut, day, time.Minute, "5.0000", "EUR"),
+		testCDR("rs1:0000000000", callOut, testPeriod.Add(-time.Minute), time.Minute, "5.0000", "EUR"),
+		uncharged,
+		otherRP,
+	)
+
+	batch, err := Build(records, testOptions())
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	control := batch.BatchControlInfo
+	if control.Sender != "DEUXY" || control.Recipient != "USAAB" || control.FileSequenceNumber != "00007" || control.FileTypeIndicator != "" {
+		t.Errorf("batch control info %+v", control)
+	}
+	if batch.AccountingInfo.TapCurrency != "EUR" || batch.AccountingInfo.TapDecimalPlaces != TapDecimalPlaces {
+		t.Errorf("accounting info %+v", batch.AccountingInfo)
+	}
+	want := []struct {
+		id     string
+		kind   string
+		charge int64
+	}{
+		{"cdr:rs1:0000000001", MobileOriginatedCall, 50000},
+		{"cdr:rs1:0000000002", MobileTerminatedCall, 15000},
+		{"cdr:rs1:0000000003", MobileOriginatedCall, 100000},
+	}
+	if len(batch.CallEvents) != len(want) {
+		t.Fatalf("got %d call events, want %d: %+v", len(batch.CallEvents), len(want), batch.CallEvents)
+	}
+	for i, w := range want {
+		if e := batch.CallEvents[i]; e.RecordID != w.id || e.Type != w.kind || e.ChargeInformation.Charge != w.charge {
+			t.Errorf("call event %d: %s %s %d, want %s %s %d", i, e.RecordID, e.Type, e.ChargeInformation.Charge, w.id, w.kind, w.charge)
+		}
+	}
+	audit := batch.AuditControlInfo
+	if audit.CallEventDetailsCount != 3 || audit.TotalCharge != 165000 ||
+		!audit.EarliestCallTimeStamp.Equal(day) || !audit.LatestCallTimeStamp.Equal(day.Add(time.Hour)) {
+		t.Errorf("audit control info %+v", audit)
+	}
+	totals := []EventTotal{
+		{Type: MobileOriginatedCall, Count: 2, Duration: 180, Charge: 150000},
+		{Type: MobileTerminatedCall, Count: 1, Duration: 90, Charge: 15000},
+	}
+	if fmt.Sprint(audit.Totals) != fmt.Sprint(totals) {
+		t.Errorf("totals %+v, want %+v", audit.Totals, totals)
+	}
+}
+
+func TestBuildRejectsMixedCurrencies(t *testing.T) {
+	day := testPeriod.Add(9 * time.Hour)
+	records := testDump(
+		testCDR("rs1:0000000001", callOut, day, time.Minute, "5.0000", "EUR"),
+		testCDR("rs1:0000000002", callOut, day.Add(time.Hour), time.Minute, "5.0000", "USD"),
+	)
+	if _, err := Build(records, testOptions()); err == nil || !strings.Contains(err.Error(), "USD") {
+		t.Errorf("Build of EUR and USD calls: %v, want an error", err)
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	valid := map[string]int64{
+		"12":                   120000,
+		"12.5":                 125000,
+		"0.0001":               1,
+		"-1.25":                -12500,
+		"-0.5":                 -5000,
+		"123.4567":             1234567,
+		"922337203685477.5807": 9223372036854775807,
+	}
+	for in, want := range valid {
+		if got, err := parseAmount(in); err != nil || got != want {
+			t.Errorf("parseAmount(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "-", ".5", "1.23456", "--1", "1.-5", "+1", "1e3", " 1", "922337203685477.5808", "99999999999999999999"} {
+		if got, err := parseAmount(in); err == nil {
+			t.Errorf("parseAmount(%q) = %d, want an error", in, got)
+		}
+	}
+}
+
+func TestBuildRejectsMalformedCharges(t *testing.T) {
+	for _, charges := range []string{"1.23456", "--1", "99999999999999999999"} {
+		records := testDump(testCDR("rs1:0000000001", callOut, testPeriod.Add(time.Hour), time.Minute, charges, "EUR"))
+		if _, err := Build(records, testOptions()); err == nil {
+			t.Errorf("Build of a CDR charging %q succeeded", charges)
+		}
+	}
+}
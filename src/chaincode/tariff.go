@@ -0,0 +1,368 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Rate cards are keyed by HO, RP and the time they take effect, so a range
+// scan over one pair returns every version of its tariff oldest first.
+// Usage on the home network is rated with the HO:HO card.
+//
+// A roaming card names the rate plan of the agreement it prices. Usage is
+// rated with the rate plan registered for the subscriber by updateRates,
+// the card in effect has to be of that plan, otherwise rating fails rather
+// than charge under terms the operators did not agree. Home cards have no
+// rate plan.
+var tariffPrefix = "tariff:"
+
+// Rated services of a rate card
+const (
+	rateVoiceOut = "voiceOut"
+	rateVoiceIn  = "voiceIn"
+	rateSMS      = "sms"
+	rateSMSIn    = "smsIn"
+	rateData     = "data"
+)
+
+// ServiceRate prices one service. Voice is priced per minute and measured in
+// seconds, SMS per message and data per MB measured in KB. SMS prices sent
+// messages, SMSIn received ones.
+type ServiceRate struct {
+	Price         Money  `json:"price"`
+	PeakPrice     Money  `json:"peakPrice"`
+	Increment     string `json:"increment"`
+	MinimumCharge Money  `json:"minimumCharge"`
+}
+
+// TimeBand is the daily peak window, "08:00" to "20:00", in the local time
+// of the roaming partner
+type TimeBand struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// RateCard is the tariff an RP charges an HO from EffectiveFrom onwards
+type RateCard struct {
+	HO            string      `json:"ho"`
+	RP            string      `json:"rp"`
+	RatePlan      string      `json:"ratePlan,omitempty"`
+	Currency      string      `json:"currency"`
+	EffectiveFrom time.Time   `json:"effectiveFrom"`
+	UTCOffset     int         `json:"utcOffset"`
+	Peak          *TimeBand   `json:"peak"`
+	VoiceOut      ServiceRate `json:"voiceOut"`
+	VoiceIn       ServiceRate `json:"voiceIn"`
+	SMS           ServiceRate `json:"sms"`
+	SMSIn         ServiceRate `json:"smsIn"`
+	Data          ServiceRate `json:"data"`
+}
+
+func tariffKey(ho string, rp string, effectiveFrom time.Time) string {
+	return tariffPrefix + ho + ":" + rp + ":" + effectiveFrom.UTC().Format(time.RFC3339)
+}
+
+//parseIncrement reads a billing increment such as "60/60" or "30/1"
+func parseIncrement(increment string) (int64, int64, error) {
+	if increment == "" {
+		return 1, 1, nil
+	}
+	parts := strings.Split(increment, "/")
+	if len(parts) != 2 {
+		return 0, 0, validationError("Invalid billing increment " + increment)
+	}
+	first, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || first <= 0 {
+		return 0, 0, validationError("Invalid billing increment " + increment)
+	}
+	next, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || next <= 0 {
+		return 0, 0, validationError("Invalid billing increment " + increment)
+	}
+	return first, next, nil
+}
+
+//billedUnits rounds the used units up to the billing increments
+func billedUnits(used int64, first int64, next int64) int64 {
+	if used <= 0 {
+		return 0
+	}
+	if used <= first {
+		return first
+	}
+	rest := used - first
+	return first + ((rest+next-1)/next)*next
+}
+
+//minutesOfDay parses "hh:mm"
+func minutesOfDay(hhmm string) (int, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, validationError("Invalid time of day " + hhmm)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+//isPeak reports whether at falls in the peak band of the card
+func (c RateCard) isPeak(at time.Time) bool {
+	if c.Peak == nil {
+		return false
+	}
+	start, err := minutesOfDay(c.Peak.Start)
+	if err != nil {
+		return false
+	}
+	end, err := minutesOfDay(c.Peak.End)
+	if err != nil {
+		return false
+	}
+	local := at.UTC().Add(time.Duration(c.UTCOffset) * time.Minute)
+	m := local.Hour()*60 + local.Minute()
+	if start <= end {
+		return m >= start && m < end
+	}
+	//band wraps around midnight
+	return m >= start || m < end
+}
+
+func (c RateCard) serviceRate(service string) (ServiceRate, int64, error) {
+	switch service {
+	case rateVoiceOut:
+		return c.VoiceOut, 60, nil
+	case rateVoiceIn:
+		return c.VoiceIn, 60, nil
+	case rateSMS:
+		return c.SMS, 1, nil
+	case rateSMSIn:
+		return c.SMSIn, 1, nil
+	case rateData:
+		return c.Data, 1024, nil
+	}
+	return ServiceRate{}, 0, validationError("Unknown rated service " + service)
+}
+
+//rate prices used units of a service started at time at
+func (c RateCard) rate(service string, used int64, at time.Time) (Money, error) {
+	sr, perPrice, err := c.serviceRate(service)
+	if err != nil {
+		return 0, err
+	}
+	first, next, err := parseIncrement(sr.Increment)
+	if err != nil {
+		return 0, err
+	}
+	billed := billedUnits(used, first, next)
+	if billed == 0 {
+		return 0, nil
+	}
+	price := sr.Price
+	if sr.PeakPrice != 0 && c.isPeak(at) {
+		price = sr.PeakPrice
+	}
+	charge, err := price.mulDiv(billed, perPrice)
+	if err != nil {
+		return 0, err
+	}
+	if charge < sr.MinimumCharge {
+		charge = sr.MinimumCharge
+	}
+	return charge, nil
+}
+
+//validate checks a rate card before it is written
+func (c RateCard) validate() error {
+	if c.HO == "" || c.RP == "" {
+		return validationError("Rate card needs both ho and rp")
+	}
+	if err := validateOperatorIDs(c.HO, c.RP); err != nil {
+		return err
+	}
+	if !validCurrency(c.Currency) {
+		return validationError("Rate card needs an ISO 4217 currency code")
+	}
+	if c.Peak != nil {
+		if _, err := minutesOfDay(c.Peak.Start); err != nil {
+			return err
+		}
+		if _, err := minutesOfDay(c.Peak.End); err != nil {
+			return err
+		}
+	}
+	for _, sr := range []ServiceRate{c.VoiceOut, c.VoiceIn, c.SMS, c.SMSIn, c.Data} {
+		if sr.Price < 0 || sr.PeakPrice < 0 || sr.MinimumCharge < 0 {
+			return validationError("Rate card prices can not be negative")
+		}
+		if _, _, err := parseIncrement(sr.Increment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putRateCard(stub shim.ChaincodeStubInterface, card RateCard) error {
+	key := tariffKey(card.HO, card.RP, card.EffectiveFrom)
+	bytes, err := json.Marshal(card)
+	if err != nil {
+		return internalError("Error marshalling rate card " + key)
+	}
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("Error - could not write rate card " + key)
+		return internalError("Error writing rate card " + key)
+	}
+	fmt.Println("Success, wrote rate card " + key)
+	return nil
+}
+
+//getRateCards returns every version of the tariff between ho and rp, oldest first
+func getRateCards(stub shim.ChaincodeStubInterface, ho string, rp string) ([]RateCard, error) {
+	cards := []RateCard{}
+	err := rangeByPrefix(stub, tariffPrefix+ho+":"+rp+":", func(key string, value []byte) error {
+		var card RateCard
+		if err := json.Unmarshal(value, &card); err != nil {
+			fmt.Println("Error unmarshalling rate card " + key)
+			return internalError("Error unmarshalling rate card " + key)
+		}
+		cards = append(cards, card)
+		return nil
+	})
+	return cards, err
+}
+
+//tariffAt returns the rate card between ho and rp in effect at time at, it has to be of the rate plan
+func tariffAt(stub shim.ChaincodeStubInterface, ho string, rp string, ratePlan string, at time.Time) (RateCard, error) {
+	if rp == "" {
+		rp = ho
+	}
+	cards, err := getRateCards(stub, ho, rp)
+	if err != nil {
+		return RateCard{}, err
+	}
+	found := -1
+	for i, card := range cards {
+		if !card.EffectiveFrom.After(at) {
+			found = i
+		}
+	}
+	if found < 0 {
+		return RateCard{}, notFoundError("No tariff between " + ho + " and " + rp + " at " + at.Format(time.RFC3339))
+	}
+	if cards[found].RatePlan != ratePlan {
+		return RateCard{}, conflictError("Tariff between " + ho + " and " + rp + " at " + at.Format(time.RFC3339) +
+			" is for rate plan '" + cards[found].RatePlan + "', the usage was registered under '" + ratePlan + "'")
+	}
+	return cards[found], nil
+}
+
+/*		0
+	json
+	{
+		"ho": "ABC",
+		"rp": "XYZ",
+		"ratePlan": "RoamingXYZ",                     (the rate plan of the agreement, none for home cards)
+		"currency": "EUR",
+		"effectiveFrom": "2017-01-01T00:00:00Z",
+		"utcOffset": 60,                              (minutes, local time of the RP)
+		"peak": {"start": "08:00", "end": "20:00"},   (optional)
+		"voiceOut": {"price": "0.25", "peakPrice": "0.35", "increment": "60/60", "minimumCharge": "0.10"},
+		"voiceIn": {"price": "0.05", "increment": "30/1"},
+		"sms": {"price": "0.10"},
+		"smsIn": {"price": "0"},                      (optional, received messages)
+		"data": {"price": "1.50", "increment": "10/10"}
+	}
+*/
+func (t *SimpleChaincode) createRateCard(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Creating rate card")
+	if err := checkArgs("createRateCard", args, 1, "rate card record"); err != nil {
+		return nil, err
+	}
+	var card RateCard
+	err := json.Unmarshal([]byte(args[0]), &card)
+	if err != nil {
+		return nil, validationError("Invalid rate card: " + err.Error())
+	}
+	err = card.validate()
+	if err != nil {
+		return nil, err
+	}
+	//The roaming partner publishes what it charges the home operator
+	err = requireOperatorOrRole(stub, "publish the tariff of "+card.RP+" for "+card.HO, []string{card.RP}, roleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := stub.GetState(tariffKey(card.HO, card.RP, card.EffectiveFrom))
+	if err != nil {
+		return nil, internalError("Error retrieving rate card")
+	}
+	if existing != nil {
+		return nil, conflictError("A rate card between " + card.HO + " and " + card.RP + " already takes effect at " + card.EffectiveFrom.Format(time.RFC3339))
+	}
+	return nil, putRateCard(stub, card)
+}
+
+//cdrService is the rated service of a call
+func cdrService(cdr callDetailRecord) string {
+	if cdr.TransType == "Call In" {
+		return rateVoiceIn
+	}
+	return rateVoiceOut
+}
+
+//cdrSeconds is the length of a call in started seconds
+func cdrSeconds(cdr callDetailRecord) int64 {
+	return int64(math.Ceil(cdr.EndTime.Sub(cdr.StartTime).Seconds()))
+}
+
+//rateCDR prices a call with the tariff of its rate plan in effect when it started
+func rateCDR(stub shim.ChaincodeStubInterface, cdr *callDetailRecord) error {
+	card, err := tariffAt(stub, cdr.HO, cdr.RP, cdr.RateType, cdr.StartTime)
+	if err != nil {
+		return err
+	}
+	charge, err := card.rate(cdrService(*cdr), cdrSeconds(*cdr), cdr.StartTime)
+	if err != nil {
+		return err
+	}
+	cdr.Charges = charge
+	cdr.Currency = card.Currency
+	return nil
+}
+
+//Query every version of the tariff between ho and rp
+func (t *SimpleChaincode) queryRateCards(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("queryRateCards called")
+	if err := checkArgs("queryRateCards", args, 2, "ho and rp"); err != nil {
+		return nil, err
+	}
+	if err := requireOperatorOrRole(stub, "read the tariff between "+args[0]+" and "+args[1], args, roleAuditor, roleAdmin); err != nil {
+		return nil, err
+	}
+	cards, err := getRateCards(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(cards)
+}
@@ -0,0 +1,127 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestBilledUnits(t *testing.T) {
+	cases := []struct {
+		increment string
+		used      int64
+		want      int64
+	}{
+		{"60/60", 0, 0},
+		{"60/60", 1, 60},
+		{"60/60", 60, 60},
+		{"60/60", 61, 120},
+		{"30/1", 10, 30},
+		{"30/1", 31, 31},
+		{"", 7, 7},
+		{"10/10", 15, 20},
+	}
+	for _, c := range cases {
+		first, next, err := parseIncrement(c.increment)
+		if err != nil {
+			t.Fatalf("parseIncrement(%q): %v", c.increment, err)
+		}
+		if got := billedUnits(c.used, first, next); got != c.want {
+			t.Errorf("%q billing of %d = %d, want %d", c.increment, c.used, got, c.want)
+		}
+	}
+	for _, bad := range []string{"60", "0/60", "60/0", "a/b", "60/60/60", "-1/1"} {
+		if _, _, err := parseIncrement(bad); err == nil {
+			t.Errorf("parseIncrement(%q) accepted", bad)
+		}
+	}
+}
+
+//minimalCard is the ABC:XYZ card of fixtures/minimal.json, peak from 08:00 to 20:00 in UTC+1
+func minimalCard(t *testing.T) RateCard {
+	var card RateCard
+	err := json.Unmarshal([]byte(`{"ho": "ABC", "rp": "XYZ", "ratePlan": "RoamingXYZ", "currency": "EUR", "utcOffset": 60,
+		"peak": {"start": "08:00", "end": "20:00"},
+		"voiceOut": {"price": "0.25", "peakPrice": "0.35", "increment": "60/60", "minimumCharge": "0.10"},
+		"voiceIn": {"price": "0.05", "increment": "30/1"}, "sms": {"price": "0.10"}, "data": {"price": "1.50", "increment": "10/10"}}`), &card)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = card.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return card
+}
+
+func TestRateCard(t *testing.T) {
+	card := minimalCard(t)
+	peak := time.Date(2017, 3, 1, 9, 0, 0, 0, time.UTC)
+	offPeak := time.Date(2017, 3, 1, 19, 30, 0, 0, time.UTC)
+	cases := []struct {
+		service string
+		used    int64
+		at      time.Time
+		want    string
+	}{
+		{rateVoiceOut, 61, peak, "0.7000"},
+		{rateVoiceOut, 61, offPeak, "0.5000"},
+		{rateVoiceOut, 1, offPeak, "0.2500"},
+		{rateVoiceOut, 0, offPeak, "0.0000"},
+		{rateVoiceIn, 10, peak, "0.0250"},
+		{rateVoiceIn, 45, peak, "0.0375"},
+		{rateSMS, 1, peak, "0.1000"},
+		{rateSMSIn, 1, peak, "0.0000"},
+		{rateData, 15, peak, "0.0293"},
+	}
+	for _, c := range cases {
+		got, err := card.rate(c.service, c.used, c.at)
+		if err != nil {
+			t.Fatalf("rate %s: %v", c.service, err)
+		}
+		if got.String() != c.want {
+			t.Errorf("%s of %d at %s = %s, want %s", c.service, c.used, c.at.Format("15:04"), got, c.want)
+		}
+	}
+	//A call billed below the minimum charge costs the minimum charge
+	card.VoiceOut.Price = moneyScale / 100
+	if got, _ := card.rate(rateVoiceOut, 1, offPeak); got != card.VoiceOut.MinimumCharge {
+		t.Errorf("short call charged %s, want the minimum charge %s", got, card.VoiceOut.MinimumCharge)
+	}
+}
+
+func TestCallPayRatesWithTheTariff(t *testing.T) {
+	l := newTestLedger(t)
+	l.roam("rs1", "XYZ")
+	l.call("rs1", "4930123456", 90*time.Second)
+	l.mustInvoke("CallIn", "rs1", "4930123456")
+	l.advance(30 * time.Second)
+	l.mustInvoke("CallEnd", "rs1")
+	l.mustInvoke("CallPay", "rs1")
+
+	cdrs := l.cdrs("rs1")
+	if len(cdrs) != 2 {
+		t.Fatalf("got %d CDRs, want 2", len(cdrs))
+	}
+	for i, want := range []string{"7.5000", "0.5000"} {
+		if cdrs[i].Charges.String() != want || cdrs[i].Currency != "EUR" || cdrs[i].Status != cdrStatusCharged {
+			t.Errorf("CDR %d charged %s %s (%s), want %s EUR", i+1, cdrs[i].Charges, cdrs[i].Currency, cdrs[i].Status, want)
+		}
+	}
+}
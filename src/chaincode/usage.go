@@ -0,0 +1,393 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Data sessions and SMS are recorded next to the voice CDRs, each under its
+// own prefix. Both take their sequence number from the UsageSeq counter of
+// the subscriber, so keys sort by subscriber and then in time order.
+//
+// Usage runs alongside calls and does not move the session state, but the
+// subscriber must have registered rates first. The subscriber Time is left
+// alone because it marks the start of a call in progress.
+var (
+	dataPrefix = "data:"
+	smsPrefix  = "sms:"
+)
+
+// Usage record status values. A data session is written Open when it
+// starts and Charged when it ends; an SMS is charged when it is recorded.
+const (
+	usageStatusOpen    = "Open"
+	usageStatusCharged = "Charged"
+)
+
+// SMS directions
+const (
+	smsOut = "SMS Out"
+	smsIn  = "SMS In"
+)
+
+// DataSessionRecord is a single packet data session
+type DataSessionRecord struct {
+	RecordID  string    `json:"recordid"`
+	PublicKey string    `json:"publickey"`
+	Seq       int       `json:"seq"`
+	TxID      string    `json:"txid"`
+	MSISDN    string    `json:"msisdn"`
+	HO        string    `json:"ho"`
+	RP        string    `json:"rp"`
+	RateType  string    `json:"ratetype"`
+	StartTime time.Time `json:"starttime"`
+	EndTime   time.Time `json:"endtime"`
+	Bytes     int64     `json:"bytes"`
+	Charges   Money     `json:"charges"`
+	Currency  string    `json:"currency"`
+	Status    string    `json:"status"`
+}
+
+// SMSRecord is a single sent or received short message
+type SMSRecord struct {
+	RecordID     string    `json:"recordid"`
+	PublicKey    string    `json:"publickey"`
+	Seq          int       `json:"seq"`
+	TxID         string    `json:"txid"`
+	MSISDN       string    `json:"msisdn"`
+	HO           string    `json:"ho"`
+	RP           string    `json:"rp"`
+	RateType     string    `json:"ratetype"`
+	TransType    string    `json:"transtype"`
+	CallingParty string    `json:"callingparty"`
+	Destination  string    `json:"destination"`
+	Time         time.Time `json:"time"`
+	Charges      Money     `json:"charges"`
+	Currency     string    `json:"currency"`
+	Status       string    `json:"status"`
+}
+
+// UsageRecords is the result of queryUsage
+type UsageRecords struct {
+	DataSessions []DataSessionRecord `json:"dataSessions"`
+	SMS          []SMSRecord         `json:"sms"`
+}
+
+func dataKey(publicKey string, seq int) string {
+	return fmt.Sprintf("%s%s:%010d", dataPrefix, publicKey, seq)
+}
+
+func smsKey(publicKey string, seq int) string {
+	return fmt.Sprintf("%s%s:%010d", smsPrefix, publicKey, seq)
+}
+
+//putUsage writes a usage record, refusing to touch one that is already charged
+func putUsage(stub shim.ChaincodeStubInterface, key string, record interface{}) error {
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return internalError("Error retrieving usage record " + key)
+	}
+	if existing != nil {
+		var old struct {
+			Status string `json:"status"`
+		}
+		if err = json.Unmarshal(existing, &old); err == nil && old.Status == usageStatusCharged {
+			fmt.Println("Error - usage record is already charged : " + key)
+			return conflictError("Usage record " + key + " is already charged and can not be modified")
+		}
+	}
+	bytes, err := json.Marshal(record)
+	if err != nil {
+		return internalError("Error marshalling usage record " + key)
+	}
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("Error - could not write usage record " + key)
+		return internalError("Error writing usage record " + key)
+	}
+	fmt.Println("Success, wrote usage record " + key)
+	return nil
+}
+
+func getDataSession(stub shim.ChaincodeStubInterface, key string) (DataSessionRecord, error) {
+	var rec DataSessionRecord
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return rec, internalError("Error retrieving data session " + key)
+	}
+	if bytes == nil {
+		return rec, notFoundError("Data session not found " + key)
+	}
+	if err = json.Unmarshal(bytes, &rec); err != nil {
+		return rec, internalError("Error unmarshalling data session " + key)
+	}
+	return rec, nil
+}
+
+//getDataSessions returns all the data sessions of a subscriber in time order
+func getDataSessions(stub shim.ChaincodeStubInterface, publicKey string) ([]DataSessionRecord, error) {
+	records := []DataSessionRecord{}
+	err := rangeByPrefix(stub, dataPrefix+publicKey+":", func(key string, value []byte) error {
+		var rec DataSessionRecord
+		if err := json.Unmarshal(value, &rec); err != nil {
+			return internalError("Error unmarshalling data session " + key)
+		}
+		records = append(records, rec)
+		return nil
+	})
+	return records, err
+}
+
+//getSMSRecords returns all the SMS of a subscriber in time order
+func getSMSRecords(stub shim.ChaincodeStubInterface, publicKey string) ([]SMSRecord, error) {
+	records := []SMSRecord{}
+	err := rangeByPrefix(stub, smsPrefix+publicKey+":", func(key string, value []byte) error {
+		var rec SMSRecord
+		if err := json.Unmarshal(value, &rec); err != nil {
+			return internalError("Error unmarshalling SMS " + key)
+		}
+		records = append(records, rec)
+		return nil
+	})
+	return records, err
+}
+
+//rateUsage prices used units of a service with the tariff of the rate plan in effect at time at
+func rateUsage(stub shim.ChaincodeStubInterface, ho string, rp string, ratePlan string, service string, used int64, at time.Time) (Money, string, error) {
+	card, err := tariffAt(stub, ho, rp, ratePlan, at)
+	if err != nil {
+		return 0, "", err
+	}
+	charge, err := card.rate(service, used, at)
+	if err != nil {
+		return 0, "", err
+	}
+	return charge, card.Currency, nil
+}
+
+//usageSubscriber loads a subscriber that is about to record usage on its serving network
+func usageSubscriber(stub shim.ChaincodeStubInterface, key string, action string) (rsDetailBlock, time.Time, error) {
+	rs, err := getSubscriber(stub, key)
+	if err != nil {
+		return rs, time.Time{}, err
+	}
+	if err = requireServingNetwork(stub, rs, action); err != nil {
+		return rs, time.Time{}, err
+	}
+	if err = requireRatesRegistered(rs, action); err != nil {
+		return rs, time.Time{}, err
+	}
+	at, err := txTime(stub)
+	return rs, at, err
+}
+
+//Start a data session
+//	args: subscriber key
+func (t *SimpleChaincode) DataSessionStart(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("DataSessionStart called")
+	if err := checkArgs("DataSessionStart", args, 1, "subscriber key"); err != nil {
+		return nil, err
+	}
+	rs, at, err := usageSubscriber(stub, args[0], "record data sessions")
+	if err != nil {
+		return nil, err
+	}
+	if rs.CurrentData != "" {
+		return nil, conflictError("Data session " + rs.CurrentData + " of " + rs.PublicKey + " is still open")
+	}
+	if err = requireService(stub, rs, serviceData, at); err != nil {
+		return nil, err
+	}
+	rs.UsageSeq = rs.UsageSeq + 1
+	rec := DataSessionRecord{
+		RecordID:  dataKey(rs.PublicKey, rs.UsageSeq),
+		PublicKey: rs.PublicKey,
+		Seq:       rs.UsageSeq,
+		TxID:      stub.GetTxID(),
+		MSISDN:    mask(rs.MSISDN),
+		HO:        rs.HO,
+		RP:        rs.RP,
+		RateType:  rs.RateType,
+		StartTime: at,
+		Status:    usageStatusOpen,
+	}
+	if err = putUsage(stub, rec.RecordID, rec); err != nil {
+		return nil, err
+	}
+	rs.CurrentData = rec.RecordID
+	if err = putSubscriber(stub, rs); err != nil {
+		return nil, err
+	}
+
+	event := newEvent(stub, eventDataStarted, rs, at, DataEvent{RecordID: rec.RecordID})
+	return nil, setEvents(stub, []RoamingEvent{event})
+}
+
+//End the open data session and charge its volume
+//	args: subscriber key, bytes
+func (t *SimpleChaincode) DataSessionEnd(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("DataSessionEnd called")
+	if err := checkArgs("DataSessionEnd", args, 2, "subscriber key and bytes"); err != nil {
+		return nil, err
+	}
+	volume, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || volume < 0 {
+		return nil, validationError("Invalid byte count " + args[1])
+	}
+	rs, at, err := usageSubscriber(stub, args[0], "record data sessions")
+	if err != nil {
+		return nil, err
+	}
+	if rs.CurrentData == "" {
+		return nil, conflictError("No data session open for " + rs.PublicKey)
+	}
+	rec, err := getDataSession(stub, rs.CurrentData)
+	if err != nil {
+		return nil, err
+	}
+	//The volume is rated and settled to the network that opened the session
+	if rec.RP != rs.RP {
+		return nil, conflictError("Data session " + rec.RecordID + " was opened on " + rec.RP + ", only it can end the session")
+	}
+	rec.EndTime = at
+	rec.Bytes = volume
+	//Data is priced per MB and measured in KB
+	rec.Charges, rec.Currency, err = rateUsage(stub, rec.HO, rec.RP, rec.RateType, rateData, (volume+1023)/1024, rec.StartTime)
+	if err != nil {
+		fmt.Println("Error - could not rate data session : " + err.Error())
+		return nil, err
+	}
+	rec.Status = usageStatusCharged
+	if err = putUsage(stub, rec.RecordID, rec); err != nil {
+		return nil, err
+	}
+	planEvents, err := chargeAllowance(stub, &rs, rateData, volume, rec.Charges, rec.Currency, at)
+	if err != nil {
+		return nil, err
+	}
+	rs.CurrentData = ""
+	if err = putSubscriber(stub, rs); err != nil {
+		return nil, err
+	}
+
+	event := newEvent(stub, eventDataEnded, rs, at, DataEvent{RecordID: rec.RecordID, Bytes: rec.Bytes, Charges: rec.Charges, Currency: rec.Currency})
+	return nil, setEvents(stub, append([]RoamingEvent{event}, planEvents...))
+}
+
+//recordSMS writes and charges a sent or received SMS
+func recordSMS(stub shim.ChaincodeStubInterface, key string, direction string, party string) ([]byte, error) {
+	rs, at, err := usageSubscriber(stub, key, "record SMS")
+	if err != nil {
+		return nil, err
+	}
+	if err = requireService(stub, rs, serviceSMS, at); err != nil {
+		return nil, err
+	}
+	rs.UsageSeq = rs.UsageSeq + 1
+	rec := SMSRecord{
+		RecordID:     smsKey(rs.PublicKey, rs.UsageSeq),
+		PublicKey:    rs.PublicKey,
+		Seq:          rs.UsageSeq,
+		TxID:         stub.GetTxID(),
+		MSISDN:       mask(rs.MSISDN),
+		HO:           rs.HO,
+		RP:           rs.RP,
+		RateType:     rs.RateType,
+		TransType:    direction,
+		CallingParty: mask(rs.MSISDN),
+		Destination:  mask(party),
+		Time:         at,
+		Status:       usageStatusCharged,
+	}
+	service := rateSMS
+	name := eventSMSSent
+	if direction == smsIn {
+		rec.CallingParty = mask(party)
+		rec.Destination = mask(rs.MSISDN)
+		service = rateSMSIn
+		name = eventSMSReceived
+	}
+	rec.Charges, rec.Currency, err = rateUsage(stub, rec.HO, rec.RP, rec.RateType, service, 1, at)
+	if err != nil {
+		fmt.Println("Error - could not rate SMS : " + err.Error())
+		return nil, err
+	}
+	if err = putUsage(stub, rec.RecordID, rec); err != nil {
+		return nil, err
+	}
+	planEvents, err := chargeAllowance(stub, &rs, service, 1, rec.Charges, rec.Currency, at)
+	if err != nil {
+		return nil, err
+	}
+	if err = putSubscriber(stub, rs); err != nil {
+		return nil, err
+	}
+
+	event := newEvent(stub, name, rs, at, SMSEvent{RecordID: rec.RecordID, TransType: direction, CallingParty: mask(rec.CallingParty), Destination: mask(rec.Destination), Charges: rec.Charges, Currency: rec.Currency})
+	return nil, setEvents(stub, append([]RoamingEvent{event}, planEvents...))
+}
+
+//Record an SMS sent by the subscriber
+//	args: subscriber key, destination msisdn
+func (t *SimpleChaincode) SMSOut(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("SMSOut called")
+	if err := checkArgs("SMSOut", args, 2, "subscriber key and destination msisdn"); err != nil {
+		return nil, err
+	}
+	return recordSMS(stub, args[0], smsOut, args[1])
+}
+
+//Record an SMS received by the subscriber
+//	args: subscriber key, calling msisdn
+func (t *SimpleChaincode) SMSIn(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("SMSIn called")
+	if err := checkArgs("SMSIn", args, 2, "subscriber key and calling msisdn"); err != nil {
+		return nil, err
+	}
+	return recordSMS(stub, args[0], smsIn, args[1])
+}
+
+//Query the data sessions and SMS of a subscriber
+//	args: subscriber key
+func (t *SimpleChaincode) queryUsage(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("queryUsage called")
+	if err := checkArgs("queryUsage", args, 1, "subscriber key"); err != nil {
+		return nil, err
+	}
+	rs, err := getSubscriber(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = requireSubscriberRead(stub, rs); err != nil {
+		return nil, err
+	}
+	var usage UsageRecords
+	if usage.DataSessions, err = getDataSessions(stub, rs.PublicKey); err != nil {
+		return nil, err
+	}
+	if usage.SMS, err = getSMSRecords(stub, rs.PublicKey); err != nil {
+		return nil, err
+	}
+	return json.Marshal(usageViews(stub, rs.HO, usage))
+}
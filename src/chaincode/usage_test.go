@@ -0,0 +1,43 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License .
+*/
+
+package main
+
+import "testing"
+
+func TestDataSessionStaysWithItsNetwork(t *testing.T) {
+	l := newTestLedger(t)
+	l.asRole(roleAdmin).mustInvoke("registerOperator", `{"id": "DEF", "tadig": "FRADF", "mccmnc": ["208-01"], "name": "DEF", "settlementCurrency": "EUR"}`)
+	l.roam("rs1", "XYZ")
+	l.mustInvoke("DataSessionStart", "rs1")
+
+	//The subscriber can not move on, so DEF never gets to end the session of XYZ
+	l.asOperator("DEF").mustFail(codeStateConflict, "discoverRP", "rs1", "DEF", "PARIS", "48.85", "2.35")
+	l.asOperator("ABC").mustFail(codeStateConflict, "discoverRP", "rs1", "DEF", "PARIS", "48.85", "2.35")
+	l.mustFail(codeUnauthorized, "DataSessionEnd", "rs1", "1")
+	if rs := l.subscriber("rs1"); rs.RP != "XYZ" || rs.State != stateRatesRegistered {
+		t.Fatalf("subscriber on %s in state %s", rs.RP, rs.State)
+	}
+
+	l.asOperator("XYZ").mustInvoke("DataSessionEnd", "rs1", "1048576")
+	var usage UsageRecords
+	l.mustQuery(&usage, "queryUsage", "rs1")
+	if len(usage.DataSessions) != 1 || usage.DataSessions[0].RP != "XYZ" || usage.DataSessions[0].Status != usageStatusCharged {
+		t.Errorf("data sessions %+v", usage.DataSessions)
+	}
+	l.asOperator("DEF").mustInvoke("discoverRP", "rs1", "DEF", "PARIS", "48.85", "2.35")
+}
@@ -142,9 +142,16 @@ function deploy(enrolledUser, chaincode_path, cert_path, cb) {
         console.error(TAG, 'Error creating /tmp directory for chaincode:', err.message);
     }
 
+    // Init loads the demo dataset unless CHAINCODE_FIXTURE names a fixture file, see fixtures/
+    var args = [];
+    if (process.env.CHAINCODE_FIXTURE) {
+        console.log(TAG, 'Deploying with fixture', process.env.CHAINCODE_FIXTURE);
+        args.push(fs.readFileSync(process.env.CHAINCODE_FIXTURE, 'utf8'));
+    }
+
     var deployRequest = {
         fcn: 'init',
-        args: ['a', '100'],
+        args: args,
         chaincodePath: chaincode_path,
         certificatePath: cert_path
     };
@@ -20,6 +20,10 @@ var async = require('async');
 
 var debug = true;  
 
+// The chaincode authorizes every call on these attributes of the caller's enrollment certificate, so they have
+// to be copied into the transaction certificate of every invoke and query.
+var certAttributes = ['role', 'operator', 'subscriber'];
+
 /**
  * A helper object for interacting with the commercial paper chaincode.  Has functions for all of the query and invoke
  * functions that are present in the chaincode.
@@ -81,6 +85,26 @@ CPChaincode.prototype.queryMSISDN = function (enrollID, inputArgs, cb) {
     });
 };
 
+CPChaincode.prototype.queryMSISDNDigest = function (enrollID, inputArgs, cb) {
+    console.log(TAG, 'queryMSISDNDigest - chaincode_ops:', enrollID);
+
+    // A query is answered by the peer and not recorded, so the number can go to it in clear
+    var queryMSISDNDigest = {
+        chaincodeID: this.chaincodeID,
+        fcn: 'queryMSISDNDigest',
+        args: inputArgs
+    };
+
+    query(this.chain, enrollID, queryMSISDNDigest, function (err, qResponse) {
+        if (err) {
+            console.error(TAG, 'failed to get queryMSISDNDigest:', err);
+            return cb(err);
+        }
+
+        cb(null, qResponse.toString());
+    });
+};
+
 CPChaincode.prototype.enterData = function (uid, inputArgs, cb) {
     console.log(TAG, '- enterData uid: ', uid);
     console.log(TAG, '- enterData input args: ', JSON.stringify(inputArgs));
@@ -164,6 +188,106 @@ CPChaincode.prototype.CallOut = function (uid, inputArgs, cb) {
     });
 };
 
+CPChaincode.prototype.CallIn = function (uid, inputArgs, cb) {
+    console.log(TAG, '- CallIn uid: ', uid);
+    console.log(TAG, '- CallIn input args: ', JSON.stringify(inputArgs));
+    var CallIn = {
+        chaincodeID: this.chaincodeID,
+        fcn: 'CallIn',
+        args: inputArgs
+    };
+
+    invoke(this.chain, uid, CallIn, function (err, result) {
+        if (err) {
+            console.error(TAG, 'failed CallIn:', err);
+            return cb(err);
+        }
+
+        console.log(TAG, 'CallIn successfully:', JSON.stringify(result));
+        cb(null, result);
+    });
+};
+
+CPChaincode.prototype.DataSessionStart = function (uid, inputArgs, cb) {
+    console.log(TAG, '- DataSessionStart uid: ', uid);
+    console.log(TAG, '- DataSessionStart input args: ', JSON.stringify(inputArgs));
+    var DataSessionStart = {
+        chaincodeID: this.chaincodeID,
+        fcn: 'DataSessionStart',
+        args: inputArgs
+    };
+
+    invoke(this.chain, uid, DataSessionStart, function (err, result) {
+        if (err) {
+            console.error(TAG, 'failed DataSessionStart:', err);
+            return cb(err);
+        }
+
+        console.log(TAG, 'DataSessionStart successfully:', JSON.stringify(result));
+        cb(null, result);
+    });
+};
+
+CPChaincode.prototype.DataSessionEnd = function (uid, inputArgs, cb) {
+    console.log(TAG, '- DataSessionEnd uid: ', uid);
+    console.log(TAG, '- DataSessionEnd input args: ', JSON.stringify(inputArgs));
+    var DataSessionEnd = {
+        chaincodeID: this.chaincodeID,
+        fcn: 'DataSessionEnd',
+        args: inputArgs
+    };
+
+    invoke(this.chain, uid, DataSessionEnd, function (err, result) {
+        if (err) {
+            console.error(TAG, 'failed DataSessionEnd:', err);
+            return cb(err);
+        }
+
+        console.log(TAG, 'DataSessionEnd successfully:', JSON.stringify(result));
+        cb(null, result);
+    });
+};
+
+CPChaincode.prototype.SMSOut = function (uid, inputArgs, cb) {
+    console.log(TAG, '- SMSOut uid: ', uid);
+    console.log(TAG, '- SMSOut input args: ', JSON.stringify(inputArgs));
+    var SMSOut = {
+        chaincodeID: this.chaincodeID,
+        fcn: 'SMSOut',
+        args: inputArgs
+    };
+
+    invoke(this.chain, uid, SMSOut, function (err, result) {
+        if (err) {
+            console.error(TAG, 'failed SMSOut:', err);
+            return cb(err);
+        }
+
+        console.log(TAG, 'SMSOut successfully:', JSON.stringify(result));
+        cb(null, result);
+    });
+};
+
+CPChaincode.prototype.SMSIn = function (uid, inputArgs, cb) {
+    console.log(TAG, '- SMSIn uid: ', uid);
+    console.log(TAG, '- SMSIn input args: ', JSON.stringify(inputArgs));
+    var SMSIn = {
+        chaincodeID: this.chaincodeID,
+        fcn: 'SMSIn',
+        args: inputArgs
+    };
+
+    invoke(this.chain, uid, SMSIn, function (err, result) {
+        if (err) {
+            console.error(TAG, 'failed SMSIn:', err);
+            return cb(err);
+        }
+
+        console.log(TAG, 'SMSIn successfully:', JSON.stringify(result));
+        cb(null, result);
+    });
+};
+
 CPChaincode.prototype.CallEnd = function (uid, inputArgs, cb) {
     console.log(TAG, '- CallEnd uid: ', uid);
     console.log(TAG, '- CallEnd input args: ', JSON.stringify(inputArgs));
@@ -246,6 +370,26 @@ CPChaincode.prototype.resetInventory = function (uid, inputArgs, cb) {
     });
 };
 
+CPChaincode.prototype.forgetSubscriber = function (uid, inputArgs, cb) {
+    console.log(TAG, '- forgetSubscriber uid: ', uid);
+    console.log(TAG, '- forgetSubscriber input args: ', JSON.stringify(inputArgs));
+    var forgetSubscriber = {
+        chaincodeID: this.chaincodeID,
+        fcn: 'forgetSubscriber',
+        args: inputArgs
+    };
+
+    invoke(this.chain, uid, forgetSubscriber, function (err, result) {
+        if (err) {
+            console.error(TAG, 'failed forgetSubscriber:', err);
+            return cb(err);
+        }
+
+        console.log(TAG, 'forgetSubscriber successfully:', JSON.stringify(result));
+        cb(null, result);
+    });
+};
+
 /**
  * Query the chaincode for the full list of commercial papers.
  * @param enrollID The user that the query should be submitted through.
@@ -325,6 +469,7 @@ function doInvoke(chain, enrollID, requestBody, cb) {
         } else {
             if (debug) console.log(TAG, 'successfully got member:', enrollID);
 
+            requestBody.attrs = certAttributes;
             if (debug) console.log(TAG, 'invoke body:', JSON.stringify(requestBody));
             var invokeTx = usr.invoke(requestBody);
 
@@ -393,6 +538,7 @@ function doQuery(chain, enrollID, requestBody, cb) {
         } else {
             if (debug) console.log(TAG, 'successfully got member:', enrollID);
 
+            requestBody.attrs = certAttributes;
             if (debug) console.log(TAG, 'query body:', JSON.stringify(requestBody));
             var queryTx = usr.query(requestBody);
 
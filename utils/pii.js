@@ -0,0 +1,125 @@
+'use strict';
+/*******************************************************************************
+ * Protects the personal data of a subscriber before it is sent to the chaincode
+ * with enterData. The fields are sealed with AES-256-GCM under a key of the
+ * subscriber and every field gets a commitment, the HMAC-SHA256 of its value
+ * under a salt of its own. Key and salts stay in a file store, one JSON file
+ * per subscriber in the same layout as the file store of the Go pii package
+ * (src/chaincode/pii), so piivault can reveal what this module protected.
+ *******************************************************************************/
+
+// For logging
+var TAG = 'pii:';
+
+var crypto = require('crypto');
+var fs = require('fs');
+var path = require('path');
+
+// Protected fields, in the order the chaincode expects their commitments
+var FIELDS = ['name', 'address', 'msisdn', 'lat', 'long'];
+
+var KEY_SIZE = 32;
+var SALT_SIZE = 16;
+var NONCE_SIZE = 12;
+
+/**
+ * A file store of subscriber secrets.
+ * @param dir The directory of the store, created when missing.
+ * @constructor
+ */
+function FileStore(dir) {
+    if (!(this instanceof FileStore))
+        return new FileStore(dir);
+    if (!fs.existsSync(dir)) {
+        fs.mkdirSync(dir, parseInt('0700', 8));
+    }
+    this.dir = dir;
+}
+
+FileStore.prototype.file = function (publicKey) {
+    if (!/^[A-Za-z0-9_-][A-Za-z0-9._-]*$/.test(publicKey)) {
+        throw new Error('subscriber key ' + publicKey + ' can not be used as a file name');
+    }
+    return path.join(this.dir, publicKey + '.json');
+};
+
+/**
+ * Reads the secrets of a subscriber, creating them on first use.
+ * @param publicKey The subscriber key.
+ * @returns {{key: Buffer, salts: Object}}
+ */
+FileStore.prototype.secrets = function (publicKey) {
+    var file = this.file(publicKey);
+    var stored;
+    if (fs.existsSync(file)) {
+        stored = JSON.parse(fs.readFileSync(file, 'utf8'));
+    } else {
+        console.log(TAG, 'creating secrets of', publicKey);
+        stored = {publicKey: publicKey, key: crypto.randomBytes(KEY_SIZE).toString('base64'), salts: {}};
+        FIELDS.forEach(function (field) {
+            stored.salts[field] = crypto.randomBytes(SALT_SIZE).toString('base64');
+        });
+        fs.writeFileSync(file, JSON.stringify(stored), {mode: parseInt('0600', 8)});
+    }
+    var salts = {};
+    FIELDS.forEach(function (field) {
+        salts[field] = Buffer.from(stored.salts[field], 'base64');
+    });
+    return {key: Buffer.from(stored.key, 'base64'), salts: salts};
+};
+
+/**
+ * Destroys the secrets of a subscriber, the blobs sealed with its key can not
+ * be opened any more. Forgetting a subscriber the store holds nothing for is
+ * not an error.
+ * @param publicKey The subscriber key.
+ */
+FileStore.prototype.forget = function (publicKey) {
+    var file = this.file(publicKey);
+    if (fs.existsSync(file)) {
+        console.log(TAG, 'destroying secrets of', publicKey);
+        fs.unlinkSync(file);
+    }
+};
+
+/**
+ * Seals a subscriber record and commits to its fields.
+ * @param store A FileStore.
+ * @param publicKey The subscriber key.
+ * @param record The personal data, {name, address, msisdn, lat, long}.
+ * @returns {{blob: string, commitments: Array}} The pii argument of enterData.
+ */
+function protect(store, publicKey, record) {
+    var secrets = store.secrets(publicKey);
+    var plain = {};
+    FIELDS.forEach(function (field) {
+        plain[field] = String(record[field] || '');
+    });
+
+    // Same layout as Go's cipher.AEAD: nonce, ciphertext, tag. The subscriber key is the additional data.
+    var nonce = crypto.randomBytes(NONCE_SIZE);
+    var cipher = crypto.createCipheriv('aes-256-gcm', secrets.key, nonce);
+    cipher.setAAD(Buffer.from(publicKey, 'utf8'));
+    var sealed = Buffer.concat([cipher.update(JSON.stringify(plain), 'utf8'), cipher.final()]);
+    var blob = Buffer.concat([nonce, sealed, cipher.getAuthTag()]);
+
+    return {
+        blob: blob.toString('base64'),
+        commitments: FIELDS.map(function (field) {
+            var hash = crypto.createHmac('sha256', secrets.salts[field]).update(plain[field], 'utf8').digest('hex');
+            return {field: field, hash: hash};
+        })
+    };
+}
+
+/**
+ * Rounds a latitude or longitude to the two decimals the chaincode takes.
+ */
+function coarse(position) {
+    var value = parseFloat(position);
+    return isNaN(value) ? position : value.toFixed(2);
+}
+
+module.exports.FileStore = FileStore;
+module.exports.protect = protect;
+module.exports.coarse = coarse;
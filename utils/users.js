@@ -71,10 +71,15 @@ module.exports.enrollUser = function (enrollID, enrollSecret, cb) {
 /**
  * Registers a new user in the membership service for the blockchain network.
  * @param enrollID The name of the user we want to register.
+ * @param attributes Optional certificate attributes the chaincode authorizes on, ex. {role: 'operator', operator: 'ABC'}
  * @param cb A callback of the form: function(error, user_credentials)
  */
-module.exports.registerUser = function (enrollID, cb) {
+module.exports.registerUser = function (enrollID, attributes, cb) {
     console.log(TAG, 'registerUser() called');
+    if (typeof attributes === 'function') {
+        cb = attributes;
+        attributes = {};
+    }
 
     if (!chain) {
         cb(new Error('Cannot register a user before setup() is called.'));
@@ -86,8 +91,12 @@ module.exports.registerUser = function (enrollID, cb) {
             console.log(TAG, 'Sending registration request for:', enrollID);
             var registrationRequest = {
                 enrollmentID: enrollID,
-                affiliation: 'group1'
+                affiliation: 'group1',
+                attributes: []
             };
+            for (var name in attributes) {
+                registrationRequest.attributes.push({name: name, value: attributes[name]});
+            }
             usr.register(registrationRequest, function (err, enrollSecret) {
                 if (err) {
                     cb(err);